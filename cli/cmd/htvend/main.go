@@ -24,8 +24,15 @@ func main() {
 		app.FlagsCommon
 		Build   htvend.BuildCommand   `command:"build" description:"Run command to create/update the manifest file"`
 		Verify  htvend.VerifyCommand  `command:"verify" description:"Verify and fetch any missing assets in the manifest file"`
+		Update  htvend.UpdateCommand  `command:"update" description:"Re-fetch selected assets from upstream and update the manifest file"`
 		Export  htvend.ExportCommand  `command:"export" description:"Export referenced assets to directory"`
 		Offline htvend.OfflineCommand `command:"offline" description:"Serve assets to command, don't allow other outbound requests"`
+		Serve   htvend.ServeCommand   `command:"serve" description:"Run a long-lived proxy server, controlled via an API"`
+		Config  htvend.ConfigCommand  `command:"config" description:"Write container runtime config to pull images via a running proxy server"`
+
+		PullImage htvend.PullImageCommand `command:"pull-image" description:"Fetch container images for the selected platforms, and record them in the manifest file"`
+
+		IsolatedExec htvend.IsolatedExecCommand `command:"isolated-exec" hidden:"yes" description:"Used internally by --isolate-network"`
 	}{}
 	// not 100% clear to me why we need to wrap opts.FlagsCommon.Apply, but I suspect it's because the value changes
 	// and it's not a proper pointer? Anyway this works, and not doing so doesn't.
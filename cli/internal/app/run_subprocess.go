@@ -30,10 +30,21 @@ type SubprocessOptions struct {
 }
 
 func RunSubprocess(ctx context.Context, prompt string, opts SubprocessOptions, extraEnv []string) error {
+	cmd, err := MakeSubprocessCommand(ctx, prompt, opts, extraEnv)
+	if err != nil {
+		return err
+	}
+	defer logrus.Debugf("(terminated)")
+
+	return cmd.Run()
+}
+
+// MakeSubprocessCommand returns the command that RunSubprocess would run, so that callers can modify it first
+func MakeSubprocessCommand(ctx context.Context, prompt string, opts SubprocessOptions, extraEnv []string) (*exec.Cmd, error) {
 	if opts.Process == "" { // then assume shell
 		opts.Process = os.Getenv("SHELL")
 		if opts.Process == "" {
-			return fmt.Errorf("no args specified, and unable to find SHELL envariable to default to")
+			return nil, fmt.Errorf("no args specified, and unable to find SHELL envariable to default to")
 		}
 		opts.Args = nil
 		if strings.HasSuffix(opts.Process, "bash") {
@@ -55,7 +66,6 @@ func RunSubprocess(ctx context.Context, prompt string, opts SubprocessOptions, e
 		logrus.Debugf("export %s", e)
 	}
 	logrus.Debugf("%s %s", opts.Process, strings.Join(opts.Args, " "))
-	defer logrus.Debugf("(terminated)")
 
-	return cmd.Run()
+	return cmd, nil
 }
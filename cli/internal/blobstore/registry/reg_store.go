@@ -26,6 +26,7 @@ import (
 	"strings"
 
 	"github.com/continusec/htvend/internal/blobstore"
+	"github.com/continusec/htvend/internal/registryauthclient"
 	"github.com/sirupsen/logrus"
 )
 
@@ -44,7 +45,9 @@ func NewRegistryStore(url string, writable bool) *RegistryStore {
 	return &RegistryStore{
 		base:     url,
 		writable: writable,
-		client:   http.DefaultClient,
+		client: &http.Client{
+			Transport: registryauthclient.NewClient(http.DefaultTransport),
+		},
 	}
 }
 
@@ -0,0 +1,191 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package buildah builds container images with buildah, configured so that
+// everything fetched by the build (including by RUN instructions) goes via an
+// htvend proxy. It is the Go equivalent of the build-img-with-proxy script.
+package buildah
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Mount is a file on the host which is mounted into the container for each RUN
+// instruction. It is not included in the final image.
+type Mount struct {
+	ID      string // must be unique within a build
+	Src     string
+	Targets []string
+}
+
+type Options struct {
+	// Path to the buildah binary. Defaults to "buildah".
+	Binary string
+
+	// Platforms to build, as os/arch. Defaults to the host architecture on linux.
+	Platforms []string
+
+	// Where the multi-platform OCI layout is written
+	OutputDir string
+
+	// If set, used for timestamps in the image, and set as SOURCE_DATE_EPOCH for RUN instructions
+	SourceDateEpoch string
+
+	// CA file on the host. If set, it is mounted at the same path for RUN
+	// instructions, and each of CertFileVars is set pointing to it.
+	CertFile     string
+	CertFileVars []string
+
+	// Other files to mount for RUN instructions
+	Mounts []Mount
+
+	// Environment for buildah, which should include the proxy env vars. Defaults to our own.
+	Env []string
+
+	// Default to our own
+	Stdout, Stderr io.Writer
+}
+
+// BuildArgs returns the arguments for `buildah build` which pass the proxy
+// configuration through to RUN instructions.
+func BuildArgs(o Options) []string {
+	// need to be able to use hosts network to get to the proxy on localhost,
+	// and pass through proxy vars (on by default, but may as well be explicit)
+	rv := []string{"--network=host", "--http-proxy"}
+
+	if o.SourceDateEpoch != "" {
+		rv = append(rv,
+			"--timestamp", o.SourceDateEpoch,
+			"--secret=id=SOURCE_DATE_EPOCH,type=env,env=CONTAINER_SOURCE_DATE_EPOCH",
+			"--mount=type=secret,id=SOURCE_DATE_EPOCH,required,env=SOURCE_DATE_EPOCH",
+		)
+	}
+
+	if o.CertFile != "" && len(o.CertFileVars) != 0 {
+		rv = append(rv,
+			"--secret=id=SSL_CERT_FILE_DATA,type=file,src="+o.CertFile,
+			"--secret=id=SSL_CERT_FILE_PATH,type=env,env=HTVEND_CERT_FILE",
+			"--mount=type=secret,id=SSL_CERT_FILE_DATA,required,target="+o.CertFile,
+		)
+		for _, ev := range o.CertFileVars {
+			rv = append(rv, "--mount=type=secret,id=SSL_CERT_FILE_PATH,required,env="+ev)
+		}
+	}
+
+	for _, m := range o.Mounts {
+		if len(m.Targets) == 0 {
+			continue
+		}
+		rv = append(rv, "--secret=id="+m.ID+",type=file,src="+m.Src)
+		for _, t := range m.Targets {
+			rv = append(rv, "--mount=type=secret,id="+m.ID+",required,target="+t)
+		}
+	}
+
+	return rv
+}
+
+// Run runs `buildah build` with args for each platform, and combines the
+// results into a multi-platform OCI layout at o.OutputDir. args should normally
+// start with BuildArgs(o), followed by those for the build itself, e.g. -f Dockerfile .
+func Run(ctx context.Context, o Options, args []string) (retErr error) {
+	if o.Binary == "" {
+		o.Binary = "buildah"
+	}
+	if len(o.Platforms) == 0 {
+		o.Platforms = []string{"linux/" + runtime.GOARCH}
+	}
+	if o.Env == nil {
+		o.Env = os.Environ()
+	}
+	if o.Stdout == nil {
+		o.Stdout = os.Stdout
+	}
+	if o.Stderr == nil {
+		o.Stderr = os.Stderr
+	}
+
+	// buildah's storage goes here, else it won't re-fetch images that it already
+	// has the blobs for, and we won't see them being used
+	tempDir, err := os.MkdirTemp("", "htvend-buildah")
+	if err != nil {
+		return fmt.Errorf("error creating temp dir: %w", err)
+	}
+	defer func() {
+		// normal removal often fails with permission errors, so use the unshare version if that fails
+		if err := os.RemoveAll(tempDir); err != nil {
+			if err := o.command(ctx, nil, "unshare", "rm", "-rf", tempDir).Run(); err != nil && retErr == nil {
+				retErr = fmt.Errorf("error removing buildah storage: %w", err)
+			}
+		}
+	}()
+
+	env := []string{"XDG_DATA_HOME=" + filepath.Join(tempDir, "data")}
+	if o.SourceDateEpoch != "" {
+		// buildah gets confused between SOURCE_DATE_EPOCH and --timestamp, so we pass it under another name
+		env = append(env, "CONTAINER_SOURCE_DATE_EPOCH="+o.SourceDateEpoch)
+	}
+	if o.CertFile != "" {
+		env = append(env, "HTVEND_CERT_FILE="+o.CertFile)
+	}
+
+	manifest := filepath.Base(tempDir)
+	if err := o.command(ctx, env, "manifest", "create", manifest).Run(); err != nil {
+		return fmt.Errorf("error creating manifest list: %w", err)
+	}
+	for _, platform := range o.Platforms {
+		archive := filepath.Join(tempDir, strings.ReplaceAll(platform, "/", "-")+".tar")
+
+		logrus.Infof("Building %s", platform)
+		buildArgs := append([]string{"build", "--platform=" + platform, "--tag=oci-archive:" + archive}, args...)
+		if err := o.command(ctx, env, buildArgs...).Run(); err != nil {
+			return fmt.Errorf("error building %s: %w", platform, err)
+		}
+		if err := o.command(ctx, env, "manifest", "add", manifest, "oci-archive:"+archive).Run(); err != nil {
+			return fmt.Errorf("error adding %s to manifest list: %w", platform, err)
+		}
+	}
+
+	logrus.Infof("Writing OCI layout to %s", o.OutputDir)
+	if err := o.command(ctx, env, "manifest", "push", "--all", manifest, "oci:"+o.OutputDir).Run(); err != nil {
+		return fmt.Errorf("error pushing manifest list: %w", err)
+	}
+	if err := o.command(ctx, env, "manifest", "rm", manifest).Run(); err != nil {
+		return fmt.Errorf("error removing manifest list: %w", err)
+	}
+	return nil
+}
+
+func (o Options) command(ctx context.Context, env []string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, o.Binary, args...)
+	for _, e := range o.Env {
+		if !strings.HasPrefix(e, "SOURCE_DATE_EPOCH=") {
+			cmd.Env = append(cmd.Env, e)
+		}
+	}
+	cmd.Env = append(cmd.Env, env...)
+	cmd.Stdout = o.Stdout
+	cmd.Stderr = o.Stderr
+	logrus.Debugf("%s %s", o.Binary, strings.Join(args, " "))
+	return cmd
+}
@@ -0,0 +1,114 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package buildah
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildArgs(t *testing.T) {
+	assert.Equal(t, []string{"--network=host", "--http-proxy"}, BuildArgs(Options{}))
+
+	assert.Equal(t, []string{
+		"--network=host",
+		"--http-proxy",
+		"--timestamp", "0",
+		"--secret=id=SOURCE_DATE_EPOCH,type=env,env=CONTAINER_SOURCE_DATE_EPOCH",
+		"--mount=type=secret,id=SOURCE_DATE_EPOCH,required,env=SOURCE_DATE_EPOCH",
+		"--secret=id=SSL_CERT_FILE_DATA,type=file,src=/tmp/x/cacerts.pem",
+		"--secret=id=SSL_CERT_FILE_PATH,type=env,env=HTVEND_CERT_FILE",
+		"--mount=type=secret,id=SSL_CERT_FILE_DATA,required,target=/tmp/x/cacerts.pem",
+		"--mount=type=secret,id=SSL_CERT_FILE_PATH,required,env=SSL_CERT_FILE",
+		"--mount=type=secret,id=SSL_CERT_FILE_PATH,required,env=NODE_EXTRA_CA_CERTS",
+		"--secret=id=JKS,type=file,src=/tmp/x/cacerts.jks",
+		"--mount=type=secret,id=JKS,required,target=/etc/ssl/certs/java/cacerts",
+	}, BuildArgs(Options{
+		SourceDateEpoch: "0",
+		CertFile:        "/tmp/x/cacerts.pem",
+		CertFileVars:    []string{"SSL_CERT_FILE", "NODE_EXTRA_CA_CERTS"},
+		Mounts: []Mount{
+			{ID: "JKS", Src: "/tmp/x/cacerts.jks", Targets: []string{"/etc/ssl/certs/java/cacerts"}},
+			{ID: "UNUSED", Src: "/tmp/x/other"},
+		},
+	}))
+}
+
+func TestRun(t *testing.T) {
+	td := t.TempDir()
+	logPath := filepath.Join(td, "log")
+	fake := filepath.Join(td, "buildah")
+	require.NoError(t, os.WriteFile(fake, []byte(`#!/bin/sh
+echo "$XDG_DATA_HOME|$SOURCE_DATE_EPOCH|$CONTAINER_SOURCE_DATE_EPOCH|$*" >> `+logPath+`
+`), 0o755))
+
+	require.NoError(t, Run(context.Background(), Options{
+		Binary:          fake,
+		Platforms:       []string{"linux/amd64", "linux/arm64"},
+		OutputDir:       "out",
+		SourceDateEpoch: "123",
+		Env:             []string{"PATH=" + os.Getenv("PATH"), "SOURCE_DATE_EPOCH=123"},
+	}, []string{"-f", "Dockerfile", "."}))
+
+	bb, err := os.ReadFile(logPath)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(bb)), "\n")
+	require.Len(t, lines, 7)
+
+	var xdg, manifest string
+	for i, l := range lines {
+		parts := strings.SplitN(l, "|", 4)
+		require.Len(t, parts, 4)
+
+		// every call should use the same private storage, and not see SOURCE_DATE_EPOCH
+		if i == 0 {
+			xdg = parts[0]
+			assert.NotEmpty(t, xdg)
+			manifest = strings.TrimPrefix(parts[3], "manifest create ")
+		}
+		assert.Equal(t, xdg, parts[0])
+		assert.Equal(t, "", parts[1])
+		assert.Equal(t, "123", parts[2])
+		lines[i] = strings.ReplaceAll(strings.ReplaceAll(parts[3], filepath.Dir(xdg), "TMP"), manifest, "MANIFEST")
+	}
+	assert.Equal(t, []string{
+		"manifest create MANIFEST",
+		"build --platform=linux/amd64 --tag=oci-archive:TMP/linux-amd64.tar -f Dockerfile .",
+		"manifest add MANIFEST oci-archive:TMP/linux-amd64.tar",
+		"build --platform=linux/arm64 --tag=oci-archive:TMP/linux-arm64.tar -f Dockerfile .",
+		"manifest add MANIFEST oci-archive:TMP/linux-arm64.tar",
+		"manifest push --all MANIFEST oci:out",
+		"manifest rm MANIFEST",
+	}, lines)
+
+	// and storage should be cleaned up
+	_, err = os.Stat(xdg)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestRunFailure(t *testing.T) {
+	td := t.TempDir()
+	fake := filepath.Join(td, "buildah")
+	require.NoError(t, os.WriteFile(fake, []byte("#!/bin/sh\n[ \"$1\" != build ]\n"), 0o755))
+
+	err := Run(context.Background(), Options{Binary: fake, Platforms: []string{"linux/amd64"}}, nil)
+	assert.ErrorContains(t, err, "error building linux/amd64")
+}
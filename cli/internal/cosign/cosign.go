@@ -0,0 +1,146 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cosign verifies cosign signatures of container images, as stored in
+// a registry by "cosign sign --key", without needing any network access.
+package cosign
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// SignatureAnnotation is set on each layer of a signature manifest to the base64 signature of the layer
+	SignatureAnnotation = "dev.cosignproject.cosign/signature"
+
+	// SimpleSigningMediaType is the media type of signature layers, which are Payloads
+	SimpleSigningMediaType = "application/vnd.dev.cosign.simplesigning.v1+json"
+
+	// SignatureArtifactType is the artifact type of signatures found via the OCI referrers API
+	SignatureArtifactType = "application/vnd.dev.cosign.artifact.sig.v1+json"
+
+	payloadType = "cosign container image signature"
+)
+
+var ErrNoMatchingKey = errors.New("signature not valid for any key")
+
+// Payload is what is signed, in the "simple signing" format
+type Payload struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+	Optional map[string]any `json:"optional"`
+}
+
+// LoadPublicKeys reads PEM encoded public keys from the given files
+func LoadPublicKeys(paths []string) ([]crypto.PublicKey, error) {
+	var rv []crypto.PublicKey
+	for _, p := range paths {
+		bb, err := os.ReadFile(p)
+		if err != nil {
+			return nil, fmt.Errorf("error reading public key: %w", err)
+		}
+		var found bool
+		for {
+			var block *pem.Block
+			block, bb = pem.Decode(bb)
+			if block == nil {
+				break
+			}
+			if block.Type != "PUBLIC KEY" {
+				continue
+			}
+			pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing public key in %s: %w", p, err)
+			}
+			rv = append(rv, pub)
+			found = true
+		}
+		if !found {
+			return nil, fmt.Errorf("no PUBLIC KEY found in %s", p)
+		}
+	}
+	return rv, nil
+}
+
+// Verify checks that the base64 encoded sig is a signature of payload by one
+// of keys, and that payload is for the image manifest with digest d.
+func Verify(keys []crypto.PublicKey, payload []byte, sig string, d digest.Digest) error {
+	rawSig, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return fmt.Errorf("error decoding signature: %w", err)
+	}
+	valid := false
+	for _, key := range keys {
+		if verifySignature(key, payload, rawSig) == nil {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return ErrNoMatchingKey
+	}
+
+	var p Payload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return fmt.Errorf("error parsing signature payload: %w", err)
+	}
+	if p.Critical.Type != payloadType {
+		return fmt.Errorf("unexpected signature payload type: %q", p.Critical.Type)
+	}
+	if p.Critical.Image.DockerManifestDigest != d.String() {
+		return fmt.Errorf("signature is for %s, not %s", p.Critical.Image.DockerManifestDigest, d)
+	}
+	return nil
+}
+
+func verifySignature(key crypto.PublicKey, payload, sig []byte) error {
+	h := sha256.Sum256(payload)
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(k, h[:], sig) {
+			return errors.New("invalid ECDSA signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, h[:], sig)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, payload, sig) {
+			return errors.New("invalid Ed25519 signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported public key type: %T", key)
+	}
+}
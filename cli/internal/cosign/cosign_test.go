@@ -0,0 +1,64 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cosign
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerify(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	require.NoError(t, err)
+	keyPath := filepath.Join(t.TempDir(), "cosign.pub")
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o644))
+
+	keys, err := LoadPublicKeys([]string{keyPath})
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+
+	d := digest.FromString("manifest")
+	payload := []byte(`{"critical":{"identity":{"docker-reference":"ghcr.io/org/img"},"image":{"docker-manifest-digest":"` + d.String() + `"},"type":"cosign container image signature"},"optional":null}`)
+	h := sha256.Sum256(payload)
+	rawSig, err := ecdsa.SignASN1(rand.Reader, priv, h[:])
+	require.NoError(t, err)
+	sig := base64.StdEncoding.EncodeToString(rawSig)
+
+	assert.NoError(t, Verify(keys, payload, sig, d))
+	assert.ErrorContains(t, Verify(keys, payload, sig, digest.FromString("other")), "signature is for")
+	assert.ErrorIs(t, Verify(keys, append(payload, ' '), sig, d), ErrNoMatchingKey)
+
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	assert.ErrorIs(t, Verify([]crypto.PublicKey{&other.PublicKey}, payload, sig, d), ErrNoMatchingKey)
+
+	_, err = LoadPublicKeys([]string{filepath.Join(t.TempDir(), "missing.pub")})
+	assert.Error(t, err)
+}
@@ -15,10 +15,34 @@
 package htvend
 
 import (
+	"context"
 	"fmt"
+	"net/http"
 	"net/textproto"
 
+	"github.com/continusec/htvend/internal/app"
+	"github.com/continusec/htvend/internal/lockfile"
+	"github.com/continusec/htvend/internal/registryauthclient"
+	"github.com/continusec/htvend/internal/secrets"
 	"github.com/jessevdk/go-flags"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	reusedAssetCount = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "htvend_reused_asset_total",
+		Help: "The total number of assets reused from the previous manifest without going upstream",
+	})
+	addedAssetCount = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "htvend_added_asset_total",
+		Help: "The total number of assets added to the manifest",
+	})
+	droppedAssetCount = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "htvend_dropped_asset_total",
+		Help: "The total number of assets dropped from the manifest as they were not requested",
+	})
 )
 
 var _ flags.Commander = &BuildCommand{}
@@ -28,9 +52,14 @@ type FetchOptions struct {
 	CacheHeader []string `long:"cache-header" default:"Content-Length" default:"Docker-Content-Digest" default:"Content-Type" default:"Content-Encoding" default:"X-Checksum-Sha1" description:"List of headers for which we will cache the first value."`
 }
 
+// CacheHeaderMap returns the headers to cache, which never includes any that may carry credentials
 func (fo FetchOptions) CacheHeaderMap() map[string]bool {
 	rv := make(map[string]bool)
 	for _, h := range fo.CacheHeader {
+		if secrets.IsSensitiveHeader(h) {
+			logrus.Warnf("ignoring --cache-header=%s, as it may include credentials", h)
+			continue
+		}
 		rv[textproto.CanonicalMIMEHeaderKey(h)] = true
 	}
 	return rv
@@ -42,6 +71,11 @@ type BuildCommand struct {
 	FetchOptions
 
 	ForceRefresh bool `long:"force-refresh" description:"If set, ignore any existing SHA256 values"`
+	FailOnDrift  bool `long:"fail-on-drift" description:"If set, fail if any entries were added, changed or dropped versus the existing manifest file, which is then left unchanged"`
+
+	WithReferrers bool `long:"with-referrers" description:"After the sub-process exits, also fetch artifacts referring to each image manifest fetched, e.g. cosign signatures, attestations and SBOMs, via the OCI referrers API and tag schemes"`
+
+	StreamingPolicy string `long:"streaming-policy" default:"passthrough" choice:"passthrough" choice:"reject" description:"What to do with websocket and server-sent event requests, which can't be recorded. passthrough forwards them upstream without recording."`
 }
 
 func (rc *BuildCommand) Execute(args []string) (retErr error) {
@@ -57,8 +91,13 @@ func (rc *BuildCommand) Execute(args []string) (retErr error) {
 	if err != nil {
 		return fmt.Errorf("error getting manifest file: %w", err)
 	}
+	discard := false // if set, the manifest is left as it was
 	defer func() {
-		if err := mf.Close(); err != nil && retErr == nil {
+		closeManifest := mf.Close
+		if discard {
+			closeManifest = mf.Discard
+		}
+		if err := closeManifest(); err != nil && retErr == nil {
 			retErr = err
 		}
 	}()
@@ -67,10 +106,57 @@ func (rc *BuildCommand) Execute(args []string) (retErr error) {
 		return fmt.Errorf("error resetting manifest file: %w", err)
 	}
 
-	return rc.ListenerOptions.RunListenerWithSubprocess(&listenerCtx{
-		Assets:         mf,
-		Blobs:          bs,
-		FetchIfMissing: true,
-		HeadersToCache: rc.FetchOptions.CacheHeaderMap(),
-	}, "htvend build", args)
+	if err := rc.ListenerOptions.RunListenerWithSubprocess(&listenerCtx{
+		Assets:          mf,
+		Blobs:           bs,
+		FetchIfMissing:  true,
+		HeadersToCache:  rc.FetchOptions.CacheHeaderMap(),
+		Client:          rc.ListenerOptions.upstreamClient(),
+		StreamingPolicy: rc.StreamingPolicy,
+	}, "htvend build", args); err != nil {
+		return err
+	}
+
+	if rc.WithReferrers {
+		if err := app.RunUntilSignals(func(ctx context.Context) error {
+			return pullReferrers(ctx, &manifestFetcher{
+				Assets:         mf,
+				Blobs:          bs,
+				HeadersToCache: rc.FetchOptions.CacheHeaderMap(),
+				Client: &http.Client{
+					Transport: registryauthclient.NewClient(rc.ListenerOptions.upstreamClient().Transport),
+				},
+			})
+		}); err != nil {
+			return err
+		}
+	}
+
+	changes := mf.Changes()
+	reportChanges(changes)
+	if rc.FailOnDrift && changes.Drifted() {
+		// otherwise the drift would become the baseline, and the next run would pass
+		discard = true
+		return fmt.Errorf("manifest drift detected: %d added, %d changed, %d dropped", len(changes.Added), len(changes.Changed), len(changes.Dropped))
+	}
+	return nil
+}
+
+func reportChanges(cr *lockfile.ChangeReport) {
+	for _, k := range cr.Added {
+		logrus.Infof("Added: %s", k)
+	}
+	for _, k := range cr.Changed {
+		logrus.Warnf("Changed: %s", k)
+	}
+	for _, k := range cr.Dropped {
+		logrus.Infof("Dropped: %s", k)
+	}
+
+	reusedAssetCount.Add(float64(len(cr.Reused)))
+	addedAssetCount.Add(float64(len(cr.Added)))
+	changedAssetCount.Add(float64(len(cr.Changed)))
+	droppedAssetCount.Add(float64(len(cr.Dropped)))
+
+	logrus.Infof("Manifest summary: %d reused, %d added, %d changed, %d re-fetched unchanged, %d dropped", len(cr.Reused), len(cr.Added), len(cr.Changed), len(cr.Refetched), len(cr.Dropped))
 }
@@ -0,0 +1,81 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package htvend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/continusec/htvend/internal/lockfile"
+	"github.com/jessevdk/go-flags"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildChanges(t *testing.T) {
+	cs, srv := newContentServer(t, map[string]string{
+		"/same":    "same",
+		"/changed": "old",
+		"/dropped": "dropped",
+	})
+	dir := t.TempDir()
+
+	// with the default headers, as a build would use
+	var fo FetchOptions
+	_, err := flags.ParseArgs(&fo, nil)
+	require.NoError(t, err)
+	build := func(forceRefresh bool, paths ...string) *lockfile.ChangeReport {
+		mf, bs := openTestManifest(t, dir)
+		require.NoError(t, mf.Reset(forceRefresh))
+		lctx := &listenerCtx{
+			Assets:         mf,
+			Blobs:          bs,
+			FetchIfMissing: true,
+			HeadersToCache: fo.CacheHeaderMap(),
+			Client:         srv.Client(),
+		}
+		for _, p := range paths {
+			rec := httptest.NewRecorder()
+			serveWithListenerCtx(lctx)(rec, httptest.NewRequest(http.MethodGet, srv.URL+p, nil))
+			require.Equal(t, http.StatusOK, rec.Code, p)
+		}
+		cr := mf.Changes()
+		require.NoError(t, mf.Close())
+		return cr
+	}
+
+	cr := build(false, "/same", "/changed", "/dropped")
+	assert.Len(t, cr.Added, 3)
+
+	cs.set("/changed", "new")
+	cs.set("/added", "added")
+	cr = build(false, "/same", "/changed", "/added")
+	assert.Equal(t, []string{srv.URL + "/changed", srv.URL + "/same"}, cr.Reused) // not fetched again
+	assert.Equal(t, []string{srv.URL + "/added"}, cr.Added)
+	assert.Empty(t, cr.Changed)
+	assert.Equal(t, []string{srv.URL + "/dropped"}, cr.Dropped)
+	assert.True(t, cr.Drifted())
+
+	// forcing a refresh only reports content that has changed, not headers such as Last-Modified
+	cs.set("/changed", "newer")
+	cr = build(true, "/same", "/changed", "/added")
+	assert.Empty(t, cr.Reused)
+	assert.Empty(t, cr.Added)
+	assert.Equal(t, []string{srv.URL + "/changed"}, cr.Changed)
+	assert.Equal(t, []string{srv.URL + "/added", srv.URL + "/same"}, cr.Refetched)
+	assert.Empty(t, cr.Dropped)
+	assert.True(t, cr.Drifted())
+}
@@ -0,0 +1,168 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package htvend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/sirupsen/logrus"
+)
+
+var _ flags.Commander = &ConfigCommand{}
+
+type ConfigCommand struct {
+	RuntimeConfigOptions
+
+	ControlSocket string `long:"control-socket" description:"Unix socket of the control API of a running htvend serve, to get the proxy address and CA from"`
+	ControlAddr   string `long:"control-addr" description:"TCP address of the control API of a running htvend serve, to get the proxy address and CA from"`
+	ProxyAddr     string `long:"proxy-addr" description:"Proxy address for the runtime to use, as host:port. Defaults to that of the running server."`
+	CAPem         string `long:"ca-pem" description:"CA PEM file for the runtime to trust. Defaults to that of the running server."`
+	CAPath        string `long:"ca-path" description:"Path that the runtime reads the CA from, e.g. /var/lib/htvend/etc/cert.pem. Defaults to a copy written to the output directory."`
+	OutputDir     string `short:"o" long:"output-dir" default:"." description:"Directory to write config to"`
+
+	Args struct {
+		Runtime string `positional-arg-name:"RUNTIME" description:"Container runtime to write config for: k3s, containerd or docker"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+func (rc *ConfigCommand) Execute(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("unexpected arguments: %v", args)
+	}
+	if _, ok := runtimeConfigWriters[rc.Args.Runtime]; !ok {
+		return fmt.Errorf("unknown container runtime %q, must be one of: %s", rc.Args.Runtime, strings.Join(slices.Sorted(maps.Keys(runtimeConfigWriters)), ", "))
+	}
+
+	proxyAddr, caPem := rc.ProxyAddr, []byte(nil)
+	if rc.CAPem != "" {
+		var err error
+		caPem, err = os.ReadFile(rc.CAPem)
+		if err != nil {
+			return fmt.Errorf("error reading CA PEM file: %w", err)
+		}
+	}
+	if proxyAddr == "" || caPem == nil {
+		c, err := rc.controlClient()
+		if err != nil {
+			return err
+		}
+		if proxyAddr == "" {
+			var st controlStatus
+			if err := c.getJSON("/health", &st); err != nil {
+				return err
+			}
+			proxyAddr = st.ProxyAddr
+		}
+		if caPem == nil {
+			if caPem, err = c.get("/ca"); err != nil {
+				return err
+			}
+		}
+	}
+
+	caPath := rc.CAPath
+	if caPath == "" {
+		var err error
+		caPath, err = filepath.Abs(filepath.Join(rc.OutputDir, "ca.pem"))
+		if err != nil {
+			return fmt.Errorf("error getting absolute path for CA: %w", err)
+		}
+		if err := os.MkdirAll(rc.OutputDir, 0o755); err != nil {
+			return fmt.Errorf("error creating output dir: %w", err)
+		}
+		if err := os.WriteFile(caPath, caPem, 0o644); err != nil {
+			return fmt.Errorf("error writing CA PEM file: %w", err)
+		}
+		logrus.Infof("Wrote %s", caPath)
+	}
+
+	files, err := writeRuntimeConfig(rc.Args.Runtime, rc.runtimeConfig(proxyAddr, caPem, caPath), rc.OutputDir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		logrus.Infof("Wrote %s", f.Path)
+	}
+	return nil
+}
+
+// controlAPIClient makes requests to the control API of htvend serve
+type controlAPIClient struct {
+	client  *http.Client
+	baseURL string
+}
+
+func (rc *ConfigCommand) controlClient() (*controlAPIClient, error) {
+	switch {
+	case rc.ControlSocket != "":
+		return &controlAPIClient{
+			client: &http.Client{
+				Transport: &http.Transport{
+					DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+						var d net.Dialer
+						return d.DialContext(ctx, "unix", rc.ControlSocket)
+					},
+				},
+			},
+			baseURL: "http://htvend",
+		}, nil
+	case rc.ControlAddr != "":
+		return &controlAPIClient{
+			client:  http.DefaultClient,
+			baseURL: "http://" + rc.ControlAddr,
+		}, nil
+	default:
+		return nil, errors.New("either --control-socket or --control-addr must be specified, unless both --proxy-addr and --ca-pem are")
+	}
+}
+
+func (c *controlAPIClient) get(path string) ([]byte, error) {
+	resp, err := c.client.Get(c.baseURL + path)
+	if err != nil {
+		return nil, fmt.Errorf("error calling control API: %w", err)
+	}
+	defer resp.Body.Close()
+	bb, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading control API response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status from control API (%s): %s: %s", path, resp.Status, strings.TrimSpace(string(bb)))
+	}
+	return bb, nil
+}
+
+func (c *controlAPIClient) getJSON(path string, v any) error {
+	bb, err := c.get(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(bb, v); err != nil {
+		return fmt.Errorf("error parsing control API response (%s): %w", path, err)
+	}
+	return nil
+}
@@ -16,11 +16,14 @@ package htvend
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net/url"
 
+	"github.com/continusec/htvend/internal/app"
 	blobs "github.com/continusec/htvend/internal/blobstore"
 	"github.com/continusec/htvend/internal/jobs"
 	"github.com/continusec/htvend/internal/lockfile"
@@ -32,11 +35,16 @@ var _ flags.Commander = &ExportCommand{}
 
 type ExportCommand struct {
 	ManifestOptions
+	JobsOptions
 
 	Dest CacheOptions `group:"Destination blob store" namespace:"dest"`
 }
 
-func ensureBlobExported(src, dst blobs.Store, expectedH []byte) (retErr error) {
+func ensureBlobExported(ctx context.Context, src, dst blobs.Store, expectedH []byte) (retErr error) {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	exists, err := dst.Exists(expectedH)
 	if err != nil {
 		return fmt.Errorf("error checking if destination exists: %w", err)
@@ -51,8 +59,12 @@ func ensureBlobExported(src, dst blobs.Store, expectedH []byte) (retErr error) {
 	// else we must fetch, write and check hash
 	srcBlob, err := src.Get(expectedH)
 	if err != nil {
+		if errors.Is(err, blobs.ErrBlobNotExist) {
+			err = jobs.Permanent(err)
+		}
 		return fmt.Errorf("error fetching from upstream blobstore: %w", err)
 	}
+	defer srcBlob.Close()
 
 	// create file to write
 	dstBlob, err := dst.Put()
@@ -76,7 +88,7 @@ func ensureBlobExported(src, dst blobs.Store, expectedH []byte) (retErr error) {
 	}
 
 	if !bytes.Equal(expectedH, actualH) {
-		return fmt.Errorf("actual hash (%s) received differs from desired hash (%s) for blob", hex.EncodeToString(actualH), hex.EncodeToString(expectedH))
+		return jobs.Permanent(fmt.Errorf("actual hash (%s) received differs from desired hash (%s) for blob", hex.EncodeToString(actualH), hex.EncodeToString(expectedH)))
 	}
 
 	return nil
@@ -117,18 +129,22 @@ func (rc *ExportCommand) Execute(args []string) (retErr error) {
 	}
 
 	// now handle each
-	mt := jobs.NewMultiTasker()
-	for canonSha := range neededCanonShas {
-		expectedH, err := hex.DecodeString(canonSha)
-		if err != nil {
-			return fmt.Errorf("error decoding hash: %w", err)
+	return app.RunUntilSignals(func(ctx context.Context) error {
+		mt := rc.JobsOptions.MakeMultiTasker(ctx)
+		for canonSha := range neededCanonShas {
+			expectedH, err := hex.DecodeString(canonSha)
+			if err != nil {
+				mt.Cancel()
+				_ = mt.Wait(func(error) {}) // release the workers, we're reporting this error instead
+				return fmt.Errorf("error decoding hash: %w", err)
+			}
+			mt.Queue(func(ctx context.Context) error {
+				return ensureBlobExported(ctx, srcBs, dstBs, expectedH)
+			})
 		}
-		mt.Queue(func() error {
-			return ensureBlobExported(srcBs, dstBs, expectedH)
-		})
-	}
 
-	return mt.Wait(func(err error) {
-		logrus.Errorf("error during parallel job: %v", err)
+		return mt.Wait(func(err error) {
+			logrus.Errorf("error during parallel job: %v", err)
+		})
 	})
 }
@@ -0,0 +1,159 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package htvend
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/continusec/htvend/internal/app"
+	"github.com/continusec/htvend/internal/netns"
+	"github.com/jessevdk/go-flags"
+	"github.com/sirupsen/logrus"
+)
+
+var _ flags.Commander = &IsolatedExecCommand{}
+
+// IsolatedExecCommand is run by runIsolatedSubprocess inside the new namespaces, and is not intended to be run directly
+type IsolatedExecCommand struct {
+	Forward     []string `long:"forward" description:"ADDR=SOCKET to forward TCP connections on ADDR to the Unix socket at SOCKET"`
+	Transparent bool     `long:"transparent" description:"Route all addresses to loopback, and answer all DNS queries with 127.0.0.1"`
+
+	app.SubprocessOptions `positional-args:"yes" required:"yes"`
+}
+
+func (c *IsolatedExecCommand) Execute(args []string) error {
+	if err := netns.SetupLoopback(); err != nil {
+		return err
+	}
+
+	return app.RunUntilSignals(func(ctx context.Context) error {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		if c.Transparent {
+			if err := netns.RouteAllToLoopback(); err != nil {
+				return err
+			}
+			pc, err := net.ListenPacket("udp4", "0.0.0.0:53")
+			if err != nil {
+				return fmt.Errorf("error listening for DNS: %w", err)
+			}
+			go func() {
+				if err := netns.ServeDNS(ctx, pc, net.IPv4(127, 0, 0, 1)); err != nil {
+					logrus.Warnf("error serving DNS: %v", err)
+				}
+			}()
+		}
+
+		for _, f := range c.Forward {
+			addr, sockPath, ok := strings.Cut(f, "=")
+			if !ok {
+				return fmt.Errorf("bad forward, expected ADDR=SOCKET: %s", f)
+			}
+			l, err := net.Listen("tcp", addr)
+			if err != nil {
+				return fmt.Errorf("error listening on %s: %w", addr, err)
+			}
+			go func() {
+				if err := netns.Forward(ctx, l, func(ctx context.Context) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", sockPath)
+				}); err != nil {
+					logrus.Warnf("error forwarding %s: %v", addr, err)
+				}
+			}()
+		}
+
+		// we only needed these to bring up the loopback interface
+		if err := netns.DropAmbientCaps(); err != nil {
+			return err
+		}
+
+		cmd := exec.CommandContext(ctx, c.Process, c.Args...)
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		cmd.SysProcAttr = netns.ChildSysProcAttr()
+		return cmd.Run()
+	})
+}
+
+// runIsolatedSubprocess runs the sub-process in a new network namespace, with only a loopback
+// interface. The proxy is made reachable at the same address inside it, via a Unix socket.
+// If transparentSock is set, then connections to any address on ports 80 and 443 are forwarded to it.
+func runIsolatedSubprocess(ctx context.Context, prompt string, opts app.SubprocessOptions, ectx *envCtx, transparentSock string) error {
+	if !netns.Supported {
+		return fmt.Errorf("--isolate-network is only supported on Linux")
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("error finding htvend executable: %w", err)
+	}
+
+	cmd, err := app.MakeSubprocessCommand(ctx, prompt, opts, ectx.EnvOverrides)
+	if err != nil {
+		return err
+	}
+
+	fwdCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// the proxies are made available at the same addresses inside the namespace
+	helperArgs := []string{self, "isolated-exec"}
+	for name, addr := range map[string]string{"proxy": ectx.ProxyAddr, "socks": ectx.SocksAddr} {
+		if addr == "" {
+			continue
+		}
+		sockPath := filepath.Join(ectx.TempDir, name+".sock")
+		l, err := net.Listen("unix", sockPath)
+		if err != nil {
+			return fmt.Errorf("error listening on %s socket: %w", name, err)
+		}
+		fwdErr := make(chan error, 1)
+		defer func() {
+			cancel()
+			if err := <-fwdErr; err != nil {
+				logrus.Warnf("error forwarding %s socket: %v", name, err)
+			}
+		}()
+		go func() {
+			fwdErr <- netns.Forward(fwdCtx, l, func(ctx context.Context) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "tcp", addr)
+			})
+		}()
+		helperArgs = append(helperArgs, "--forward", addr+"="+sockPath)
+	}
+
+	// wrap the command with our helper, which sets up the namespace
+	if transparentSock != "" {
+		helperArgs = append(helperArgs, "--transparent", "--forward", "0.0.0.0:80="+transparentSock, "--forward", "0.0.0.0:443="+transparentSock)
+	}
+	cmd.Args = append(append(helperArgs, "--", cmd.Path), cmd.Args[1:]...)
+	cmd.Path = self
+	cmd.SysProcAttr = netns.SysProcAttr()
+
+	logrus.Debugf("running isolated: %s", strings.Join(cmd.Args, " "))
+	defer logrus.Debugf("(terminated)")
+
+	return cmd.Run()
+}
@@ -0,0 +1,201 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package htvend
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+
+	"github.com/continusec/htvend/internal/app"
+	"github.com/continusec/htvend/internal/blobstore"
+	"github.com/continusec/htvend/internal/imagepull"
+	"github.com/continusec/htvend/internal/imageref"
+	"github.com/continusec/htvend/internal/lockfile"
+	"github.com/continusec/htvend/internal/registryauthclient"
+	"github.com/continusec/htvend/internal/secrets"
+	"github.com/hashicorp/go-multierror"
+	"github.com/jessevdk/go-flags"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+var _ flags.Commander = &PullImageCommand{}
+
+type PullImageCommand struct {
+	ManifestOptions
+	FetchOptions
+
+	Platforms    []string `long:"platform" description:"List of os/arch[/variant] platforms to pull from multi-platform images, or all. Defaults to the host platform."`
+	DisableHTTP2 bool     `long:"disable-http2" description:"Only use HTTP/1.1 with upstream servers"`
+
+	WithReferrers bool `long:"with-referrers" description:"Also fetch artifacts referring to each image manifest, e.g. cosign signatures, attestations and SBOMs, via the OCI referrers API and tag schemes"`
+
+	Args struct {
+		Images []string `positional-arg-name:"IMAGE" required:"1" description:"Images to pull, e.g. alpine:3.20, ghcr.io/org/img@sha256:..."`
+	} `positional-args:"yes"`
+}
+
+func (rc *PullImageCommand) Execute(args []string) (retErr error) {
+	if len(args) != 0 {
+		return fmt.Errorf("unexpected arguments: %v", args)
+	}
+
+	platforms, err := imagepull.ParsePlatforms(rc.Platforms)
+	if err != nil {
+		return err
+	}
+	var refs []imageref.Reference
+	for _, img := range rc.Args.Images {
+		ref, err := imageref.Parse(img)
+		if err != nil {
+			return err
+		}
+		refs = append(refs, ref)
+	}
+
+	bs, err := rc.ManifestOptions.MakeBlobStore(true)
+	if err != nil {
+		return fmt.Errorf("error making blob store: %w", err)
+	}
+
+	mf, err := rc.ManifestOptions.MakeManifestFile(&manifestContextOptions{
+		Writable:    true,
+		NoCacheList: rc.NoCache,
+	})
+	if err != nil {
+		return fmt.Errorf("error getting manifest file: %w", err)
+	}
+	defer func() {
+		if err := mf.Close(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+
+	f := &manifestFetcher{
+		Assets:         mf,
+		Blobs:          bs,
+		HeadersToCache: rc.FetchOptions.CacheHeaderMap(),
+		Client: &http.Client{
+			Transport: registryauthclient.NewClient(newUpstreamClient(rc.DisableHTTP2).Transport),
+		},
+	}
+	return app.RunUntilSignals(func(ctx context.Context) error {
+		var rv error
+		for _, ref := range refs {
+			logrus.Infof("Pulling %s", ref)
+			if err := imagepull.Pull(ctx, f, ref, imagepull.Options{
+				Platforms:     platforms,
+				WithReferrers: rc.WithReferrers,
+			}); err != nil {
+				rv = multierror.Append(rv, fmt.Errorf("error pulling %s: %w", ref, err))
+			}
+		}
+		return rv
+	})
+}
+
+// pullReferrers fetches, via f, artifacts referring to each image manifest already in its manifest file
+func pullReferrers(ctx context.Context, f *manifestFetcher) error {
+	type image struct {
+		ref    imageref.Reference
+		digest digest.Digest
+	}
+	seen := make(map[string]bool)
+	var images []image
+	if err := f.Assets.ForEach(func(k *url.URL, v lockfile.BlobInfo) error {
+		ref, ok := imageref.FromManifestURL(k)
+		if !ok || imagepull.IsReferrerTag(ref.Tag) {
+			return nil
+		}
+		d := digest.NewDigestFromEncoded(digest.SHA256, v.Sha256)
+		if id := ref.RepositoryURL() + "@" + d.String(); !seen[id] {
+			seen[id] = true
+			images = append(images, image{ref: ref, digest: d})
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].ref.String() < images[j].ref.String()
+	})
+
+	var rv error
+	for _, img := range images {
+		if err := imagepull.PullReferrers(ctx, f, img.ref, img.digest); err != nil {
+			rv = multierror.Append(rv, fmt.Errorf("error pulling referrers of %s: %w", img.ref, err))
+		}
+	}
+	return rv
+}
+
+var _ imagepull.Fetcher = &manifestFetcher{}
+
+// manifestFetcher serves from the manifest if it can, else fetches and records in it, the same as htvend build would
+type manifestFetcher struct {
+	Assets         *lockfile.File
+	Blobs          blobstore.Store
+	HeadersToCache map[string]bool
+	Client         *http.Client
+}
+
+func (f *manifestFetcher) Fetch(ctx context.Context, u string, accept string) (digest.Digest, string, error) {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return "", "", fmt.Errorf("error parsing URL: %w", err)
+	}
+
+	bi, found, err := f.Assets.GetBlob(pu)
+	if err != nil {
+		return "", "", fmt.Errorf("error looking up asset: %w", err)
+	}
+	if !found {
+		status, err := fetchAndSaveBlob(ctx, f.Assets, f.Blobs, http.MethodGet, nil, pu, f.Client, f.HeadersToCache, func(newReq *http.Request) error {
+			if accept != "" {
+				newReq.Header.Set("Accept", accept)
+			}
+			return nil
+		}, nil)
+		if err != nil {
+			return "", "", err
+		}
+		if status != http.StatusOK {
+			return "", "", &imagepull.StatusError{URL: secrets.RedactURL(pu), StatusCode: status}
+		}
+		if bi, found, err = f.Assets.GetBlob(pu); err != nil {
+			return "", "", fmt.Errorf("error looking up asset: %w", err)
+		}
+		if !found {
+			return "", "", fmt.Errorf("%s was not recorded, check --no-cache-response", secrets.RedactURL(pu))
+		}
+	}
+	return digest.NewDigestFromEncoded(digest.SHA256, bi.Sha256), bi.Headers["Content-Type"], nil
+}
+
+func (f *manifestFetcher) Open(ctx context.Context, d digest.Digest) (io.ReadCloser, error) {
+	if d.Algorithm() != digest.SHA256 {
+		return nil, fmt.Errorf("unsupported digest: %s", d)
+	}
+	k, err := hex.DecodeString(d.Encoded())
+	if err != nil {
+		return nil, fmt.Errorf("bad digest: %w", err)
+	}
+	return f.Blobs.Get(k)
+}
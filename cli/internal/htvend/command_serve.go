@@ -0,0 +1,536 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package htvend
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/continusec/htvend/internal/app"
+	"github.com/continusec/htvend/internal/blobstore"
+	"github.com/continusec/htvend/internal/lockfile"
+	"github.com/continusec/htvend/internal/proxyserver"
+	"github.com/continusec/htvend/internal/re"
+	"github.com/hashicorp/go-multierror"
+	"github.com/jessevdk/go-flags"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	serveModeOffline = "offline"
+	serveModeBuild   = "build"
+
+	selectByUsername   = "username"
+	selectByHeader     = "header"
+	selectByListenAddr = "listen-addr"
+)
+
+var _ flags.Commander = &ServeCommand{}
+
+type ServeCommand struct {
+	ManifestOptions
+	ProxyOptions
+	FetchOptions
+	RegistryOptions
+
+	Mode          string   `long:"mode" default:"offline" choice:"offline" choice:"build" description:"Initial mode. In build mode missing assets are fetched and added to the manifest, in offline mode they are rejected."`
+	DummyOK       []string `long:"dummy-ok-response" default:"^http.*/v2/$" description:"Regex list of URLs that we return a dummy 200 OK reply to when offline. Useful for some Docker clients."`
+	ControlSocket string   `long:"control-socket" description:"Path to a Unix socket to serve the control API on"`
+	ControlAddr   string   `long:"control-addr" description:"TCP address to serve the control API on. It is unauthenticated, so only bind to localhost."`
+	ControlDir    string   `long:"control-manifest-dir" default:"." description:"Directory that manifests loaded via the control API must be in. Relative paths are resolved against it."`
+	RecentMisses  int      `long:"recent-misses" default:"100" description:"Number of recent missing asset requests to remember for the control API"`
+
+	StreamingPolicy string `long:"streaming-policy" default:"passthrough" choice:"passthrough" choice:"reject" description:"In build mode, what to do with websocket and server-sent event requests, which can't be recorded. passthrough forwards them upstream without recording."`
+
+	Projects           map[string]string `long:"project" key-value-delimiter:"=" description:"Serve a manifest per project, as NAME=PATH. May be repeated. If set, --manifest is ignored and each request is served from the project selected by --select-by."`
+	SelectBy           string            `long:"select-by" default:"username" choice:"username" choice:"header" choice:"listen-addr" description:"How a client selects its project: the username in the proxy URL, a header on the proxy request, or the address it connects to."`
+	SelectHeader       string            `long:"select-header" default:"X-Htvend-Project" description:"Header on the proxy request that names the project, if selecting by header"`
+	ProjectListenAddrs map[string]string `long:"project-listen-addr" key-value-delimiter:"=" description:"Listen address for a project, as NAME=ADDR. May be repeated. Required for each project if selecting by listen-addr."`
+}
+
+func (rc *ServeCommand) Execute(args []string) (retErr error) {
+	if len(args) != 0 {
+		return fmt.Errorf("serve does not run a sub-process, unexpected arguments: %v", args)
+	}
+
+	dummyOK, err := re.NewMultiRegexMatcher(rc.DummyOK)
+	if err != nil {
+		return fmt.Errorf("error creating dummy OK regex matcher: %w", err)
+	}
+
+	st := &serveState{
+		opts:    rc,
+		dummyOK: dummyOK,
+		client:  rc.upstreamClient(),
+		misses:  newMissLog(rc.RecentMisses),
+		started: time.Now(),
+	}
+
+	initial := map[string]string{"": rc.ManifestFile}
+	if len(rc.Projects) != 0 {
+		if rc.RegistryListenAddr != "" {
+			return errors.New("--registry-listen-addr can't be used with --project, as it can't tell which project a pull is for")
+		}
+		initial = rc.Projects
+		st.projectForAddr, err = rc.projectListenAddrs()
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := st.switchTo(rc.Mode, initial); err != nil {
+		return err
+	}
+	defer func() {
+		if err := st.close(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+
+	cfg := rc.proxyServerConfig(st.handle)
+	for addr := range st.projectForAddr {
+		cfg.ExtraHttpListenAddrs = append(cfg.ExtraHttpListenAddrs, addr)
+	}
+	slices.Sort(cfg.ExtraHttpListenAddrs)
+
+	return app.RunUntilSignals(func(parCtx context.Context) error {
+		return proxyserver.ServeUntilDone(parCtx, cfg, func(ctx context.Context, info proxyserver.ServerInfo) error {
+			return app.WithTempDir(func(tempDir string) error {
+				ectx, err := rc.makeEnv(tempDir, info)
+				if err != nil {
+					return err
+				}
+
+				st.mu.Lock()
+				st.proxyAddr, st.socksAddr, st.caPem, st.env = info.ProxyAddr, info.SocksAddr, info.CAPem, ectx.EnvOverrides
+				st.mu.Unlock()
+
+				logrus.Infof("Serving (%s mode)...", rc.Mode)
+				if len(rc.Projects) != 0 {
+					switch rc.SelectBy {
+					case selectByUsername:
+						logrus.Infof("Clients select a project with a proxy URL of the form http://PROJECT@%s", info.ProxyAddr)
+					case selectByHeader:
+						logrus.Infof("Clients select a project with a %s header on each proxy request", rc.SelectHeader)
+					}
+				}
+				for _, ev := range ectx.EnvOverrides {
+					fmt.Printf("export %s\n", ev)
+				}
+
+				stopRegistry, err := rc.startRegistry(st.withManifest)
+				if err != nil {
+					return err
+				}
+				return multierror.Append(st.serveControlAPI(ctx), stopRegistry()).ErrorOrNil()
+			})
+		})
+	})
+}
+
+// projectListenAddrs returns a map of listen address to project name, if selecting by listen address
+func (rc *ServeCommand) projectListenAddrs() (map[string]string, error) {
+	if rc.SelectBy != selectByListenAddr {
+		if len(rc.ProjectListenAddrs) != 0 {
+			return nil, fmt.Errorf("--project-listen-addr requires --select-by=%s", selectByListenAddr)
+		}
+		return nil, nil
+	}
+	rv := make(map[string]string)
+	for name := range rc.Projects {
+		addr, ok := rc.ProjectListenAddrs[name]
+		if !ok {
+			return nil, fmt.Errorf("no --project-listen-addr specified for project: %s", name)
+		}
+		if addr == rc.ListenAddr {
+			return nil, fmt.Errorf("listen address for project %s must differ from --listen-addr", name)
+		}
+		if other, dupe := rv[addr]; dupe {
+			return nil, fmt.Errorf("listen address %s used by more than one project: %s, %s", addr, name, other)
+		}
+		rv[addr] = name
+	}
+	for name := range rc.ProjectListenAddrs {
+		if _, ok := rc.Projects[name]; !ok {
+			return nil, fmt.Errorf("--project-listen-addr specified for unknown project: %s", name)
+		}
+	}
+	return rv, nil
+}
+
+// serveState holds everything that the control API may change while we are running
+type serveState struct {
+	opts           *ServeCommand
+	dummyOK        *re.MultiRegexMatcher
+	client         *http.Client
+	misses         *missLog
+	started        time.Time
+	projectForAddr map[string]string // only set if selecting by listen address
+
+	switchMu      sync.Mutex     // held while switching, so that only one switch happens at a time
+	retiring      sync.WaitGroup // manifests that have been switched away from, but not yet closed
+	retiringPaths map[string]int // paths of those opened in build mode, guarded by mu
+
+	// held briefly to look up or swap manifests, never while serving a request
+	mu        sync.RWMutex
+	mode      string
+	manifests map[string]*servedManifest // keyed by project name, which is "" unless --project is used
+	proxyAddr string
+	socksAddr string
+	caPem     []byte
+	env       []string
+}
+
+type servedManifest struct {
+	path string
+	mode string
+	lctx *listenerCtx
+
+	// requests currently using this manifest, it is closed once these finish after being switched away from
+	refs sync.WaitGroup
+}
+
+// acquire returns the manifest for a project, which the caller must release with refs.Done()
+func (st *serveState) acquire(name string) (*servedManifest, bool) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	sm, ok := st.manifests[name]
+	if ok {
+		sm.refs.Add(1)
+	}
+	return sm, ok
+}
+
+func (st *serveState) multiProject() bool {
+	return len(st.opts.Projects) != 0
+}
+
+func (st *serveState) handle(w http.ResponseWriter, r *http.Request) {
+	name := ""
+	if st.multiProject() {
+		var ok bool
+		name, ok = st.selectProject(r)
+		if !ok {
+			if st.opts.SelectBy == selectByUsername {
+				w.Header().Set("Proxy-Authenticate", `Basic realm="htvend"`)
+				http.Error(w, "htvend project must be specified as the proxy username", http.StatusProxyAuthRequired)
+			} else {
+				http.Error(w, "no htvend project selected", http.StatusForbidden)
+			}
+			return
+		}
+	}
+
+	sm, ok := st.acquire(name)
+	if !ok {
+		if st.multiProject() {
+			http.Error(w, "unknown htvend project: "+name, http.StatusForbidden)
+		} else {
+			http.Error(w, "htvend has no manifest loaded, see control API", http.StatusServiceUnavailable)
+		}
+		return
+	}
+	defer sm.refs.Done()
+	serveWithListenerCtx(sm.lctx)(w, r)
+}
+
+// selectProject returns the project name that the client asked for
+func (st *serveState) selectProject(r *http.Request) (string, bool) {
+	ci, ok := proxyserver.ClientInfoFromContext(r.Context())
+	if !ok {
+		return "", false
+	}
+	switch st.opts.SelectBy {
+	case selectByUsername:
+		if ci.Username != "" {
+			return ci.Username, true // from SOCKS5 authentication
+		}
+		user, _, ok := parseProxyAuthorization(ci.Header.Get("Proxy-Authorization"))
+		return user, ok && user != ""
+	case selectByHeader:
+		name := ci.Header.Get(st.opts.SelectHeader)
+		return name, name != ""
+	case selectByListenAddr:
+		name, ok := st.projectForAddr[ci.ListenAddr]
+		return name, ok
+	default:
+		return "", false
+	}
+}
+
+// parseProxyAuthorization parses a Basic Proxy-Authorization header value
+func parseProxyAuthorization(v string) (username, password string, ok bool) {
+	const prefix = "basic "
+	if len(v) < len(prefix) || !strings.EqualFold(v[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	bb, err := base64.StdEncoding.DecodeString(v[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+	username, password, ok = strings.Cut(string(bb), ":")
+	return username, password, ok
+}
+
+// switchTo opens manifests in the given mode, then swaps them in for new requests. paths maps
+// project names to manifest paths, and replaces (or adds) those. Manifests that are unchanged
+// are kept open, and those replaced are closed (and saved) in the background, once in-flight
+// requests using them have finished. On failure nothing is changed.
+func (st *serveState) switchTo(mode string, paths map[string]string) error {
+	if mode != serveModeBuild && mode != serveModeOffline {
+		return fmt.Errorf("unknown mode: %s", mode)
+	}
+
+	st.switchMu.Lock()
+	defer st.switchMu.Unlock()
+
+	// only we change this, so it can't change under us
+	st.mu.RLock()
+	current := maps.Clone(st.manifests)
+	st.mu.RUnlock()
+
+	target := make(map[string]string)
+	for name, sm := range current {
+		target[name] = sm.path
+	}
+	maps.Copy(target, paths)
+
+	next := make(map[string]*servedManifest)
+	var opened []*servedManifest
+	for _, name := range slices.Sorted(maps.Keys(target)) {
+		path := target[name]
+		prev, ok := current[name]
+		if ok && prev.path == path && prev.mode == mode {
+			next[name] = prev
+			continue
+		}
+		if ok && prev.path == path && prev.mode == serveModeBuild {
+			// so that the new one starts from everything fetched so far
+			if err := prev.lctx.Assets.Flush(); err != nil {
+				closeServedManifests(opened)
+				return fmt.Errorf("error flushing manifest %s: %w", path, err)
+			}
+		}
+		if mode == serveModeBuild && st.isRetiring(path) {
+			closeServedManifests(opened)
+			return fmt.Errorf("manifest %s is still being written by in-flight requests, try again once they finish", path)
+		}
+		lctx, err := st.openListenerCtx(mode, path)
+		if err != nil {
+			closeServedManifests(opened)
+			if name != "" {
+				return fmt.Errorf("error opening manifest for project %s: %w", name, err)
+			}
+			return err
+		}
+		sm := &servedManifest{path: path, mode: mode, lctx: lctx}
+		next[name] = sm
+		opened = append(opened, sm)
+	}
+
+	st.mu.Lock()
+	st.mode = mode
+	st.manifests = next
+	st.mu.Unlock()
+
+	for name, sm := range current {
+		if next[name] != sm {
+			st.retire(sm)
+		}
+	}
+	for name, sm := range next {
+		if name == "" {
+			logrus.Infof("Now serving %s in %s mode", sm.path, mode)
+		} else {
+			logrus.Infof("Now serving %s for project %s in %s mode", sm.path, name, mode)
+		}
+	}
+	return nil
+}
+
+// retire closes sm once no requests are using it. It must no longer be in st.manifests.
+func (st *serveState) retire(sm *servedManifest) {
+	if sm.mode == serveModeBuild {
+		st.mu.Lock()
+		if st.retiringPaths == nil {
+			st.retiringPaths = make(map[string]int)
+		}
+		st.retiringPaths[sm.path]++
+		st.mu.Unlock()
+	}
+
+	st.retiring.Add(1)
+	go func() {
+		defer st.retiring.Done()
+		sm.refs.Wait()
+		if err := sm.lctx.Assets.Close(); err != nil {
+			logrus.Errorf("error closing manifest %s: %v", sm.path, err)
+		}
+		if sm.mode == serveModeBuild {
+			st.mu.Lock()
+			st.retiringPaths[sm.path]--
+			if st.retiringPaths[sm.path] == 0 {
+				delete(st.retiringPaths, sm.path)
+			}
+			st.mu.Unlock()
+		}
+	}()
+}
+
+// isRetiring returns true if a manifest at path, opened in build mode, has not yet been closed
+func (st *serveState) isRetiring(path string) bool {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	return st.retiringPaths[path] != 0
+}
+
+// closeServedManifests closes manifests that no requests can be using
+func closeServedManifests(sms []*servedManifest) {
+	for _, sm := range sms {
+		if err := sm.lctx.Assets.Close(); err != nil {
+			logrus.Warnf("error closing manifest %s: %v", sm.path, err)
+		}
+	}
+}
+
+func (st *serveState) openListenerCtx(mode, path string) (*listenerCtx, error) {
+	writable := mode == serveModeBuild
+
+	bs, err := st.opts.ManifestOptions.MakeBlobStore(writable)
+	if err != nil {
+		return nil, fmt.Errorf("error making blob store: %w", err)
+	}
+
+	mo := st.opts.ManifestOptions
+	mo.ManifestFile = path
+	mf, err := mo.MakeManifestFile(&manifestContextOptions{
+		Writable:    writable,
+		NoCacheList: st.opts.FetchOptions.NoCache,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error getting manifest file: %w", err)
+	}
+
+	lctx := &listenerCtx{
+		Assets: mf,
+		Blobs:  bs,
+		Misses: st.misses,
+	}
+	if writable {
+		lctx.FetchIfMissing = true
+		lctx.HeadersToCache = st.opts.FetchOptions.CacheHeaderMap()
+		lctx.Client = st.client
+		lctx.StreamingPolicy = st.opts.StreamingPolicy
+	} else {
+		lctx.FailIfMissing = true
+		lctx.DummyOK = st.dummyOK
+	}
+	return lctx, nil
+}
+
+// withManifest is an ociregistry.WithManifest serving from the current manifest
+func (st *serveState) withManifest(cb func(assets *lockfile.File, blobs blobstore.Store) error) error {
+	sm, ok := st.acquire("")
+	if !ok {
+		return errors.New("no manifest loaded")
+	}
+	defer sm.refs.Done()
+	return cb(sm.lctx.Assets, sm.lctx.Blobs)
+}
+
+func (st *serveState) flush() error {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	if len(st.manifests) == 0 {
+		return errors.New("no manifest loaded")
+	}
+	var rv error
+	for _, sm := range st.manifests {
+		if err := sm.lctx.Assets.Flush(); err != nil {
+			rv = multierror.Append(rv, err)
+		}
+	}
+	return rv
+}
+
+// close waits for any requests to finish, then closes all manifests
+func (st *serveState) close() error {
+	st.switchMu.Lock()
+	defer st.switchMu.Unlock()
+
+	st.mu.Lock()
+	current := st.manifests
+	st.manifests = nil
+	st.mu.Unlock()
+
+	st.retiring.Wait()
+	var rv error
+	for _, sm := range current {
+		sm.refs.Wait()
+		if err := sm.lctx.Assets.Close(); err != nil {
+			rv = multierror.Append(rv, err)
+		}
+	}
+	return rv
+}
+
+// missLog remembers the most recent requests for missing assets
+type missLog struct {
+	mu      sync.Mutex
+	max     int
+	entries []missEntry
+}
+
+type missEntry struct {
+	Time time.Time `json:"time"`
+	URL  string    `json:"url"`
+}
+
+func newMissLog(max int) *missLog {
+	return &missLog{max: max}
+}
+
+// Record is a no-op if m is nil
+func (m *missLog) Record(u string) {
+	if m == nil || m.max <= 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.entries = append(m.entries, missEntry{Time: time.Now(), URL: u})
+	if len(m.entries) > m.max {
+		m.entries = m.entries[len(m.entries)-m.max:]
+	}
+}
+
+// Recent returns the remembered misses, oldest first
+func (m *missLog) Recent() []missEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]missEntry{}, m.entries...)
+}
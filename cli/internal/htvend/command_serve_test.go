@@ -0,0 +1,284 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package htvend
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/continusec/htvend/internal/lockfile"
+	"github.com/continusec/htvend/internal/proxyserver"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestServeState(dir string, client *http.Client) *serveState {
+	return &serveState{
+		opts: &ServeCommand{
+			ManifestOptions: ManifestOptions{
+				CacheOptions: CacheOptions{
+					BlobsBackend: "filesystem",
+					BlobsDir:     filepath.Join(dir, "blobs"),
+				},
+			},
+			ControlDir: dir,
+		},
+		client:  client,
+		misses:  newMissLog(10),
+		started: time.Now(),
+	}
+}
+
+// proxyRequest makes a request as the proxy server would pass it to us
+func proxyRequest(method, u string, body string) *http.Request {
+	return httptest.NewRequest(method, u, strings.NewReader(body))
+}
+
+func TestServeSwitchDoesNotWaitForRequests(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-release
+		}
+		_, _ = w.Write([]byte("content of " + r.URL.Path))
+	}))
+	defer upstream.Close()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "assets.json")
+	st := newTestServeState(dir, upstream.Client())
+	require.NoError(t, st.switchTo(serveModeBuild, map[string]string{"": path}))
+
+	slow := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		st.handle(slow, proxyRequest(http.MethodGet, upstream.URL+"/slow", ""))
+	}()
+	<-started
+
+	// switching, and new requests, don't wait for the slow download
+	switched := make(chan struct{})
+	go func() {
+		defer close(switched)
+		rec := httptest.NewRecorder()
+		st.controlMux().ServeHTTP(rec, proxyRequest(http.MethodPut, "http://htvend/mode", `{"mode":"offline"}`))
+		assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	}()
+	select {
+	case <-switched:
+	case <-time.After(5 * time.Second):
+		t.Fatal("switch blocked by in-flight request")
+	}
+	rec := httptest.NewRecorder()
+	st.handle(rec, proxyRequest(http.MethodGet, upstream.URL+"/other", ""))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	// nor can we go back to build mode while the old manifest may still be written
+	assert.ErrorContains(t, st.switchTo(serveModeBuild, nil), "in-flight")
+
+	close(release)
+	<-done
+	assert.Equal(t, http.StatusOK, slow.Code)
+	assert.Equal(t, "content of /slow", slow.Body.String())
+
+	// once drained, the old manifest is saved
+	require.NoError(t, st.close())
+	mf, err := lockfile.NewMapFile(lockfile.MapFileOptions{Path: path})
+	require.NoError(t, err)
+	bi, found, err := mf.GetBlob(mustParse(t, upstream.URL+"/slow"))
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, sha256Hex("content of /slow"), bi.Sha256)
+}
+
+func TestServeControlManifestDir(t *testing.T) {
+	dir := t.TempDir()
+	st := newTestServeState(dir, nil)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "assets.json"), []byte("{}"), 0o644))
+	require.NoError(t, st.switchTo(serveModeOffline, map[string]string{"": filepath.Join(dir, "assets.json")}))
+	defer func() { assert.NoError(t, st.close()) }()
+
+	put := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		st.controlMux().ServeHTTP(rec, proxyRequest(http.MethodPut, "http://htvend/manifest", body))
+		return rec
+	}
+
+	for _, p := range []string{"../assets.json", "/etc/assets.json", filepath.Join(dir, "..", "assets.json")} {
+		rec := put(`{"path":"` + p + `"}`)
+		assert.Equal(t, http.StatusForbidden, rec.Code, p)
+	}
+
+	rec := put(`{"path":"other.json","mode":"build"}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	status := st.status()
+	assert.Equal(t, serveModeBuild, status.Mode)
+	assert.Equal(t, "other.json", filepath.Base(status.Manifest))
+}
+
+// clientRequest makes a request as the proxy server would pass it to us, for the given client
+func clientRequest(u string, ci *proxyserver.ClientInfo) *http.Request {
+	r := proxyRequest(http.MethodGet, u, "")
+	if ci == nil {
+		return r
+	}
+	if ci.Header == nil {
+		ci.Header = make(http.Header)
+	}
+	return r.WithContext(proxyserver.WithClientInfo(r.Context(), ci))
+}
+
+func TestServeSelectProject(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("content of " + r.URL.Path))
+	}))
+	defer upstream.Close()
+
+	for _, tc := range []struct {
+		selectBy string
+		a, b     *proxyserver.ClientInfo
+		unknown  *proxyserver.ClientInfo
+		missing  int
+	}{
+		{
+			selectBy: selectByUsername,
+			a:        &proxyserver.ClientInfo{Username: "a"}, // SOCKS5
+			b:        &proxyserver.ClientInfo{Header: http.Header{"Proxy-Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte("b:"))}}},
+			unknown:  &proxyserver.ClientInfo{Username: "c"},
+			missing:  http.StatusProxyAuthRequired,
+		},
+		{
+			selectBy: selectByHeader,
+			a:        &proxyserver.ClientInfo{Header: http.Header{"X-Htvend-Project": {"a"}}},
+			b:        &proxyserver.ClientInfo{Header: http.Header{"X-Htvend-Project": {"b"}}},
+			unknown:  &proxyserver.ClientInfo{Header: http.Header{"X-Htvend-Project": {"c"}}},
+			missing:  http.StatusForbidden,
+		},
+		{
+			selectBy: selectByListenAddr,
+			a:        &proxyserver.ClientInfo{ListenAddr: "127.0.0.1:8081"},
+			b:        &proxyserver.ClientInfo{ListenAddr: "127.0.0.1:8082"},
+			unknown:  &proxyserver.ClientInfo{ListenAddr: "127.0.0.1:8080"},
+			missing:  http.StatusForbidden,
+		},
+	} {
+		t.Run(tc.selectBy, func(t *testing.T) {
+			dir := t.TempDir()
+			projects := map[string]string{
+				"a": filepath.Join(dir, "a.json"),
+				"b": filepath.Join(dir, "b.json"),
+			}
+			st := newTestServeState(dir, upstream.Client())
+			st.opts.Projects = projects
+			st.opts.SelectBy = tc.selectBy
+			st.opts.SelectHeader = "X-Htvend-Project"
+			st.projectForAddr = map[string]string{"127.0.0.1:8081": "a", "127.0.0.1:8082": "b"}
+			require.NoError(t, st.switchTo(serveModeBuild, projects))
+
+			get := func(path string, ci *proxyserver.ClientInfo) *httptest.ResponseRecorder {
+				rec := httptest.NewRecorder()
+				st.handle(rec, clientRequest(upstream.URL+path, ci))
+				return rec
+			}
+			assert.Equal(t, http.StatusOK, get("/a", tc.a).Code)
+			assert.Equal(t, http.StatusOK, get("/b", tc.b).Code)
+			assert.Equal(t, http.StatusForbidden, get("/c", tc.unknown).Code)
+
+			rec := get("/none", nil)
+			assert.Equal(t, tc.missing, rec.Code)
+			if tc.missing == http.StatusProxyAuthRequired {
+				assert.NotEmpty(t, rec.Header().Get("Proxy-Authenticate"))
+			}
+			require.NoError(t, st.close())
+
+			// each request is recorded in its own project only
+			for name, want := range map[string]string{"a": "/a", "b": "/b"} {
+				mf, err := lockfile.NewMapFile(lockfile.MapFileOptions{Path: projects[name]})
+				require.NoError(t, err)
+				var got []string
+				require.NoError(t, mf.ForEach(func(k *url.URL, _ lockfile.BlobInfo) error {
+					got = append(got, k.Path)
+					return nil
+				}))
+				assert.Equal(t, []string{want}, got, name)
+				require.NoError(t, mf.Close())
+			}
+		})
+	}
+}
+
+func TestServeProjectListenAddrs(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		rc    ServeCommand
+		want  map[string]string
+		error string
+	}{
+		{
+			name: "not selecting by listen-addr",
+			rc:   ServeCommand{SelectBy: selectByUsername, Projects: map[string]string{"a": "a.json"}},
+		},
+		{
+			name:  "addrs without listen-addr",
+			rc:    ServeCommand{SelectBy: selectByHeader, Projects: map[string]string{"a": "a.json"}, ProjectListenAddrs: map[string]string{"a": ":8081"}},
+			error: "requires --select-by=listen-addr",
+		},
+		{
+			name: "ok",
+			rc:   ServeCommand{SelectBy: selectByListenAddr, Projects: map[string]string{"a": "a.json", "b": "b.json"}, ProjectListenAddrs: map[string]string{"a": ":8081", "b": ":8082"}},
+			want: map[string]string{":8081": "a", ":8082": "b"},
+		},
+		{
+			name:  "missing addr",
+			rc:    ServeCommand{SelectBy: selectByListenAddr, Projects: map[string]string{"a": "a.json", "b": "b.json"}, ProjectListenAddrs: map[string]string{"a": ":8081"}},
+			error: "no --project-listen-addr specified for project: b",
+		},
+		{
+			name:  "same as main listener",
+			rc:    ServeCommand{ProxyOptions: ProxyOptions{ListenAddr: ":8081"}, SelectBy: selectByListenAddr, Projects: map[string]string{"a": "a.json"}, ProjectListenAddrs: map[string]string{"a": ":8081"}},
+			error: "must differ from --listen-addr",
+		},
+		{
+			name:  "shared addr",
+			rc:    ServeCommand{SelectBy: selectByListenAddr, Projects: map[string]string{"a": "a.json", "b": "b.json"}, ProjectListenAddrs: map[string]string{"a": ":8081", "b": ":8081"}},
+			error: "used by more than one project",
+		},
+		{
+			name:  "unknown project",
+			rc:    ServeCommand{SelectBy: selectByListenAddr, Projects: map[string]string{"a": "a.json"}, ProjectListenAddrs: map[string]string{"a": ":8081", "c": ":8083"}},
+			error: "unknown project: c",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := tc.rc.projectListenAddrs()
+			if tc.error != "" {
+				assert.ErrorContains(t, err, tc.error)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
@@ -0,0 +1,229 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package htvend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/continusec/htvend/internal/app"
+	"github.com/continusec/htvend/internal/blobstore"
+	"github.com/continusec/htvend/internal/jobs"
+	"github.com/continusec/htvend/internal/lockfile"
+	"github.com/continusec/htvend/internal/re"
+	"github.com/continusec/htvend/internal/registryauthclient"
+	"github.com/continusec/htvend/internal/secrets"
+	"github.com/jessevdk/go-flags"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	changedAssetCount = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "htvend_changed_asset_total",
+		Help: "The total number of assets whose content changed when re-fetched",
+	})
+)
+
+var _ flags.Commander = &UpdateCommand{}
+
+type UpdateCommand struct {
+	ManifestOptions
+	FetchOptions
+
+	Match     []string      `long:"match" description:"Regex list of URLs to re-fetch from upstream. If not set, all entries are candidates."`
+	OlderThan time.Duration `long:"older-than" description:"Only re-fetch entries with a cached Last-Modified header older than this (e.g. 720h). Entries without one are skipped, and it is an error if none have one, so add Last-Modified to --cache-header when building."`
+
+	DisableHTTP2 bool `long:"disable-http2" description:"Only use HTTP/1.1 with upstream servers"`
+
+	JobsOptions
+}
+
+func (rc *UpdateCommand) Execute(args []string) (retErr error) {
+	if len(rc.Match) == 0 && rc.OlderThan == 0 {
+		return errors.New("at least one of --match or --older-than must be specified (use build --force-refresh to refresh everything)")
+	}
+
+	match, err := re.NewMultiRegexMatcher(rc.Match)
+	if err != nil {
+		return fmt.Errorf("error creating match regex matcher: %w", err)
+	}
+
+	mf, err := rc.ManifestOptions.MakeManifestFile(&manifestContextOptions{
+		Writable:       true,
+		AllowOverwrite: true,
+		NoCacheList:    rc.FetchOptions.NoCache,
+	})
+	if err != nil {
+		return fmt.Errorf("error getting manifest file: %w", err)
+	}
+	defer func() {
+		if err := mf.Close(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+
+	bs, err := rc.ManifestOptions.MakeBlobStore(true)
+	if err != nil {
+		return fmt.Errorf("error creating blob store: %w", err)
+	}
+
+	matches := func(k *url.URL) bool {
+		return len(rc.Match) == 0 || match.Match(secrets.RedactURL(k))
+	}
+	if rc.OlderThan != 0 {
+		if err := checkLastModifiedCached(mf, matches); err != nil {
+			return err
+		}
+	}
+
+	return app.RunUntilSignals(func(ctx context.Context) error {
+		return doUpdate(ctx, &updateCtx{
+			Assets:         mf,
+			Blobs:          bs,
+			HeadersToCache: rc.FetchOptions.CacheHeaderMap(),
+			Client: &http.Client{
+				Transport: registryauthclient.NewClient(newUpstreamClient(rc.DisableHTTP2).Transport),
+			},
+			Jobs: &rc.JobsOptions,
+			Selected: func(k *url.URL, v lockfile.BlobInfo) bool {
+				if !matches(k) {
+					return false
+				}
+				if rc.OlderThan != 0 {
+					lm, err := http.ParseTime(v.Headers["Last-Modified"])
+					if err != nil {
+						logrus.Debugf("no usable Last-Modified header, skipping: %s", secrets.RedactURL(k))
+						return false
+					}
+					if time.Since(lm) < rc.OlderThan {
+						return false
+					}
+				}
+				return true
+			},
+		})
+	})
+}
+
+// checkLastModifiedCached fails if none of the entries that match have a cached Last-Modified
+// header, as --older-than would silently select nothing. It isn't cached by default.
+func checkLastModifiedCached(mf *lockfile.File, matches func(k *url.URL) bool) error {
+	var total, missing int
+	if err := mf.ForEach(func(k *url.URL, v lockfile.BlobInfo) error {
+		if !matches(k) {
+			return nil
+		}
+		total++
+		if _, err := http.ParseTime(v.Headers["Last-Modified"]); err != nil {
+			missing++
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("error iterating manifest: %w", err)
+	}
+	switch {
+	case total != 0 && missing == total:
+		return fmt.Errorf("--older-than can't select anything, as none of the %d entries have a cached Last-Modified header, rebuild with --cache-header Last-Modified (as well as the defaults) to use it", total)
+	case missing != 0:
+		logrus.Warnf("Skipping %d of %d entries without a cached Last-Modified header, as --older-than can't tell their age", missing, total)
+	}
+	return nil
+}
+
+type updateCtx struct {
+	Assets         *lockfile.File
+	Blobs          blobstore.Store
+	HeadersToCache map[string]bool
+	Client         *http.Client
+	Jobs           *JobsOptions
+	Selected       func(k *url.URL, v lockfile.BlobInfo) bool
+}
+
+func doUpdate(ctx context.Context, uctx *updateCtx) error {
+	type candidate struct {
+		K *url.URL
+		V lockfile.BlobInfo
+	}
+
+	// gather first, as we can't call back into the manifest while iterating it
+	var candidates []candidate
+	if err := uctx.Assets.ForEach(func(k *url.URL, v lockfile.BlobInfo) error {
+		if uctx.Selected(k, v) {
+			candidates = append(candidates, candidate{K: k, V: v})
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("error iterating manifest: %w", err)
+	}
+
+	progress := jobs.NewProgress("update", int64(len(candidates)), 0)
+	stopProgress := progress.Display(os.Stderr)
+	var mu sync.Mutex
+	var changed int
+	mt := uctx.Jobs.MakeMultiTasker(ctx)
+	for _, c := range candidates {
+		mt.Queue(func(ctx context.Context) error {
+			if err := checkFetchable(c.K, c.V); err != nil {
+				return jobs.Permanent(err)
+			}
+			status, err := fetchAndSaveBlob(ctx, uctx.Assets, uctx.Blobs, http.MethodGet, nil, c.K, uctx.Client, uctx.HeadersToCache, nil, nil)
+			if err != nil {
+				return fmt.Errorf("error fetching %s: %w", secrets.RedactURL(c.K), err)
+			}
+			if status != http.StatusOK {
+				err := fmt.Errorf("unexpected status fetching %s: %d (entry left unchanged)", secrets.RedactURL(c.K), status)
+				if status < http.StatusInternalServerError {
+					err = jobs.Permanent(err)
+				}
+				return err
+			}
+			defer progress.ItemDone()
+
+			nv, found, err := uctx.Assets.GetBlob(c.K)
+			if err != nil {
+				return jobs.Permanent(fmt.Errorf("error re-reading entry for %s: %w", secrets.RedactURL(c.K), err))
+			}
+			switch {
+			case !found:
+				logrus.Warnf("Not stored after fetch (matches --no-cache-response?): %s", secrets.RedactURL(c.K))
+			case nv.Sha256 != c.V.Sha256:
+				mu.Lock()
+				changed++
+				mu.Unlock()
+				changedAssetCount.Inc()
+				logrus.Infof("Changed: %s (%s -> %s)", secrets.RedactURL(c.K), c.V.Sha256, nv.Sha256)
+			default:
+				logrus.Infof("Unchanged: %s", secrets.RedactURL(c.K))
+			}
+			return nil
+		})
+	}
+	err := mt.Wait(func(err error) {
+		logrus.Errorf("error during parallel job: %v", err)
+	})
+	stopProgress()
+
+	logrus.Infof("Re-fetched %d entries, %d changed", len(candidates), changed)
+
+	return err
+}
@@ -0,0 +1,172 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package htvend
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/continusec/htvend/internal/blobstore/directory"
+	"github.com/continusec/htvend/internal/lockfile"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mustParse(t *testing.T, s string) *url.URL {
+	u, err := url.Parse(s)
+	require.NoError(t, err)
+	return u
+}
+
+func sha256Hex(s string) string {
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:])
+}
+
+// newTestManifest returns a writable manifest and blob store in a temp dir
+func newTestManifest(t *testing.T) (*lockfile.File, *directory.DirectoryStore) {
+	mf, blobs := openTestManifest(t, t.TempDir())
+	t.Cleanup(func() { assert.NoError(t, mf.Close()) })
+	return mf, blobs
+}
+
+// openTestManifest returns a writable manifest and blob store in dir, which the caller must close
+func openTestManifest(t *testing.T, dir string) (*lockfile.File, *directory.DirectoryStore) {
+	mf, err := lockfile.NewMapFile(lockfile.MapFileOptions{
+		Path:           filepath.Join(dir, "assets.json"),
+		Writable:       true,
+		AllowOverwrite: true,
+	})
+	require.NoError(t, err)
+	return mf, directory.NewDirectoryStore(filepath.Join(dir, "blobs"), true)
+}
+
+// contentServer serves the current value of each path, which tests may change.
+// Last-Modified is different for every response, as some servers do.
+type contentServer struct {
+	mu       sync.Mutex
+	content  map[string]string
+	requests int
+}
+
+func (cs *contentServer) set(path, body string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.content[path] = body
+}
+
+func (cs *contentServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cs.mu.Lock()
+	body, ok := cs.content[r.URL.Path]
+	cs.requests++
+	lastModified := time.Unix(1700000000, 0).Add(time.Duration(cs.requests) * time.Second)
+	cs.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	_, _ = w.Write([]byte(body))
+}
+
+func newContentServer(t *testing.T, content map[string]string) (*contentServer, *httptest.Server) {
+	cs := &contentServer{content: content}
+	srv := httptest.NewServer(cs)
+	t.Cleanup(srv.Close)
+	return cs, srv
+}
+
+func TestUpdate(t *testing.T) {
+	cs, srv := newContentServer(t, map[string]string{
+		"/a": "a1",
+		"/b": "b1",
+	})
+	mf, bs := newTestManifest(t)
+	a, b, gone := mustParse(t, srv.URL+"/a"), mustParse(t, srv.URL+"/b"), mustParse(t, srv.URL+"/gone")
+	require.NoError(t, mf.AddBlob(a, lockfile.BlobInfo{Sha256: sha256Hex("a1")}))
+	require.NoError(t, mf.AddBlob(b, lockfile.BlobInfo{Sha256: sha256Hex("b1")}))
+	require.NoError(t, mf.AddBlob(gone, lockfile.BlobInfo{Sha256: sha256Hex("gone")}))
+
+	cs.set("/a", "a2")
+	cs.set("/b", "b2")
+
+	update := func(selected ...*url.URL) error {
+		return doUpdate(context.Background(), &updateCtx{
+			Assets:         mf,
+			Blobs:          bs,
+			HeadersToCache: map[string]bool{},
+			Client:         srv.Client(),
+			Jobs:           &JobsOptions{Jobs: 2},
+			Selected: func(k *url.URL, v lockfile.BlobInfo) bool {
+				for _, s := range selected {
+					if k.String() == mf.KeyFor(s) {
+						return true
+					}
+				}
+				return false
+			},
+		})
+	}
+
+	// only the selected entry is re-fetched
+	require.NoError(t, update(a))
+	for u, want := range map[*url.URL]string{a: "a2", b: "b1"} {
+		bi, found, err := mf.GetBlob(u)
+		require.NoError(t, err)
+		assert.True(t, found)
+		assert.Equal(t, sha256Hex(want), bi.Sha256, u.String())
+	}
+
+	// an entry recorded with a signature can't be fetched again
+	signed := mustParse(t, srv.URL+"/a?X-Amz-Signature=abc")
+	require.NoError(t, mf.AddBlob(signed, lockfile.BlobInfo{Sha256: sha256Hex("a1")}))
+	assert.ErrorContains(t, update(signed), "can't re-fetch")
+
+	// an entry that has vanished upstream is reported, and left alone
+	err := update(gone)
+	require.Error(t, err)
+	assert.True(t, strings.Contains(err.Error(), "404"), err.Error())
+	bi, found, err := mf.GetBlob(gone)
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, sha256Hex("gone"), bi.Sha256)
+}
+
+func TestCheckLastModifiedCached(t *testing.T) {
+	mf, _ := newTestManifest(t)
+	require.NoError(t, mf.AddBlob(mustParse(t, "https://example.com/a"), lockfile.BlobInfo{Sha256: sha256Hex("a")}))
+	require.NoError(t, mf.AddBlob(mustParse(t, "https://example.com/b"), lockfile.BlobInfo{
+		Sha256:  sha256Hex("b"),
+		Headers: map[string]string{"Last-Modified": "Tue, 14 Nov 2023 22:13:20 GMT"},
+	}))
+	matching := func(path string) func(k *url.URL) bool {
+		return func(k *url.URL) bool { return path == "" || k.Path == path }
+	}
+
+	// built with the default --cache-header, so there is nothing to go on
+	assert.ErrorContains(t, checkLastModifiedCached(mf, matching("/a")), "none of the 1 entries have a cached Last-Modified header")
+	assert.NoError(t, checkLastModifiedCached(mf, matching("/b")))
+	assert.NoError(t, checkLastModifiedCached(mf, matching(""))) // some are skipped
+	assert.NoError(t, checkLastModifiedCached(mf, matching("/none")))
+}
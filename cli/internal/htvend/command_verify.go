@@ -16,6 +16,8 @@ package htvend
 
 import (
 	"bytes"
+	"context"
+	"crypto"
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
@@ -23,11 +25,21 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/continusec/htvend/internal/app"
 	"github.com/continusec/htvend/internal/blobstore"
 	blobs "github.com/continusec/htvend/internal/blobstore"
+	"github.com/continusec/htvend/internal/cosign"
+	"github.com/continusec/htvend/internal/jobs"
 	"github.com/continusec/htvend/internal/lockfile"
 	"github.com/continusec/htvend/internal/registryauthclient"
+	"github.com/continusec/htvend/internal/secrets"
 	"github.com/hashicorp/go-multierror"
 	"github.com/jessevdk/go-flags"
 	"github.com/sirupsen/logrus"
@@ -41,9 +53,39 @@ type VerifyCommand struct {
 
 	Fetch  bool `long:"fetch" description:"If set, fetch missing assets"`
 	Repair bool `long:"repair" description:"If set, replace any missing assets with new versions currently found (implies fetch). May still require a rebuild afterwards (e.g. if they trigger other new calls)."`
+
+	Upstream       bool   `long:"upstream" description:"If set, don't check local blobs. Instead re-request every URL from upstream and report any that have changed, vanished or moved. Never modifies the manifest."`
+	UpstreamMethod string `long:"upstream-method" default:"GET" choice:"GET" choice:"HEAD" description:"GET downloads and hashes each asset. HEAD compares cached headers only, with a conditional request if Etag or Last-Modified were cached."`
+	Report         string `long:"report" description:"If set, write a JSON report of upstream checks to this file (- for stdout)"`
+
+	DisableHTTP2 bool `long:"disable-http2" description:"Only use HTTP/1.1 with upstream servers, for --fetch, --repair and --upstream"`
+
+	Images        bool     `long:"images" description:"If set, also check cosign signatures of container images in the manifest, against --cosign-key, without network access"`
+	CosignKeys    []string `long:"cosign-key" description:"List of PEM public key files to check image signatures against, for --images"`
+	RequireSigned bool     `long:"require-signed" description:"If set, fail if any image doesn't have a valid signature, for --images. Otherwise a warning is logged."`
+
+	JobsOptions
 }
 
 func (rc *VerifyCommand) Execute(args []string) (retErr error) {
+	if rc.Upstream {
+		if rc.Images {
+			return fmt.Errorf("--upstream cannot be combined with --images")
+		}
+		return rc.executeUpstream()
+	}
+
+	var keys []crypto.PublicKey
+	if rc.Images {
+		if len(rc.CosignKeys) == 0 {
+			return fmt.Errorf("--images requires at least one --cosign-key")
+		}
+		var err error
+		if keys, err = cosign.LoadPublicKeys(rc.CosignKeys); err != nil {
+			return err
+		}
+	}
+
 	mf, err := rc.ManifestOptions.MakeManifestFile(&manifestContextOptions{
 		Writable:       rc.Repair,
 		AllowOverwrite: rc.Repair,
@@ -58,19 +100,59 @@ func (rc *VerifyCommand) Execute(args []string) (retErr error) {
 		}
 	}()
 
-	bs, err := rc.ManifestOptions.MakeBlobStore(rc.Fetch)
+	bs, err := rc.ManifestOptions.MakeBlobStore(rc.Fetch || rc.Repair)
 	if err != nil {
 		return fmt.Errorf("error creating blob store: %w", err)
 	}
 
-	return doValidate(&validateCtx{
-		Assets:         mf,
-		Blobs:          bs,
-		FailIfMissing:  !rc.Fetch && !rc.Repair,
-		FetchIfMissing: rc.Fetch || rc.Repair,
-		RepairIfWrong:  rc.Repair,
-		ValidateSHA256: true,
-		HeadersToCache: rc.FetchOptions.CacheHeaderMap(),
+	return app.RunUntilSignals(func(ctx context.Context) error {
+		if err := doValidate(ctx, &validateCtx{
+			Assets:         mf,
+			Blobs:          bs,
+			FailIfMissing:  !rc.Fetch && !rc.Repair,
+			FetchIfMissing: rc.Fetch || rc.Repair,
+			RepairIfWrong:  rc.Repair,
+			ValidateSHA256: true,
+			HeadersToCache: rc.FetchOptions.CacheHeaderMap(),
+			Client: &http.Client{
+				Transport: registryauthclient.NewClient(newUpstreamClient(rc.DisableHTTP2).Transport),
+			},
+			Jobs: &rc.JobsOptions,
+		}); err != nil {
+			return err
+		}
+		if rc.Images {
+			return verifyImages(mf, bs, keys, rc.RequireSigned)
+		}
+		return nil
+	})
+}
+
+func (rc *VerifyCommand) executeUpstream() (retErr error) {
+	if rc.Fetch || rc.Repair {
+		return fmt.Errorf("--upstream cannot be combined with --fetch or --repair")
+	}
+
+	mf, err := rc.ManifestOptions.MakeManifestFile(&manifestContextOptions{
+		NoCacheList: rc.FetchOptions.NoCache,
+	}) // read-only!
+	if err != nil {
+		return fmt.Errorf("error getting manifest file: %w", err)
+	}
+	defer func() {
+		if err := mf.Close(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+
+	return app.RunUntilSignals(func(ctx context.Context) error {
+		return doUpstreamCheck(ctx, &upstreamCheckCtx{
+			Assets:     mf,
+			Method:     rc.UpstreamMethod,
+			Transport:  newUpstreamClient(rc.DisableHTTP2).Transport,
+			Jobs:       &rc.JobsOptions,
+			ReportPath: rc.Report,
+		})
 	})
 }
 
@@ -80,6 +162,9 @@ type validateCtx struct {
 	DestSocket string
 
 	HeadersToCache map[string]bool // if repair
+	Client         *http.Client    // if fetching
+
+	Jobs *JobsOptions
 
 	FailIfMissing  bool
 	FetchIfMissing bool
@@ -87,6 +172,13 @@ type validateCtx struct {
 	ValidateSHA256 bool
 }
 
+type countingWriter int64
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	*cw += countingWriter(len(b))
+	return len(b), nil
+}
+
 // copy reader to all writers, returning any errors
 // if no writers, then nothing is read and no error
 func copyToWriters(r io.Reader, writers []io.Writer) error {
@@ -105,83 +197,156 @@ func copyToWriters(r io.Reader, writers []io.Writer) error {
 	return err
 }
 
-func doValidate(vctx *validateCtx) error {
+func doValidate(ctx context.Context, vctx *validateCtx) error {
 	type toBeFetched struct {
 		K       *url.URL
 		V       lockfile.BlobInfo
 		NewHash []byte
 	}
 
+	// gather first, so that we don't hold the manifest lock while hashing
+	var entries []toBeFetched
+	var totalBytes int64
+	sizesKnown := true
+	if err := vctx.Assets.ForEach(func(k *url.URL, v lockfile.BlobInfo) error {
+		entries = append(entries, toBeFetched{K: k, V: v})
+		n, err := strconv.ParseInt(v.Headers["Content-Length"], 10, 64)
+		if err != nil {
+			sizesKnown = false
+		}
+		totalBytes += n
+		return nil
+	}); err != nil {
+		return fmt.Errorf("error iterating manifest: %w", err)
+	}
+	if !sizesKnown {
+		totalBytes = 0
+	}
+
+	var mu sync.Mutex
 	var missingList []toBeFetched
 	var wrongHashList []toBeFetched
-	if err := vctx.Assets.ForEach(func(k *url.URL, v lockfile.BlobInfo) (retErr error) {
-		logrus.Infof("Verifying %s...", k)
 
-		expectedH, err := hex.DecodeString(v.Sha256)
-		if err != nil {
-			return fmt.Errorf("error decoding sha key for %s: %w", k.String(), err)
-		}
+	progress := jobs.NewProgress("verify", int64(len(entries)), totalBytes)
+	stopProgress := progress.Display(os.Stderr)
+	mt := vctx.Jobs.MakeMultiTasker(ctx)
+	for _, e := range entries {
+		mt.Queue(func(ctx context.Context) (retErr error) {
+			logrus.Debugf("Verifying %s...", secrets.RedactURL(e.K))
 
-		r, err := vctx.Blobs.Get(expectedH)
-		if err != nil {
-			if errors.Is(err, blobs.ErrBlobNotExist) {
-				missingList = append(missingList, toBeFetched{
-					K: k,
-					V: v,
-				})
-				return nil // since we handle later, as we won't want to edit map while iterating it
+			expectedH, err := hex.DecodeString(e.V.Sha256)
+			if err != nil {
+				return jobs.Permanent(fmt.Errorf("error decoding sha key for %s: %w", secrets.RedactURL(e.K), err))
 			}
-			return fmt.Errorf("unknown error finding blob for %s: %w", k.String(), err)
-		}
 
-		defer func() {
-			if err := r.Close(); err != nil && retErr == nil {
-				retErr = fmt.Errorf("error in clean-up close in validate for %s: %w", k.String(), err)
+			r, err := vctx.Blobs.Get(expectedH)
+			if err != nil {
+				if errors.Is(err, blobs.ErrBlobNotExist) {
+					mu.Lock()
+					missingList = append(missingList, e)
+					mu.Unlock()
+					progress.ItemDone()
+					return nil // since we handle later
+				}
+				return fmt.Errorf("unknown error finding blob for %s: %w", secrets.RedactURL(e.K), err)
 			}
-		}()
 
-		var writers []io.Writer
-		if vctx.ValidateSHA256 {
-			h2 := sha256.New()
-			writers = append(writers, h2)
 			defer func() {
+				if err := r.Close(); err != nil && retErr == nil {
+					retErr = fmt.Errorf("error in clean-up close in validate for %s: %w", secrets.RedactURL(e.K), err)
+				}
+			}()
+
+			// count bytes separately for each attempt, so a retry doesn't inflate progress
+			var attemptBytes countingWriter
+			writers := []io.Writer{&attemptBytes}
+			h2 := sha256.New()
+			if vctx.ValidateSHA256 {
+				writers = append(writers, h2)
+			}
+			if err := copyToWriters(r, writers); err != nil {
+				return fmt.Errorf("error reading blob for %s: %w", secrets.RedactURL(e.K), err)
+			}
+			progress.AddBytes(int64(attemptBytes))
+			progress.ItemDone()
+
+			if vctx.ValidateSHA256 {
 				actualH := h2.Sum(nil)
 				if !bytes.Equal(expectedH, actualH) {
+					mu.Lock()
 					wrongHashList = append(wrongHashList, toBeFetched{
-						K:       k,
-						V:       v,
+						K:       e.K,
+						V:       e.V,
 						NewHash: actualH,
 					})
+					mu.Unlock()
 				}
-			}()
-		}
-
-		return copyToWriters(r, writers)
-	}); err != nil {
+			}
+			return nil
+		})
+	}
+	err := mt.Wait(func(err error) {
+		logrus.Errorf("error during parallel job: %v", err)
+	})
+	stopProgress()
+	if err != nil {
 		return fmt.Errorf("error in verification: %w", err)
 	}
 
+	// sort for stable output
+	for _, l := range [][]toBeFetched{missingList, wrongHashList} {
+		slices.SortFunc(l, func(a, b toBeFetched) int {
+			return strings.Compare(a.K.String(), b.K.String())
+		})
+	}
+
 	var rv error
-	var client *http.Client
-	for _, missing := range missingList {
-		switch {
-		case vctx.FailIfMissing:
-			rv = multierror.Append(rv, fmt.Errorf("missing asset: %s", missing.K.Redacted()))
-		case vctx.FetchIfMissing:
-			if client == nil {
-				client = &http.Client{
-					Transport: registryauthclient.NewClient(http.DefaultTransport),
+	switch {
+	case vctx.FailIfMissing:
+		for _, missing := range missingList {
+			rv = multierror.Append(rv, fmt.Errorf("missing asset: %s", secrets.RedactURL(missing.K)))
+		}
+	case vctx.FetchIfMissing && len(missingList) != 0:
+		fetchProgress := jobs.NewProgress("fetch", int64(len(missingList)), 0)
+		stopFetchProgress := fetchProgress.Display(os.Stderr)
+		fetchMt := vctx.Jobs.MakeMultiTasker(ctx)
+		for _, missing := range missingList {
+			fetchMt.Queue(func(ctx context.Context) error {
+				if err := checkFetchable(missing.K, missing.V); err != nil {
+					fetchProgress.ItemDone()
+					return jobs.Permanent(err)
 				}
-			}
-			if err := fetchAndSaveBlob(vctx.Assets, vctx.Blobs, http.MethodGet, nil, missing.K, client, vctx.HeadersToCache, nil, nil); err != nil {
-				return fmt.Errorf("error fetching %s: %w", missing.K.Redacted(), err)
-			}
+				// failed attempts may be retried, so only count this once it is done
+				status, err := fetchAndSaveBlob(ctx, vctx.Assets, vctx.Blobs, http.MethodGet, nil, missing.K, vctx.Client, vctx.HeadersToCache, nil, nil)
+				if err != nil {
+					return fmt.Errorf("error fetching %s: %w", secrets.RedactURL(missing.K), err)
+				}
+				if status != http.StatusOK {
+					err := fmt.Errorf("unexpected status fetching %s: %d", secrets.RedactURL(missing.K), status)
+					if status < http.StatusInternalServerError {
+						fetchProgress.ItemDone()
+						err = jobs.Permanent(err)
+					}
+					return err
+				}
+				fetchProgress.ItemDone()
+				return nil
+			})
+		}
+		err := fetchMt.Wait(func(err error) {
+			logrus.Errorf("error during parallel job: %v", err)
+		})
+		stopFetchProgress()
+		if err != nil {
+			return err
 		}
 	}
 
 	for _, wrongHash := range wrongHashList {
-		rv = multierror.Append(rv, fmt.Errorf("wrong hash for: %s expected: %s have %s", wrongHash.K.Redacted(), wrongHash.V.Sha256, hex.EncodeToString(wrongHash.NewHash)))
+		rv = multierror.Append(rv, fmt.Errorf("wrong hash for: %s expected: %s have %s", secrets.RedactURL(wrongHash.K), wrongHash.V.Sha256, hex.EncodeToString(wrongHash.NewHash)))
 	}
 
+	logrus.Infof("Verified %d entries (%s) in %s: %d missing, %d wrong hash", len(entries), jobs.HumanBytes(progress.Bytes()), progress.Elapsed().Round(time.Millisecond), len(missingList), len(wrongHashList))
+
 	return rv
 }
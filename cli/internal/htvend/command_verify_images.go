@@ -0,0 +1,220 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package htvend
+
+import (
+	"crypto"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/continusec/htvend/internal/blobstore"
+	"github.com/continusec/htvend/internal/cosign"
+	"github.com/continusec/htvend/internal/imagepull"
+	"github.com/continusec/htvend/internal/imageref"
+	"github.com/continusec/htvend/internal/lockfile"
+	"github.com/continusec/htvend/internal/secrets"
+	"github.com/hashicorp/go-multierror"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+)
+
+const maxImageManifestSize = 4 << 20
+
+// imageManifest has the fields we need from any of the manifest and index types
+type imageManifest struct {
+	Manifests    []imgspecv1.Descriptor `json:"manifests"`
+	Layers       []imgspecv1.Descriptor `json:"layers"`
+	Subject      *imgspecv1.Descriptor  `json:"subject"`
+	ArtifactType string                 `json:"artifactType"`
+}
+
+type imageVerifier struct {
+	Blobs   blobstore.Store
+	Entries map[string]lockfile.BlobInfo // by URL
+	Keys    []crypto.PublicKey
+}
+
+// verifyImages checks cosign signatures for each image in the manifest file,
+// using only the manifest file and blob store. Images are those manifests that
+// aren't a platform manifest of an index, or an artifact such as a signature.
+func verifyImages(assets *lockfile.File, blobs blobstore.Store, keys []crypto.PublicKey, requireSigned bool) error {
+	v := &imageVerifier{
+		Blobs:   blobs,
+		Entries: make(map[string]lockfile.BlobInfo),
+		Keys:    keys,
+	}
+	type image struct {
+		ref    imageref.Reference
+		digest digest.Digest
+	}
+	var candidates []image
+	notImages := make(map[digest.Digest]bool) // children and artifacts
+	if err := assets.ForEach(func(k *url.URL, bi lockfile.BlobInfo) error {
+		v.Entries[k.String()] = bi
+		if ref, ok := imageref.FromManifestURL(k); ok {
+			d := digest.NewDigestFromEncoded(digest.SHA256, bi.Sha256)
+			if imagepull.IsReferrerTag(ref.Tag) {
+				notImages[d] = true
+			} else {
+				candidates = append(candidates, image{ref: ref, digest: d})
+			}
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("error iterating manifest: %w", err)
+	}
+
+	// anything listed by an index, or the referrers API, isn't an image in its own right
+	for k, bi := range v.Entries {
+		u, err := url.Parse(k)
+		if err != nil {
+			return err
+		}
+		_, isManifest := imageref.FromManifestURL(u)
+		if !isManifest && !strings.Contains(u.Path, "/referrers/") {
+			continue
+		}
+		m, err := v.readManifest(bi.Sha256)
+		if err != nil {
+			return fmt.Errorf("error reading %s: %w", secrets.RedactURL(u), err)
+		}
+		if m.Subject != nil {
+			notImages[digest.NewDigestFromEncoded(digest.SHA256, bi.Sha256)] = true
+		}
+		for _, desc := range m.Manifests {
+			notImages[desc.Digest] = true
+		}
+	}
+
+	var images []image
+	seen := make(map[string]bool)
+	for _, img := range candidates {
+		id := img.ref.RepositoryURL() + "@" + img.digest.String()
+		if notImages[img.digest] || seen[id] {
+			continue
+		}
+		seen[id] = true
+		img.ref.Tag, img.ref.Digest = "", img.digest.String()
+		images = append(images, img)
+	}
+	slices.SortFunc(images, func(a, b image) int {
+		return strings.Compare(a.ref.String(), b.ref.String())
+	})
+
+	var rv error
+	for _, img := range images {
+		if err := v.verify(img.ref, img.digest); err != nil {
+			if requireSigned {
+				rv = multierror.Append(rv, fmt.Errorf("no valid signature for %s: %w", img.ref, err))
+			} else {
+				logrus.Warnf("No valid signature for %s: %v", img.ref, err)
+			}
+			continue
+		}
+		logrus.Infof("Verified signature for %s", img.ref)
+	}
+	logrus.Infof("Checked signatures for %d images", len(images))
+	return rv
+}
+
+// verify returns nil if any signature found for d, by tag or via the referrers API, is valid
+func (v *imageVerifier) verify(ref imageref.Reference, d digest.Digest) error {
+	sigManifests := []string{ref.ManifestURL(imagepull.ReferrerTag(d, ".sig"))}
+	for _, u := range []string{ref.ReferrersURL(d.String()), ref.ManifestURL(imagepull.ReferrerTag(d, ""))} {
+		bi, ok := v.Entries[u]
+		if !ok {
+			continue
+		}
+		index, err := v.readManifest(bi.Sha256)
+		if err != nil {
+			return fmt.Errorf("error reading referrers: %w", err)
+		}
+		for _, desc := range index.Manifests {
+			if desc.ArtifactType == cosign.SignatureArtifactType {
+				sigManifests = append(sigManifests, ref.ManifestURL(desc.Digest.String()))
+			}
+		}
+	}
+
+	var lastErr error
+	for _, u := range sigManifests {
+		bi, ok := v.Entries[u]
+		if !ok {
+			continue
+		}
+		m, err := v.readManifest(bi.Sha256)
+		if err != nil {
+			return fmt.Errorf("error reading signature manifest: %w", err)
+		}
+		for _, layer := range m.Layers {
+			sig, ok := layer.Annotations[cosign.SignatureAnnotation]
+			if !ok || layer.MediaType != cosign.SimpleSigningMediaType || layer.Digest.Algorithm() != digest.SHA256 {
+				continue
+			}
+			payload, err := v.readBlob(layer.Digest.Encoded())
+			if err != nil {
+				lastErr = fmt.Errorf("error reading signature payload: %w", err)
+				continue
+			}
+			if err := cosign.Verify(v.Keys, payload, sig, d); err != nil {
+				lastErr = err
+				continue
+			}
+			return nil
+		}
+	}
+	if lastErr == nil {
+		return fmt.Errorf("no signatures found")
+	}
+	return lastErr
+}
+
+func (v *imageVerifier) readManifest(sha256 string) (*imageManifest, error) {
+	bb, err := v.readBlob(sha256)
+	if err != nil {
+		return nil, err
+	}
+	var m imageManifest
+	if err := json.Unmarshal(bb, &m); err != nil {
+		return nil, fmt.Errorf("error parsing manifest: %w", err)
+	}
+	return &m, nil
+}
+
+func (v *imageVerifier) readBlob(sha256 string) ([]byte, error) {
+	k, err := hex.DecodeString(sha256)
+	if err != nil {
+		return nil, fmt.Errorf("bad digest: %w", err)
+	}
+	rc, err := v.Blobs.Get(k)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	bb, err := io.ReadAll(io.LimitReader(rc, maxImageManifestSize))
+	if err != nil {
+		return nil, err
+	}
+	if digest.FromBytes(bb).Encoded() != sha256 {
+		return nil, fmt.Errorf("blob %s is too large or corrupt", sha256)
+	}
+	return bb, nil
+}
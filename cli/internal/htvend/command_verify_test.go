@@ -0,0 +1,90 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package htvend
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/continusec/htvend/internal/lockfile"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyFetch(t *testing.T) {
+	cs, srv := newContentServer(t, map[string]string{
+		"/ok":    "ok",
+		"/flaky": "flaky",
+	})
+	var flakyRequests, goneRequests atomic.Int32
+	mux := http.NewServeMux()
+	mux.Handle("/", cs)
+	mux.HandleFunc("/flaky", func(w http.ResponseWriter, r *http.Request) {
+		if flakyRequests.Add(1) == 1 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		cs.ServeHTTP(w, r)
+	})
+	mux.HandleFunc("/gone", func(w http.ResponseWriter, r *http.Request) {
+		goneRequests.Add(1)
+		http.NotFound(w, r)
+	})
+	srv.Config.Handler = mux
+
+	mf, bs := newTestManifest(t)
+	for p, content := range map[string]string{"/ok": "ok", "/flaky": "flaky", "/gone": "gone"} {
+		require.NoError(t, mf.AddBlob(mustParse(t, srv.URL+p), lockfile.BlobInfo{Sha256: sha256Hex(content)}))
+	}
+
+	var used atomic.Bool
+	client := srv.Client()
+	transport := client.Transport
+	client.Transport = roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		used.Store(true)
+		return transport.RoundTrip(r)
+	})
+
+	err := doValidate(context.Background(), &validateCtx{
+		Assets:         mf,
+		Blobs:          bs,
+		FetchIfMissing: true,
+		ValidateSHA256: true,
+		Client:         client,
+		Jobs:           &JobsOptions{Jobs: 2, KeepGoing: true, Retries: 1},
+	})
+	assert.ErrorContains(t, err, "unexpected status fetching "+srv.URL+"/gone: 404")
+	assert.True(t, used.Load())
+
+	// server errors are retried, others are not
+	assert.Equal(t, int32(2), flakyRequests.Load())
+	assert.Equal(t, int32(1), goneRequests.Load())
+	for _, content := range []string{"ok", "flaky"} {
+		k, err := hex.DecodeString(sha256Hex(content))
+		require.NoError(t, err)
+		exists, err := bs.Exists(k)
+		require.NoError(t, err)
+		assert.True(t, exists, content)
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
@@ -0,0 +1,240 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package htvend
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/continusec/htvend/internal/lockfile"
+	"github.com/continusec/htvend/internal/registryauthclient"
+	"github.com/continusec/htvend/internal/secrets"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	upstreamUnchanged = "unchanged"
+	upstreamChanged   = "changed"
+	upstreamVanished  = "vanished"
+	upstreamMoved     = "moved"
+	upstreamUnknown   = "unknown" // HEAD gave us nothing to compare against
+	upstreamError     = "error"
+)
+
+// headers that, if cached, we can compare against a HEAD response
+var comparableHeaders = []string{"Docker-Content-Digest", "Content-Length", "Etag", "Last-Modified", "X-Checksum-Sha1"}
+
+type upstreamResult struct {
+	URL            string `json:"url"`
+	Status         string `json:"status"`
+	HTTPStatus     int    `json:"httpStatus,omitempty"`
+	ExpectedSha256 string `json:"expectedSha256"`
+	ActualSha256   string `json:"actualSha256,omitempty"`
+	Location       string `json:"location,omitempty"`
+	Error          string `json:"error,omitempty"`
+}
+
+type upstreamCheckCtx struct {
+	Assets     *lockfile.File
+	Method     string
+	Transport  http.RoundTripper // defaults to http.DefaultTransport
+	Jobs       *JobsOptions
+	ReportPath string
+}
+
+func doUpstreamCheck(ctx context.Context, uctx *upstreamCheckCtx) error {
+	type entry struct {
+		K *url.URL
+		V lockfile.BlobInfo
+	}
+	var entries []entry
+	if err := uctx.Assets.ForEach(func(k *url.URL, v lockfile.BlobInfo) error {
+		entries = append(entries, entry{K: k, V: v})
+		return nil
+	}); err != nil {
+		return fmt.Errorf("error iterating manifest: %w", err)
+	}
+
+	transport := uctx.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	client := &http.Client{
+		Transport: registryauthclient.NewClient(transport),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			// temporary redirects, e.g. to a CDN, are followed, but permanent ones are reported as moved
+			switch req.Response.StatusCode {
+			case http.StatusMovedPermanently, http.StatusPermanentRedirect:
+				return http.ErrUseLastResponse
+			}
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return nil
+		},
+	}
+
+	var mu sync.Mutex
+	var results []upstreamResult
+	mt := uctx.Jobs.MakeMultiTasker(ctx)
+	for _, e := range entries {
+		mt.Queue(func(ctx context.Context) error {
+			res := checkUpstream(ctx, client, uctx.Method, e.K, e.V)
+			logrus.Infof("Upstream %s: %s", res.Status, res.URL)
+			mu.Lock()
+			results = append(results, res)
+			mu.Unlock()
+			return nil
+		})
+	}
+	if err := mt.Wait(func(err error) {
+		logrus.Errorf("error during parallel job: %v", err)
+	}); err != nil {
+		return err
+	}
+
+	slices.SortFunc(results, func(a, b upstreamResult) int {
+		return strings.Compare(a.URL, b.URL)
+	})
+
+	if uctx.ReportPath != "" {
+		if err := writeUpstreamReport(uctx.ReportPath, results); err != nil {
+			return fmt.Errorf("error writing report: %w", err)
+		}
+	}
+
+	counts := make(map[string]int)
+	for _, r := range results {
+		counts[r.Status]++
+	}
+	logrus.Infof("Upstream summary: %d unchanged, %d changed, %d vanished, %d moved, %d unknown, %d errors",
+		counts[upstreamUnchanged], counts[upstreamChanged], counts[upstreamVanished], counts[upstreamMoved], counts[upstreamUnknown], counts[upstreamError])
+
+	if bad := counts[upstreamChanged] + counts[upstreamVanished] + counts[upstreamMoved] + counts[upstreamError]; bad != 0 {
+		return fmt.Errorf("upstream drift detected for %d of %d entries", bad, len(results))
+	}
+	return nil
+}
+
+func writeUpstreamReport(path string, results []upstreamResult) error {
+	bb, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling report: %w", err)
+	}
+	bb = append(bb, '\n')
+	if path == "-" {
+		_, err = os.Stdout.Write(bb)
+		return err
+	}
+	return os.WriteFile(path, bb, 0o666)
+}
+
+func checkUpstream(ctx context.Context, client *http.Client, method string, u *url.URL, v lockfile.BlobInfo) (res upstreamResult) {
+	res = upstreamResult{
+		URL:            secrets.RedactURL(u),
+		ExpectedSha256: v.Sha256,
+	}
+	if err := checkFetchable(u, v); err != nil {
+		res.Status = upstreamUnknown
+		res.Error = err.Error()
+		return res
+	}
+	if err := func() (retErr error) {
+		req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+		if err != nil {
+			return fmt.Errorf("error making request object: %w", err)
+		}
+		if method == http.MethodHead {
+			if etag := v.Headers["Etag"]; etag != "" {
+				req.Header.Set("If-None-Match", etag)
+			}
+			if lm := v.Headers["Last-Modified"]; lm != "" {
+				req.Header.Set("If-Modified-Since", lm)
+			}
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			// errors from the client include the URL, which may be a redirect, so redact it ourselves
+			var urlErr *url.Error
+			if errors.As(err, &urlErr) {
+				return fmt.Errorf("error performing request (%s): %w", secrets.RedactURLString(urlErr.URL), urlErr.Err)
+			}
+			return fmt.Errorf("error performing request: %w", err)
+		}
+		defer func() {
+			if err := resp.Body.Close(); err != nil && retErr == nil {
+				retErr = fmt.Errorf("error closing response: %w", err)
+			}
+		}()
+
+		res.HTTPStatus = resp.StatusCode
+		switch {
+		case resp.StatusCode == http.StatusNotModified:
+			res.Status = upstreamUnchanged
+		case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+			res.Status = upstreamVanished
+		case resp.StatusCode == http.StatusMovedPermanently || resp.StatusCode == http.StatusPermanentRedirect:
+			res.Status = upstreamMoved
+			res.Location = secrets.RedactURLString(resp.Header.Get("Location"))
+		case resp.StatusCode != http.StatusOK:
+			res.Status = upstreamError
+			res.Error = "unexpected status: " + resp.Status
+		case method == http.MethodHead:
+			res.Status = compareCachedHeaders(v.Headers, resp.Header)
+		default:
+			h := sha256.New()
+			if _, err := io.Copy(h, resp.Body); err != nil {
+				return fmt.Errorf("error reading response: %w", err)
+			}
+			res.ActualSha256 = hex.EncodeToString(h.Sum(nil))
+			if res.ActualSha256 == v.Sha256 {
+				res.Status = upstreamUnchanged
+			} else {
+				res.Status = upstreamChanged
+			}
+		}
+		return nil
+	}(); err != nil {
+		res.Status = upstreamError
+		res.Error = err.Error()
+	}
+	return res
+}
+
+func compareCachedHeaders(cached map[string]string, actual http.Header) string {
+	rv := upstreamUnknown
+	for _, h := range comparableHeaders {
+		c, a := cached[h], actual.Get(h)
+		if c == "" || a == "" {
+			continue
+		}
+		if c != a {
+			return upstreamChanged
+		}
+		rv = upstreamUnchanged
+	}
+	return rv
+}
@@ -0,0 +1,80 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package htvend
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/continusec/htvend/internal/lockfile"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyUpstream(t *testing.T) {
+	_, srv := newContentServer(t, map[string]string{
+		"/same":    "same",
+		"/changed": "new",
+	})
+	mux := http.NewServeMux()
+	mux.Handle("/", srv.Config.Handler)
+	mux.Handle("/cdn", http.RedirectHandler("/same", http.StatusFound))
+	mux.Handle("/moved", http.RedirectHandler("/same?token=secret", http.StatusMovedPermanently))
+	mux.Handle("/broken", http.RedirectHandler("http://127.0.0.1:1/x?token=secret", http.StatusFound))
+	srv.Config.Handler = mux
+
+	mf, _ := newTestManifest(t)
+	for p, content := range map[string]string{
+		"/same":    "same",
+		"/changed": "old",
+		"/gone":    "gone",
+		"/cdn":     "same",
+		"/moved":   "same",
+		"/broken":  "same",
+	} {
+		require.NoError(t, mf.AddBlob(mustParse(t, srv.URL+p), lockfile.BlobInfo{Sha256: sha256Hex(content)}))
+	}
+
+	report := filepath.Join(t.TempDir(), "report.json")
+	err := doUpstreamCheck(context.Background(), &upstreamCheckCtx{
+		Assets:     mf,
+		Method:     http.MethodGet,
+		Jobs:       &JobsOptions{Jobs: 2},
+		ReportPath: report,
+	})
+	assert.ErrorContains(t, err, "upstream drift detected for 4 of 6 entries")
+
+	bb, err := os.ReadFile(report)
+	require.NoError(t, err)
+	assert.NotContains(t, string(bb), "secret") // from the Location header, or the error following the redirect
+	var results []upstreamResult
+	require.NoError(t, json.Unmarshal(bb, &results))
+	statuses := make(map[string]string)
+	for _, r := range results {
+		statuses[r.URL[len(srv.URL):]] = r.Status
+	}
+	assert.Equal(t, map[string]string{
+		"/same":    upstreamUnchanged,
+		"/changed": upstreamChanged,
+		"/gone":    upstreamVanished,
+		"/cdn":     upstreamUnchanged, // temporary redirects are followed
+		"/moved":   upstreamMoved,
+		"/broken":  upstreamError,
+	}, statuses)
+}
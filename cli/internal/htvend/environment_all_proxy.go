@@ -0,0 +1,26 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package htvend
+
+func allProxyAppender(e *envCtx) error {
+	if e.SocksAddr == "" {
+		return nil
+	}
+	for _, ev := range e.Options.AllProxyEnvVars {
+		// socks5h so that clients leave name resolution to us
+		e.EnvOverrides = append(e.EnvOverrides, ev+"=socks5h://"+e.SocksAddr)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package htvend
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	"github.com/continusec/htvend/internal/buildah"
+)
+
+type BuildahOptions struct {
+	Buildah                   bool     `long:"buildah" description:"Instead of a sub-process, run buildah build with the arguments given, e.g. -f Dockerfile . RUN instructions are configured to use the proxy, and the result is written as a multi-platform OCI layout."`
+	BuildahBinary             string   `long:"buildah-binary" env:"BUILDAH_BINARY" default:"buildah" description:"Path to buildah, for --buildah"`
+	BuildahPlatforms          []string `long:"buildah-platform" description:"List of os/arch platforms to build, for --buildah. Defaults to the host architecture."`
+	BuildahOutput             string   `long:"buildah-output" default:"oci" description:"Directory to write the OCI layout to, for --buildah"`
+	SourceDateEpoch           string   `long:"source-date-epoch" env:"SOURCE_DATE_EPOCH" default:"0" description:"Timestamp for reproducible images, also set as SOURCE_DATE_EPOCH for RUN instructions, for --buildah. Set empty to not use."`
+	BuildahJksPaths           []string `long:"buildah-jks-path" description:"List of paths to mount the CA trust store in JKS format at for RUN instructions, e.g. /etc/ssl/certs/java/cacerts, for --buildah"`
+	BuildahMavenSettingsPaths []string `long:"buildah-maven-settings-path" description:"List of paths to mount a Maven settings.xml using the proxy at for RUN instructions, e.g. /root/.m2/settings.xml, for --buildah"`
+}
+
+func (o *BuildahOptions) buildahOptions(ectx *envCtx) buildah.Options {
+	return buildah.Options{
+		Binary:          o.BuildahBinary,
+		Platforms:       o.BuildahPlatforms,
+		OutputDir:       o.BuildahOutput,
+		SourceDateEpoch: o.SourceDateEpoch,
+		CertFile:        ectx.CAPemPath,
+		CertFileVars:    ectx.Options.CertFileEnvVars,
+		Env:             append(os.Environ(), ectx.EnvOverrides...),
+	}
+}
+
+// buildahAppender works out the arguments for buildah build, if --buildah is used
+func (o *BuildahOptions) buildahAppender(e *envCtx) error {
+	if !o.Buildah {
+		return nil
+	}
+
+	bo := o.buildahOptions(e)
+	bo.Mounts = append(bo.Mounts, buildah.Mount{
+		ID:      "JKS_CA_TRUSTSTORE",
+		Src:     e.JksPath,
+		Targets: o.BuildahJksPaths,
+	})
+	if len(o.BuildahMavenSettingsPaths) != 0 {
+		path, err := writeMavenSettings(e)
+		if err != nil {
+			return err
+		}
+		bo.Mounts = append(bo.Mounts, buildah.Mount{
+			ID:      "MVN_SETTINGS_XML",
+			Src:     path,
+			Targets: o.BuildahMavenSettingsPaths,
+		})
+	}
+	e.BuildahArgs = buildah.BuildArgs(bo)
+	return nil
+}
+
+// runBuildah runs buildah in place of the sub-process. The positional arguments are passed to buildah build.
+func (o *ListenerOptions) runBuildah(ctx context.Context, ectx *envCtx) error {
+	if o.IsolateNetwork {
+		return errors.New("--buildah can't be used with --isolate-network, as it needs to use the host's network")
+	}
+
+	args := ectx.BuildahArgs
+	if o.SubprocessOptions.Process != "" {
+		args = append(append(args, o.SubprocessOptions.Process), o.SubprocessOptions.Args...)
+	}
+	return buildah.Run(ctx, o.buildahOptions(ectx), args)
+}
@@ -0,0 +1,121 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package htvend
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+
+	"github.com/sirupsen/logrus"
+)
+
+// usual locations of the system CA bundle, as checked by Go's crypto/x509
+var systemCAFiles = []string{
+	"/etc/ssl/certs/ca-certificates.crt",                // Debian/Ubuntu/Gentoo etc.
+	"/etc/pki/tls/certs/ca-bundle.crt",                  // Fedora/RHEL 6
+	"/etc/ssl/ca-bundle.pem",                            // OpenSUSE
+	"/etc/pki/tls/cacert.pem",                           // OpenELEC
+	"/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem", // CentOS/RHEL 7
+	"/etc/ssl/cert.pem",                                 // Alpine Linux, macOS
+}
+
+// caBundleAppender works out which CAs the sub-process should trust. By
+// default that is only our own, as everything goes via the proxy.
+func caBundleAppender(e *envCtx) error {
+	bundle := bytes.NewBuffer(nil)
+
+	if e.Options.WithSystemCAs {
+		path, err := findSystemCAFile(e.Options.SystemCAFile)
+		if err != nil {
+			return err
+		}
+		if err := appendPEMFile(bundle, path); err != nil {
+			return fmt.Errorf("error reading system CAs: %w", err)
+		}
+	}
+
+	for _, path := range e.Options.ExtraCAPems {
+		if err := appendPEMFile(bundle, path); err != nil {
+			return fmt.Errorf("error reading extra CAs: %w", err)
+		}
+	}
+
+	if bundle.Len() == 0 {
+		e.CABundlePem = e.CAPem
+		return nil
+	}
+
+	appendPEM(bundle, e.CAPem)
+	e.CABundlePem = bundle.Bytes()
+	return nil
+}
+
+func findSystemCAFile(override string) (string, error) {
+	if override != "" {
+		return override, nil
+	}
+	if p := os.Getenv("SSL_CERT_FILE"); p != "" {
+		return p, nil
+	}
+	for _, p := range systemCAFiles {
+		if _, err := os.Stat(p); err == nil {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("unable to find the system CA bundle on %s, specify it with --system-ca-file", runtime.GOOS)
+}
+
+// appendPEMFile checks that path has at least one usable certificate in it, and appends those to
+// bundle. Some system bundles have certificates that Go can't parse (e.g. with a negative serial
+// number), which are skipped.
+func appendPEMFile(bundle *bytes.Buffer, path string) error {
+	bb, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	count := 0
+	for rest := bb; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+			logrus.Warnf("skipping certificate in %s that can't be parsed: %v", path, err)
+			continue
+		}
+		appendPEM(bundle, pem.EncodeToMemory(block))
+		count++
+	}
+	if count == 0 {
+		return errors.New("no usable certificates found in " + path)
+	}
+	return nil
+}
+
+func appendPEM(bundle *bytes.Buffer, bb []byte) {
+	bundle.Write(bb)
+	if len(bb) != 0 && bb[len(bb)-1] != '\n' {
+		bundle.WriteByte('\n')
+	}
+}
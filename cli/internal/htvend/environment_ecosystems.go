@@ -0,0 +1,227 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package htvend
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ecosystemAppenders write config for a package manager, for those that
+// don't pick up everything they need from the standard env vars
+var ecosystemAppenders = map[string]mutateEnvFunc{
+	"pip":    pipAppender,
+	"npm":    npmAppender,
+	"maven":  mavenAppender,
+	"gradle": gradleAppender,
+	"git":    gitAppender,
+	"cargo":  cargoAppender,
+	"go":     goAppender,
+}
+
+func ecosystemsAppender(e *envCtx) error {
+	for _, name := range e.Options.Ecosystems {
+		f, ok := ecosystemAppenders[name]
+		if !ok {
+			return fmt.Errorf("unknown ecosystem: %s", name)
+		}
+		if err := f(e); err != nil {
+			return fmt.Errorf("error configuring %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// writeEcosystemFile writes contents to name within a directory for the ecosystem, and returns its path
+func writeEcosystemFile(e *envCtx, ecosystem, name, contents string) (string, error) {
+	dir := filepath.Join(e.TempDir, ecosystem)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", fmt.Errorf("error creating config dir: %w", err)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(contents), 0o444); err != nil {
+		return "", fmt.Errorf("error writing config file: %w", err)
+	}
+	return path, nil
+}
+
+func pipAppender(e *envCtx) error {
+	path, err := writeEcosystemFile(e, "pip", "pip.conf", fmt.Sprintf(`[global]
+proxy = http://%s
+cert = %s
+`, e.ProxyAddr, e.CAPemPath))
+	if err != nil {
+		return err
+	}
+	e.EnvOverrides = append(e.EnvOverrides,
+		"PIP_CONFIG_FILE="+path,
+		"PIP_CERT="+e.CAPemPath, // as these take precedence over the file, if already set
+		"PIP_PROXY=http://"+e.ProxyAddr,
+		"REQUESTS_CA_BUNDLE="+e.CAPemPath, // used by the requests library, whether via pip or not
+	)
+	return nil
+}
+
+func npmAppender(e *envCtx) error {
+	path, err := writeEcosystemFile(e, "npm", ".npmrc", fmt.Sprintf(`proxy=http://%[1]s
+https-proxy=http://%[1]s
+noproxy=
+cafile=%[2]s
+strict-ssl=true
+`, e.ProxyAddr, e.CAPemPath))
+	if err != nil {
+		return err
+	}
+	e.EnvOverrides = append(e.EnvOverrides,
+		"NPM_CONFIG_USERCONFIG="+path,
+		"NODE_EXTRA_CA_CERTS="+e.CAPemPath,
+	)
+	return nil
+}
+
+// javaTrustStoreOpts are JVM options to trust our CA
+func javaTrustStoreOpts(e *envCtx) string {
+	return "-Djavax.net.ssl.trustStore=" + e.JksPath + " -Djavax.net.ssl.trustStoreType=PKCS12"
+}
+
+func mavenAppender(e *envCtx) error {
+	path, err := writeMavenSettings(e)
+	if err != nil {
+		return err
+	}
+	e.EnvOverrides = append(e.EnvOverrides,
+		appendToEnv("MAVEN_ARGS", "--settings "+path), // needs Maven 3.9 or later
+		appendToEnv("MAVEN_OPTS", javaTrustStoreOpts(e)),
+	)
+	return nil
+}
+
+// writeMavenSettings writes a settings.xml with the proxy, and returns its path
+func writeMavenSettings(e *envCtx) (string, error) {
+	host, port, err := net.SplitHostPort(e.ProxyAddr)
+	if err != nil {
+		return "", fmt.Errorf("error parsing proxy address: %w", err)
+	}
+	var proxies strings.Builder
+	for _, protocol := range []string{"http", "https"} {
+		fmt.Fprintf(&proxies, `    <proxy>
+      <id>htvend-%s</id>
+      <active>true</active>
+      <protocol>%s</protocol>
+      <host>%s</host>
+      <port>%s</port>
+      <nonProxyHosts />
+    </proxy>
+`, protocol, protocol, host, port)
+	}
+	return writeEcosystemFile(e, "maven", "settings.xml", `<settings>
+  <proxies>
+`+proxies.String()+`  </proxies>
+</settings>
+`)
+}
+
+// gradleAppender uses a new Gradle user home, so that its caches start empty
+// and all dependencies are fetched via the proxy
+func gradleAppender(e *envCtx) error {
+	host, port, err := net.SplitHostPort(e.ProxyAddr)
+	if err != nil {
+		return fmt.Errorf("error parsing proxy address: %w", err)
+	}
+	path, err := writeEcosystemFile(e, "gradle", "gradle.properties", fmt.Sprintf(`systemProp.http.proxyHost=%[1]s
+systemProp.http.proxyPort=%[2]s
+systemProp.http.nonProxyHosts=
+systemProp.https.proxyHost=%[1]s
+systemProp.https.proxyPort=%[2]s
+systemProp.https.nonProxyHosts=
+systemProp.javax.net.ssl.trustStore=%[3]s
+systemProp.javax.net.ssl.trustStoreType=PKCS12
+`, host, port, e.JksPath))
+	if err != nil {
+		return err
+	}
+	e.EnvOverrides = append(e.EnvOverrides, "GRADLE_USER_HOME="+filepath.Dir(path))
+	return nil
+}
+
+func gitAppender(e *envCtx) error {
+	e.EnvOverrides = append(e.EnvOverrides, "GIT_SSL_CAINFO="+e.CAPemPath)
+	return nil
+}
+
+func cargoAppender(e *envCtx) error {
+	e.EnvOverrides = append(e.EnvOverrides,
+		"CARGO_HTTP_CAINFO="+e.CAPemPath,
+		"CARGO_HTTP_PROXY=http://"+e.ProxyAddr,
+	)
+	return nil
+}
+
+// goAppender makes sure modules are fetched as plain HTTPS downloads from a
+// module proxy (rather than falling back to version control), and into an
+// empty module cache so that they are all fetched via us.
+func goAppender(e *envCtx) error {
+	goProxy := os.Getenv("GOPROXY")
+	if goProxy == "" {
+		goProxy = "https://proxy.golang.org"
+	}
+	proxies := withoutDirectGoProxy(goProxy)
+	if proxies == "" {
+		return fmt.Errorf("GOPROXY (%s) has no module proxies to fetch from", goProxy)
+	}
+
+	modCache := filepath.Join(e.TempDir, "go", "mod")
+	if err := os.MkdirAll(modCache, 0o755); err != nil {
+		return fmt.Errorf("error creating module cache: %w", err)
+	}
+	e.EnvOverrides = append(e.EnvOverrides,
+		"GOPROXY="+proxies,
+		"GOMODCACHE="+modCache,
+		appendToEnv("GOFLAGS", "-modcacherw"), // else the temp dir can't be removed afterwards
+	)
+	return nil
+}
+
+// withoutDirectGoProxy removes direct and off from a GOPROXY list, keeping the
+// separator after each proxy, as "|" falls back on any error, but "," only on a 404 or 410
+func withoutDirectGoProxy(goProxy string) string {
+	var rv strings.Builder
+	sep := ""
+	for goProxy != "" {
+		p, next := goProxy, ""
+		if i := strings.IndexAny(goProxy, ",|"); i >= 0 {
+			p, next = goProxy[:i], goProxy[i:i+1]
+			goProxy = goProxy[i+1:]
+		} else {
+			goProxy = ""
+		}
+		p = strings.TrimSpace(p)
+		if p == "" || p == "direct" || p == "off" {
+			continue
+		}
+		rv.WriteString(sep + p)
+		sep = next
+	}
+	return rv.String()
+}
+
+// appendToEnv returns NAME=VALUE for an env var holding space-separated
+// options, with value after any that the user has already set
+func appendToEnv(name, value string) string {
+	return name + "=" + strings.TrimSpace(os.Getenv(name)+" "+value)
+}
@@ -0,0 +1,94 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package htvend
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestEnvCtx(t *testing.T, ecosystems ...string) *envCtx {
+	return &envCtx{
+		TempDir:   t.TempDir(),
+		ProxyAddr: "127.0.0.1:8080",
+		CAPemPath: "/tmp/ca.pem",
+		JksPath:   "/tmp/ca.p12",
+		Options:   &ProxyOptions{Ecosystems: ecosystems},
+	}
+}
+
+// envMap returns the env overrides as a map, failing if any is set twice
+func envMap(t *testing.T, e *envCtx) map[string]string {
+	rv := make(map[string]string)
+	for _, ev := range e.EnvOverrides {
+		k, v, ok := strings.Cut(ev, "=")
+		require.True(t, ok, ev)
+		_, dupe := rv[k]
+		require.False(t, dupe, k)
+		rv[k] = v
+	}
+	return rv
+}
+
+func TestEcosystems(t *testing.T) {
+	t.Setenv("MAVEN_OPTS", "-Xmx1g")
+	t.Setenv("MAVEN_ARGS", "")
+	t.Setenv("GOPROXY", "https://goproxy.example.com|https://proxy.golang.org,direct")
+	t.Setenv("GOFLAGS", "-mod=mod")
+
+	e := newTestEnvCtx(t, "maven", "go", "pip")
+	require.NoError(t, ecosystemsAppender(e))
+	env := envMap(t, e)
+
+	settings := filepath.Join(e.TempDir, "maven", "settings.xml")
+	assert.Equal(t, "--settings "+settings, env["MAVEN_ARGS"])
+	assert.Equal(t, "-Xmx1g -Djavax.net.ssl.trustStore=/tmp/ca.p12 -Djavax.net.ssl.trustStoreType=PKCS12", env["MAVEN_OPTS"])
+	bb, err := os.ReadFile(settings)
+	require.NoError(t, err)
+	assert.Contains(t, string(bb), "<host>127.0.0.1</host>")
+
+	assert.Equal(t, "https://goproxy.example.com|https://proxy.golang.org", env["GOPROXY"])
+	assert.Equal(t, "-mod=mod -modcacherw", env["GOFLAGS"])
+	assert.Equal(t, filepath.Join(e.TempDir, "go", "mod"), env["GOMODCACHE"])
+
+	assert.Equal(t, "http://127.0.0.1:8080", env["PIP_PROXY"])
+	bb, err = os.ReadFile(env["PIP_CONFIG_FILE"])
+	require.NoError(t, err)
+	assert.Contains(t, string(bb), "cert = /tmp/ca.pem")
+
+	assert.ErrorContains(t, ecosystemsAppender(newTestEnvCtx(t, "bad")), "unknown ecosystem")
+}
+
+func TestWithoutDirectGoProxy(t *testing.T) {
+	for in, want := range map[string]string{
+		"https://proxy.golang.org":        "https://proxy.golang.org",
+		"https://a,https://b,direct":      "https://a,https://b",
+		"https://a|https://b|direct":      "https://a|https://b",
+		"https://a|direct,https://b":      "https://a|https://b",
+		"direct":                          "",
+		"off":                             "",
+		" https://a , direct | https://b": "https://a,https://b",
+	} {
+		assert.Equal(t, want, withoutDirectGoProxy(in), in)
+	}
+
+	t.Setenv("GOPROXY", "direct")
+	assert.ErrorContains(t, goAppender(newTestEnvCtx(t)), "no module proxies")
+}
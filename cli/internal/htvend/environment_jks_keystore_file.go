@@ -27,20 +27,18 @@ import (
 )
 
 func jksKeystoreAppender(e *envCtx) error {
-	if len(e.Options.JksKeyStoreVars) != 0 {
-		jks := bytes.NewBuffer(nil)
-		if err := pemToJks(bytes.NewReader(e.CAPem), jks); err != nil {
-			return fmt.Errorf("error converting PEM to JKS file: %w", err)
-		}
+	jks := bytes.NewBuffer(nil)
+	if err := pemToJks(bytes.NewReader(e.CABundlePem), jks); err != nil {
+		return fmt.Errorf("error converting PEM to JKS file: %w", err)
+	}
 
-		resultPath := filepath.Join(e.TempDir, "cacerts.jks")
-		if err := os.WriteFile(resultPath, jks.Bytes(), 0o444); err != nil {
-			return fmt.Errorf("error writing CA PEM file: %w", err)
-		}
+	e.JksPath = filepath.Join(e.TempDir, "cacerts.jks")
+	if err := os.WriteFile(e.JksPath, jks.Bytes(), 0o444); err != nil {
+		return fmt.Errorf("error writing CA PEM file: %w", err)
+	}
 
-		for _, ev := range e.Options.JksKeyStoreVars {
-			e.EnvOverrides = append(e.EnvOverrides, ev+"="+resultPath)
-		}
+	for _, ev := range e.Options.JksKeyStoreVars {
+		e.EnvOverrides = append(e.EnvOverrides, ev+"="+e.JksPath)
 	}
 	return nil
 }
@@ -0,0 +1,47 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package htvend
+
+import (
+	"path/filepath"
+)
+
+type RuntimeConfigOptions struct {
+	RuntimeConfigRegistries []string `long:"runtime-config-registry" default:"docker.io" default:"ghcr.io" default:"quay.io" default:"registry.k8s.io" default:"gcr.io" description:"List of registries to write container runtime config for"`
+}
+
+func (o *RuntimeConfigOptions) runtimeConfig(proxyAddr string, caPem []byte, caPath string) *runtimeConfig {
+	return &runtimeConfig{
+		ProxyAddr:  proxyAddr,
+		CAPem:      caPem,
+		CAPath:     caPath,
+		Registries: o.RuntimeConfigRegistries,
+	}
+}
+
+// runtimeConfigAppender writes config for each --runtime-config, and exports the paths written
+func runtimeConfigAppender(e *envCtx) error {
+	rc := e.Options.runtimeConfig(e.ProxyAddr, e.CABundlePem, e.CAPemPath)
+	for _, name := range e.Options.RuntimeConfigs {
+		files, err := writeRuntimeConfig(name, rc, filepath.Join(e.TempDir, name))
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			e.EnvOverrides = append(e.EnvOverrides, f.EnvVar+"="+f.Path)
+		}
+	}
+	return nil
+}
@@ -15,23 +15,23 @@
 package htvend
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"path/filepath"
 )
 
 func sslCertFileAppender(e *envCtx) error {
-	if len(e.Options.CertFileEnvVars) != 0 {
-		resultPath := e.Options.TlsCertPem
-		if resultPath == "" {
-			resultPath = filepath.Join(e.TempDir, "cacerts.pem")
-			if err := os.WriteFile(resultPath, e.CAPem, 0o444); err != nil {
-				return fmt.Errorf("error writing CA PEM file: %w", err)
-			}
-		}
-		for _, ev := range e.Options.CertFileEnvVars {
-			e.EnvOverrides = append(e.EnvOverrides, ev+"="+resultPath)
+	// only use the original if that is all we need, else we write out the bundle
+	e.CAPemPath = e.Options.TlsCertPem
+	if e.CAPemPath == "" || !bytes.Equal(e.CABundlePem, e.CAPem) {
+		e.CAPemPath = filepath.Join(e.TempDir, "cacerts.pem")
+		if err := os.WriteFile(e.CAPemPath, e.CABundlePem, 0o444); err != nil {
+			return fmt.Errorf("error writing CA PEM file: %w", err)
 		}
 	}
+	for _, ev := range e.Options.CertFileEnvVars {
+		e.EnvOverrides = append(e.EnvOverrides, ev+"="+e.CAPemPath)
+	}
 	return nil
 }
@@ -0,0 +1,35 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package htvend
+
+import (
+	"context"
+
+	"github.com/continusec/htvend/internal/jobs"
+)
+
+type JobsOptions struct {
+	Jobs      int  `long:"jobs" default:"8" description:"Maximum number of concurrent jobs (hashing, fetching, copying)"`
+	KeepGoing bool `long:"keep-going" description:"If set, carry on with remaining jobs after a failure, rather than cancelling them"`
+	Retries   int  `long:"retries" default:"3" description:"Number of times to retry a failed job, with exponential backoff"`
+}
+
+func (o *JobsOptions) MakeMultiTasker(ctx context.Context) *jobs.MultiTasker {
+	return jobs.NewMultiTasker(ctx, jobs.Options{
+		Jobs:      o.Jobs,
+		KeepGoing: o.KeepGoing,
+		Retries:   o.Retries,
+	})
+}
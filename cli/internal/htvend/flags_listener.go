@@ -20,14 +20,17 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"path/filepath"
 
 	"github.com/continusec/htvend/internal/app"
 	"github.com/continusec/htvend/internal/blobstore"
 	"github.com/continusec/htvend/internal/lockfile"
 	"github.com/continusec/htvend/internal/proxyserver"
 	"github.com/continusec/htvend/internal/re"
+	"github.com/continusec/htvend/internal/secrets"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/sirupsen/logrus"
@@ -42,10 +45,19 @@ var (
 
 type ListenerOptions struct {
 	app.SubprocessOptions `positional-args:"yes"`
+	ProxyOptions
+	BuildahOptions
+	RegistryOptions
 
+	Daemon         bool `short:"d" long:"daemon" description:"Run as a daemon until terminated"`
+	IsolateNetwork bool `long:"isolate-network" description:"Run the sub-process in a new network namespace which can only reach the proxy. Linux only."`
+	Transparent    bool `long:"transparent" description:"With --isolate-network, also intercept connections to ports 80 and 443 from tools that ignore the proxy env vars, and answer all DNS lookups locally."`
+}
+
+// ProxyOptions are those needed to run the proxy server and tell clients how to use it
+type ProxyOptions struct {
 	ListenAddr    string `short:"l" long:"listen-addr" default:"127.0.0.1:0" description:"Listen address for proxy server (:0) will allocate a dynamic open port"`
 	TlsListenAddr string `long:"tls-listen-addr" default:"127.0.0.1:0" description:"Listen address for a TLS proxy server (:0) will allocate a dynamic open port"`
-	Daemon        bool   `short:"d" long:"daemon" description:"Run as a daemon until terminated"`
 
 	TlsCertPem           string `long:"tls-cert-pem" description:"If set use this as the TLS cert. Must be a CA pem"`
 	TlsKeyPem            string `long:"tls-key-pem" description:"If set use this as the TLS key. Must match the cert"`
@@ -56,6 +68,20 @@ type ListenerOptions struct {
 	JksKeyStoreVars  []string `long:"set-env-var-jks-keystore" default:"JKS_KEYSTORE_FILE" description:"List of environment variables that will be set pointing to the temporary CA certificates file in JKS format."`
 	HttpProxyEnvVars []string `long:"set-env-var-http-proxy" default:"HTTP_PROXY" default:"HTTPS_PROXY" default:"http_proxy" default:"https_proxy" description:"List of environment variables that will be set pointing to the proxy host:port."`
 	NoProxyEnvVars   []string `long:"set-env-var-no-proxy" default:"NO_PROXY" default:"no_proxy" description:"List of environment variables that will be set blank."`
+
+	DisableHTTP2 bool `long:"disable-http2" description:"Only use HTTP/1.1, both with clients and upstream servers"`
+
+	WithSystemCAs bool     `long:"with-system-cas" description:"Include the system's trusted CAs in the CA files given to the sub-process, for anything it connects to without going via the proxy"`
+	SystemCAFile  string   `long:"system-ca-file" description:"PEM file of the system's trusted CAs, for --with-system-cas. Defaults to $SSL_CERT_FILE, else the usual location for the OS."`
+	ExtraCAPems   []string `long:"extra-ca-pem" description:"List of PEM files of additional CAs to include in the CA files given to the sub-process"`
+
+	SocksListenAddr string   `long:"socks-listen-addr" description:"If set, also listen for SOCKS5 connections on this address, e.g. 127.0.0.1:0. Only HTTP and HTTPS are supported over it."`
+	AllProxyEnvVars []string `long:"set-env-var-all-proxy" default:"ALL_PROXY" default:"all_proxy" description:"List of environment variables that will be set pointing to the SOCKS5 proxy, if enabled."`
+
+	Ecosystems []string `long:"ecosystem" choice:"pip" choice:"npm" choice:"maven" choice:"gradle" choice:"git" choice:"cargo" choice:"go" description:"List of package managers to write config for and point the sub-process at, so that they use the proxy and trust its CA."`
+
+	RuntimeConfigs []string `long:"runtime-config" choice:"k3s" choice:"containerd" choice:"docker" description:"List of container runtimes to write registry config for, pointing at the proxy and trusting its CA. The paths are set in HTVEND_* env vars, which are printed in daemon mode."`
+	RuntimeConfigOptions
 }
 
 type mutateEnvFunc func(ectx *envCtx) error
@@ -64,10 +90,14 @@ type envCtx struct {
 	// input
 	TempDir   string
 	ProxyAddr string
+	SocksAddr string // empty if not enabled
 	CAPem     []byte
-	Options   *ListenerOptions
+	Options   *ProxyOptions
 
 	// output
+	CABundlePem  []byte // CAs the sub-process should trust, including ours
+	CAPemPath    string // file containing CABundlePem
+	JksPath      string // file containing CABundlePem, as a passwordless PKCS#12 trust store
 	BuildahArgs  []string
 	EnvOverrides []string
 }
@@ -83,7 +113,15 @@ type listenerCtx struct {
 	DummyOK *re.MultiRegexMatcher
 
 	// "build" options
-	HeadersToCache map[string]bool
+	HeadersToCache  map[string]bool
+	Client          *http.Client // defaults to http.DefaultClient
+	StreamingPolicy string       // passthrough or reject, for websockets and server-sent events
+
+	// optional, if set we record missing assets here
+	Misses *missLog
+
+	// dedupes concurrent fetches of the same asset
+	inflight inflightFetches
 }
 
 type KeyValue struct {
@@ -91,39 +129,106 @@ type KeyValue struct {
 	Value lockfile.BlobInfo
 }
 
+func (o *ProxyOptions) proxyServerConfig(handler http.HandlerFunc) proxyserver.ProxyServerConfig {
+	return proxyserver.ProxyServerConfig{
+		HttpListenAddr:       o.ListenAddr,
+		HttpsListenAddr:      o.TlsListenAddr,
+		TlsCertPath:          o.TlsCertPem,
+		TlsKeyPath:           o.TlsKeyPem,
+		TlsGenerateIfMissing: o.TlsGenerateIfMissing,
+		SocksListenAddr:      o.SocksListenAddr,
+		DisableHTTP2:         o.DisableHTTP2,
+		Handler:              handler,
+	}
+}
+
+func (o *ProxyOptions) upstreamClient() *http.Client {
+	return newUpstreamClient(o.DisableHTTP2)
+}
+
+// makeEnv writes any files needed by clients of the proxy to tempDir, and returns the env vars to point at them
+func (o *ProxyOptions) makeEnv(tempDir string, info proxyserver.ServerInfo, extra ...mutateEnvFunc) (*envCtx, error) {
+	ectx := &envCtx{
+		TempDir:   tempDir,
+		ProxyAddr: info.ProxyAddr,
+		SocksAddr: info.SocksAddr,
+		CAPem:     info.CAPem,
+		Options:   o,
+	}
+	for _, f := range append([]mutateEnvFunc{
+		caBundleAppender,
+		stdProxyVarsAppender,
+		allProxyAppender,
+		sslCertFileAppender,
+		tmpDirsAppender,
+		jksKeystoreAppender,
+		ecosystemsAppender,
+		runtimeConfigAppender,
+	}, extra...) {
+		if err := f(ectx); err != nil {
+			return nil, fmt.Errorf("error modifying env: %w", err)
+		}
+	}
+	return ectx, nil
+}
+
+// withManifest is an ociregistry.WithManifest serving from our manifest
+func (lctx *listenerCtx) withManifest(cb func(assets *lockfile.File, blobs blobstore.Store) error) error {
+	return cb(lctx.Assets, lctx.Blobs)
+}
+
+func serveWithListenerCtx(lctx *listenerCtx) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := handleMainServerRequest(lctx, w, r); err != nil {
+			logrus.Warnf("error handling request: %v", err)
+			http.Error(w, "see proxy server log for details", http.StatusInternalServerError)
+		}
+	}
+}
+
 func (o *ListenerOptions) RunListenerWithSubprocess(lctx *listenerCtx, prompt string, args []string) error {
-	return app.RunUntilSignals(func(parCtx context.Context) error {
-		return proxyserver.ServeUntilDone(parCtx, proxyserver.ProxyServerConfig{
-			HttpListenAddr:       o.ListenAddr,
-			HttpsListenAddr:      o.TlsListenAddr,
-			TlsCertPath:          o.TlsCertPem,
-			TlsKeyPath:           o.TlsKeyPem,
-			TlsGenerateIfMissing: o.TlsGenerateIfMissing,
-			Handler: func(w http.ResponseWriter, r *http.Request) {
-				if err := handleMainServerRequest(lctx, w, r); err != nil {
-					logrus.Warnf("error handling request: %v", err)
-					http.Error(w, "see proxy server log for details", http.StatusInternalServerError)
+	if o.Transparent && !o.IsolateNetwork {
+		return errors.New("--transparent requires --isolate-network")
+	}
+
+	return app.WithTempDir(func(tempDir string) (retErr error) {
+		cfg := o.proxyServerConfig(serveWithListenerCtx(lctx))
+
+		// connections to ports 80 and 443 inside the namespace are forwarded to this
+		var transparentSock string
+		if o.Transparent {
+			transparentSock = filepath.Join(tempDir, "transparent.sock")
+			l, err := net.Listen("unix", transparentSock)
+			if err != nil {
+				return fmt.Errorf("error listening on transparent socket: %w", err)
+			}
+			cfg.TransparentListeners = append(cfg.TransparentListeners, l)
+		}
+
+		return app.RunUntilSignals(func(parCtx context.Context) error {
+			return proxyserver.ServeUntilDone(parCtx, cfg, func(ctx context.Context, info proxyserver.ServerInfo) (retErr error) {
+				ectx, err := o.makeEnv(tempDir, info, o.buildahAppender)
+				if err != nil {
+					return err
 				}
-			}}, func(ctx context.Context, proxyAddr string, caPem []byte) error {
-			return app.WithTempDir(func(tempDir string) (retErr error) {
-				ectx := envCtx{
-					TempDir:   tempDir,
-					ProxyAddr: proxyAddr,
-					CAPem:     caPem,
-					Options:   o,
+
+				stopRegistry, err := o.startRegistry(lctx.withManifest)
+				if err != nil {
+					return err
 				}
-				for _, f := range []mutateEnvFunc{
-					stdProxyVarsAppender,
-					sslCertFileAppender,
-					tmpDirsAppender,
-					jksKeystoreAppender,
-				} {
-					if err := f(&ectx); err != nil {
-						return fmt.Errorf("error modifying env: %w", err)
+				defer func() {
+					if err := stopRegistry(); err != nil && retErr == nil {
+						retErr = err
 					}
-				}
+				}()
 
 				if !o.Daemon {
+					if o.Buildah {
+						return o.runBuildah(ctx, ectx)
+					}
+					if o.IsolateNetwork {
+						return runIsolatedSubprocess(ctx, prompt, o.SubprocessOptions, ectx, transparentSock)
+					}
 					return app.RunSubprocess(ctx, prompt, o.SubprocessOptions, ectx.EnvOverrides)
 				}
 
@@ -131,6 +236,12 @@ func (o *ListenerOptions) RunListenerWithSubprocess(lctx *listenerCtx, prompt st
 				if o.SubprocessOptions.Process != "" {
 					return fmt.Errorf("if running as a daemon, no sub-process should be specified. Received: %s", o.SubprocessOptions.Process)
 				}
+				if o.IsolateNetwork {
+					return errors.New("--isolate-network applies to a sub-process, so can't be used with --daemon")
+				}
+				if o.Buildah {
+					return errors.New("--buildah runs instead of a sub-process, so can't be used with --daemon")
+				}
 
 				logrus.Infof("Daemon running...")
 				for _, ev := range ectx.EnvOverrides {
@@ -147,12 +258,21 @@ func (o *ListenerOptions) RunListenerWithSubprocess(lctx *listenerCtx, prompt st
 func handleMainServerRequest(lctx *listenerCtx, w http.ResponseWriter, r *http.Request) error {
 	u := extractReqFromURL(r)
 
-	if lctx.DummyOK.Match(u.Redacted()) {
+	if lctx.DummyOK.Match(secrets.RedactURL(u)) {
 		// we return a dummy 200 OK response
 		w.WriteHeader(http.StatusOK)
 		return nil
 	}
 
+	if isStreamingRequest(r) {
+		return handleStreamingRequest(lctx, w, r, u)
+	}
+
+	// concurrent requests for the same asset are looked up, and if needed fetched, once
+	if lctx.FetchIfMissing && r.Method == http.MethodGet && !lctx.Assets.SkipSave(u) {
+		return lctx.inflight.fetch(lctx, w, r, u)
+	}
+
 	bi, found, err := lctx.Assets.GetBlob(u)
 	if err != nil {
 		return fmt.Errorf("error looking up asset: %w", err)
@@ -163,20 +283,14 @@ func handleMainServerRequest(lctx *listenerCtx, w http.ResponseWriter, r *http.R
 	}
 
 	missingAssetCount.Inc()
+	lctx.Misses.Record(secrets.RedactURL(u))
 
 	if lctx.FetchIfMissing {
-		return fetchAndSaveBlob(lctx.Assets, lctx.Blobs, r.Method, r.Body, u, http.DefaultClient, lctx.HeadersToCache, func(newReq *http.Request) error {
-			for k, v := range r.Header {
-				for _, v1 := range v {
-					newReq.Header.Add(k, v1)
-				}
-			}
-			return nil
-		}, w)
+		return fetchUpstream(lctx, w, r, u)
 	}
 
 	if lctx.FailIfMissing {
-		logrus.Warnf("missing asset for URL: %s", u.Redacted())
+		logrus.Warnf("missing asset for URL: %s", secrets.RedactURL(u))
 		http.Error(w, "missing asset", http.StatusNotFound)
 		return nil // as this is unremarkable for the proxy server
 	}
@@ -184,10 +298,24 @@ func handleMainServerRequest(lctx *listenerCtx, w http.ResponseWriter, r *http.R
 	return errors.New("missing logic path - should not have gotten here")
 }
 
+// fetchUpstream fetches u for r, saving it if appropriate, and writes the response to w
+func fetchUpstream(lctx *listenerCtx, w http.ResponseWriter, r *http.Request, u *url.URL) error {
+	client := lctx.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	_, err := fetchAndSaveBlob(r.Context(), lctx.Assets, lctx.Blobs, r.Method, r.Body, u, client, lctx.HeadersToCache, func(newReq *http.Request) error {
+		copyEndToEndHeaders(newReq.Header, r.Header)
+		return nil
+	}, w)
+	return err
+}
+
 // r and w are optional - if they are specified, then we are in a reverse proxy request
 // ELSE we happily ignore them being nil and assume GET with no body or headers
-// as this is called by validate
+// as this is called by validate. Returns the upstream status code.
 func fetchAndSaveBlob(
+	ctx context.Context,
 	assets *lockfile.File,
 	blobs blobstore.Store,
 	method string,
@@ -197,21 +325,26 @@ func fetchAndSaveBlob(
 	hdrsToCache map[string]bool,
 	preprocessRequest func(*http.Request) error,
 	w http.ResponseWriter,
-) (retErr error) {
-	newReq, err := http.NewRequest(method, u.String(), body)
+) (_ int, retErr error) {
+	newReq, err := http.NewRequestWithContext(ctx, method, u.String(), body)
 	if err != nil {
-		return fmt.Errorf("error making request object: %w", err)
+		return 0, fmt.Errorf("error making request object: %w", err)
 	}
-	logrus.Infof("Fetching URL: %s %s", method, newReq.URL)
+	logrus.Infof("Fetching URL: %s %s", method, secrets.RedactURL(newReq.URL))
 	if preprocessRequest != nil {
 		err = preprocessRequest(newReq)
 		if err != nil {
-			return fmt.Errorf("error preprocessing request (%s): %w", u, err)
+			return 0, fmt.Errorf("error preprocessing request (%s): %w", secrets.RedactURL(u), err)
 		}
 	}
 	resp, err := client.Do(newReq)
 	if err != nil {
-		return fmt.Errorf("error performing request (%s): %w", u, err)
+		// errors from the client include the URL, which we can't redact
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return 0, fmt.Errorf("error performing request (%s): %w", secrets.RedactURL(u), err)
 	}
 	defer func() {
 		if err := resp.Body.Close(); err != nil && retErr == nil {
@@ -222,32 +355,37 @@ func fetchAndSaveBlob(
 	logrus.Debugf("Response (%d):", resp.StatusCode)
 	for k, v := range resp.Header {
 		for _, v1 := range v {
-			logrus.Debugf("%s: %s", k, v1)
+			logrus.Debugf("%s: %s", k, secrets.RedactHeaderValue(k, v1))
 		}
 	}
 
 	if w != nil {
-		for k, v := range resp.Header {
-			for _, v1 := range v {
-				w.Header().Add(k, v1)
-			}
-		}
+		copyEndToEndHeaders(w.Header(), resp.Header)
 		w.WriteHeader(resp.StatusCode)
+
+		// an event stream may never end, so we can't tee it to a blob
+		if isStreamingResponse(resp) {
+			streamingRequestCount.WithLabelValues("passthrough").Inc()
+			logrus.Warnf("Passing through event stream without recording, so this build is not reproducible offline: %s", secrets.RedactURL(u))
+			return resp.StatusCode, copyFlushing(w, resp.Body)
+		}
 	}
 
 	// if we don't need to save, then exit early - don't save non-OK responses - for now don't filter HEAD - useful for Docker API call during k3s init
 	if assets.SkipSave(u) || resp.StatusCode != http.StatusOK {
 		if w != nil {
-			_, err = io.Copy(w, resp.Body)
-			return err
+			if _, err = io.Copy(w, resp.Body); err != nil {
+				return resp.StatusCode, err
+			}
+			copyTrailers(w, resp.Trailer)
 		}
-		return nil
+		return resp.StatusCode, nil
 	}
 
 	// we save to this file
 	caf, err := blobs.Put()
 	if err != nil {
-		return fmt.Errorf("error creating caf to put: %w", err)
+		return 0, fmt.Errorf("error creating caf to put: %w", err)
 	}
 	defer func() {
 		// Cleanup() is safe to call (no-op) after a successful Commit()
@@ -258,17 +396,18 @@ func fetchAndSaveBlob(
 
 	if w != nil {
 		if _, err = io.Copy(w, io.TeeReader(resp.Body, caf)); err != nil {
-			return fmt.Errorf("error copying response via tee: %w", err)
+			return 0, fmt.Errorf("error copying response via tee: %w", err)
 		}
+		copyTrailers(w, resp.Trailer)
 	} else {
 		if _, err = io.Copy(caf, resp.Body); err != nil {
-			return fmt.Errorf("error copying response direct to CAF: %w", err)
+			return 0, fmt.Errorf("error copying response direct to CAF: %w", err)
 		}
 	}
 
 	digest, err := caf.Commit()
 	if err != nil {
-		return fmt.Errorf("error committing blob (url %s): %w", u.Redacted(), err)
+		return 0, fmt.Errorf("error committing blob (url %s): %w", secrets.RedactURL(u), err)
 	}
 
 	// record asset belonging to this build
@@ -277,15 +416,15 @@ func fetchAndSaveBlob(
 		Headers: filterHeaders(hdrsToCache, resp.Header),
 	})
 	if err != nil {
-		return fmt.Errorf("error updating asset file: %w", err)
+		return 0, fmt.Errorf("error updating asset file: %w", err)
 	}
-	return nil
+	return resp.StatusCode, nil
 }
 
 func filterHeaders(desired map[string]bool, actual http.Header) map[string]string {
 	rv := make(map[string]string)
 	for k, vs := range actual {
-		if desired[k] {
+		if desired[k] && !secrets.IsSensitiveHeader(k) {
 			rv[k] = vs[0]
 		}
 	}
@@ -309,6 +448,9 @@ func serveFoundBlob(lctx *listenerCtx, bi lockfile.BlobInfo, w http.ResponseWrit
 
 	hdrs := w.Header()
 	for k, v := range bi.Headers {
+		if hopByHopHeaders[k] {
+			continue // in case they were added to --cache-header, as they'd break HTTP/2
+		}
 		hdrs.Set(k, v)
 	}
 
@@ -16,6 +16,7 @@ package htvend
 
 import (
 	"fmt"
+	"net/url"
 	"strings"
 
 	"github.com/adrg/xdg"
@@ -25,6 +26,8 @@ import (
 	"github.com/continusec/htvend/internal/blobstore/s3store"
 	"github.com/continusec/htvend/internal/lockfile"
 	"github.com/continusec/htvend/internal/re"
+	"github.com/continusec/htvend/internal/secrets"
+	"github.com/continusec/htvend/internal/urlnorm"
 )
 
 type CacheOptions struct {
@@ -39,7 +42,12 @@ type CacheOptions struct {
 
 type ManifestOptions struct {
 	CacheOptions
-	ManifestFile string `short:"m" long:"manifest" default:"./assets.json" description:"File to put manifest data in"`
+	ManifestFile   string `short:"m" long:"manifest" default:"./assets.json" description:"File to put manifest data in"`
+	ManifestLayout string `long:"manifest-layout" default:"indent" choice:"indent" choice:"line" description:"How to lay out entries when writing the manifest. line puts each entry on a single line, which keeps diffs small."`
+
+	URLPresets     []string `long:"url-preset" choice:"s3" choice:"gcs" choice:"azure" choice:"github" choice:"cloudfront" description:"List of built-in rules to remove expiring signatures from URLs before they are used as manifest keys. Entries keyed this way can only be refreshed by rebuilding."`
+	URLStripParams []string `long:"url-strip-param" description:"List of query parameters to remove from all URLs before they are used as manifest keys"`
+	URLRewrites    []string `long:"url-rewrite" description:"List of REGEX=>REPLACEMENT rewrites of URLs before they are used as manifest keys, e.g. to replace a build number in a path"`
 }
 
 type manifestContextOptions struct {
@@ -55,15 +63,30 @@ func (o *ManifestOptions) MakeManifestFile(opts *manifestContextOptions) (*lockf
 		return nil, fmt.Errorf("error creating no-cache regex matcher: %w", err)
 	}
 
+	normalizer, err := urlnorm.New(o.URLPresets, o.URLStripParams, o.URLRewrites)
+	if err != nil {
+		return nil, err
+	}
+
 	return lockfile.NewMapFile(lockfile.MapFileOptions{
 		Path:           o.ManifestFile,
 		Writable:       opts.Writable,
 		AllowOverwrite: opts.AllowOverwrite,
+		Layout:         o.ManifestLayout,
+		URLNormalizer:  normalizer,
 
 		NoCache: noCache,
 	})
 }
 
+// checkFetchable returns an error if the manifest key k can't be used to fetch the asset again
+func checkFetchable(k *url.URL, v lockfile.BlobInfo) error {
+	if v.Unfetchable {
+		return fmt.Errorf("can't re-fetch %s, as the manifest key isn't the URL it was fetched from (e.g. a signature was removed), rebuild to fetch it again", secrets.RedactURL(k))
+	}
+	return nil
+}
+
 func xdgIt(origPath string) (string, error) {
 	d := origPath
 	if remPath, ok := strings.CutPrefix(d, "${XDG_DATA_HOME}/"); ok {
@@ -0,0 +1,63 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package htvend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/continusec/htvend/internal/ociregistry"
+	"github.com/sirupsen/logrus"
+)
+
+type RegistryOptions struct {
+	RegistryListenAddr      string `long:"registry-listen-addr" description:"If set, also serve images in the manifest as a read-only OCI registry on this address, e.g. 127.0.0.1:5000, so that clients can pull them without using the proxy"`
+	RegistryDefaultUpstream string `long:"registry-default-upstream" default:"docker.io" description:"Upstream registry for image names that don't start with one, for --registry-listen-addr"`
+}
+
+// startRegistry serves the registry if --registry-listen-addr is set. It returns
+// once listening, and the caller must call stop to shut it down.
+func (o *RegistryOptions) startRegistry(with ociregistry.WithManifest) (stop func() error, err error) {
+	if o.RegistryListenAddr == "" {
+		return func() error { return nil }, nil
+	}
+
+	l, err := net.Listen("tcp", o.RegistryListenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("error listening for registry: %w", err)
+	}
+	server := &http.Server{
+		Handler: ociregistry.NewHandler(ociregistry.Options{
+			DefaultRegistry: o.RegistryDefaultUpstream,
+			WithManifest:    with,
+		}),
+	}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.Serve(l)
+	}()
+	logrus.Infof("OCI registry listening on http://%s", l.Addr())
+
+	return func() error {
+		server.Shutdown(context.Background())
+		if err := <-errs; err != nil && !errors.Is(err, http.ErrServerClosed) {
+			return fmt.Errorf("error from registry server: %w", err)
+		}
+		return nil
+	}, nil
+}
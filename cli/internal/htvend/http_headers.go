@@ -0,0 +1,84 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package htvend
+
+import (
+	"net/http"
+	"strings"
+)
+
+// hopByHopHeaders apply to a single connection, so are not forwarded by proxies
+// (RFC 9110 section 7.6.1). HTTP/2 forbids them entirely.
+var hopByHopHeaders = map[string]bool{
+	"Connection":          true,
+	"Proxy-Connection":    true,
+	"Keep-Alive":          true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true, // was meant for us (and may be used to select a project), not upstream
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+}
+
+// copyEndToEndHeaders adds all headers from src to dst, except hop-by-hop headers and any
+// named by the Connection header. "Te: trailers" is kept, as gRPC needs it to get through.
+func copyEndToEndHeaders(dst, src http.Header) {
+	connHeaders := make(map[string]bool)
+	for _, v := range src.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			connHeaders[http.CanonicalHeaderKey(strings.TrimSpace(name))] = true
+		}
+	}
+	for k, vs := range src {
+		if connHeaders[k] {
+			continue
+		}
+		if hopByHopHeaders[k] {
+			if k == "Te" && strings.EqualFold(strings.TrimSpace(src.Get(k)), "trailers") {
+				dst.Set(k, "trailers")
+			}
+			continue
+		}
+		for _, v := range vs {
+			dst.Add(k, v)
+		}
+	}
+}
+
+// copyTrailers sends trailers, which must be called after the body has been written
+func copyTrailers(w http.ResponseWriter, trailer http.Header) {
+	for k, vs := range trailer {
+		for _, v := range vs {
+			w.Header().Add(http.TrailerPrefix+k, v)
+		}
+	}
+}
+
+// newUpstreamClient returns a client for fetching from upstream servers, which uses HTTP/2 where available
+func newUpstreamClient(disableHTTP2 bool) *http.Client {
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(!disableHTTP2)
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Protocols = &protocols
+	if t.TLSClientConfig != nil {
+		// this may have had h2 added by earlier use, which would override Protocols
+		t.TLSClientConfig = t.TLSClientConfig.Clone()
+		t.TLSClientConfig.NextProtos = nil
+	}
+	return &http.Client{Transport: t}
+}
@@ -0,0 +1,403 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package htvend
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+
+	"github.com/continusec/htvend/internal/lockfile"
+	"github.com/continusec/htvend/internal/secrets"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	dedupedFetchCount = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "htvend_deduped_fetch_total",
+		Help: "The total number of requests served by waiting for an in-flight request for the same asset",
+	})
+)
+
+// inflightFetches ensures that concurrent requests for the same manifest key
+// result in a single lookup and, if missing, a single upstream fetch. The first
+// request (the leader) fetches and saves the blob as usual. Others (followers)
+// that arrive before the leader has written any of the body have the response
+// spooled to a temp file for them, and stream it from there as it arrives. Any
+// that arrive later wait for the leader to finish, then serve the saved blob, so
+// nothing is spooled unless it is needed. Requests are only shared if they also send the same
+// Accept and Authorization headers, since either may change the response. Event
+// streams are never shared: if the leader's response turns out to be one, it is
+// passed straight through and each follower makes its own request. The zero
+// value is ready to use.
+type inflightFetches struct {
+	mu      sync.Mutex
+	fetches map[string]*inflightFetch
+}
+
+type inflightFetch struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	// created by the leader before writing the body, if a follower asked for it first
+	spool       *os.File
+	spoolWanted bool
+	spoolErr    error
+	bodyStarted bool
+
+	// cancels the upstream fetch, called once nobody is waiting for it
+	cancel   context.CancelFunc
+	watchers int
+
+	// number of requests still reading from spool, it is closed when this hits zero
+	readers int
+
+	// set once the leader has a response
+	headerReady bool
+	status      int
+	header      http.Header
+	streaming   bool // the response is an event stream, so is not spooled
+
+	size int64 // bytes written to spool so far
+	done bool
+	err  error
+
+	// set if the leader found the asset in the manifest
+	found *lockfile.BlobInfo
+}
+
+// fetch returns once the response has been written to w. r must be a GET request.
+func (ifs *inflightFetches) fetch(lctx *listenerCtx, w http.ResponseWriter, r *http.Request, u *url.URL) error {
+	k := inflightKey(lctx, r, u)
+
+	ifs.mu.Lock()
+	if ifs.fetches == nil {
+		ifs.fetches = make(map[string]*inflightFetch)
+	}
+	f, following := ifs.fetches[k]
+	tailing := false
+	if following {
+		f.mu.Lock()
+		f.watchers++
+		f.readers++
+		tailing = !f.bodyStarted
+		if tailing {
+			f.spoolWanted = true
+		}
+		f.mu.Unlock()
+	} else {
+		f = &inflightFetch{
+			watchers: 1,
+			readers:  1,
+		}
+		f.cond = sync.NewCond(&f.mu)
+		ifs.fetches[k] = f
+	}
+	ifs.mu.Unlock()
+
+	defer f.release()
+	context.AfterFunc(r.Context(), f.unwatch)
+
+	if following {
+		dedupedFetchCount.Inc()
+		logrus.Infof("Waiting for in-flight request for the same asset: %s", secrets.RedactURL(u))
+		var err error
+		if tailing {
+			err = f.follow(lctx, w, r.Context())
+		} else {
+			err = f.awaitSaved(lctx, w, r, u)
+		}
+		if errors.Is(err, errInflightStreaming) {
+			logrus.Infof("In-flight request is an event stream, making our own request: %s", secrets.RedactURL(u))
+			return fetchUpstream(lctx, w, r, u)
+		}
+		return err
+	}
+
+	err := f.lead(lctx, w, r, u)
+
+	// remove before marking done, so that anyone who misses out will find it in the manifest
+	ifs.mu.Lock()
+	delete(ifs.fetches, k)
+	ifs.mu.Unlock()
+
+	f.mu.Lock()
+	f.done = true
+	f.err = err
+	if f.err == nil && !f.headerReady && f.found == nil {
+		f.err = errors.New("in-flight fetch finished without a response")
+	}
+	f.cond.Broadcast()
+	f.mu.Unlock()
+
+	return err
+}
+
+// errInflightStreaming is returned by follow if the leader's response is an event stream
+var errInflightStreaming = errors.New("in-flight fetch is an event stream")
+
+// inflightKey identifies requests that can share a response. The Authorization
+// header is hashed so that we don't keep credentials around.
+func inflightKey(lctx *listenerCtx, r *http.Request, u *url.URL) string {
+	auth := sha256.Sum256([]byte(r.Header.Get("Authorization")))
+	return lctx.Assets.KeyFor(u) + "\x00" + r.Header.Get("Accept") + "\x00" + hex.EncodeToString(auth[:])
+}
+
+func (f *inflightFetch) lead(lctx *listenerCtx, w http.ResponseWriter, r *http.Request, u *url.URL) error {
+	bi, found, err := lctx.Assets.GetBlob(u)
+	if err != nil {
+		return fmt.Errorf("error looking up asset: %w", err)
+	}
+	if found {
+		f.mu.Lock()
+		f.found = &bi
+		f.mu.Unlock()
+		return serveFoundBlob(lctx, bi, w)
+	}
+
+	missingAssetCount.Inc()
+	lctx.Misses.Record(secrets.RedactURL(u))
+
+	// the fetch carries on for as long as anyone is waiting for it, even if our client goes away
+	ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+	defer cancel()
+	f.mu.Lock()
+	f.cancel = cancel
+	stop := f.watchers == 0
+	f.mu.Unlock()
+	if stop {
+		cancel()
+	}
+
+	client := lctx.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	_, err = fetchAndSaveBlob(ctx, lctx.Assets, lctx.Blobs, r.Method, r.Body, u, client, lctx.HeadersToCache, func(newReq *http.Request) error {
+		copyEndToEndHeaders(newReq.Header, r.Header)
+		return nil
+	}, &spoolingWriter{f: f, w: w})
+	return err
+}
+
+// awaitSaved is used by followers that arrived after the leader started writing the body, so
+// can't read it from the start. Once the leader is done, the blob it saved is served, or if
+// it wasn't saved (e.g. not a 200 response) we make our own request.
+func (f *inflightFetch) awaitSaved(lctx *listenerCtx, w http.ResponseWriter, r *http.Request, u *url.URL) error {
+	ctx := r.Context()
+	f.mu.Lock()
+	for !f.done && !f.streaming && ctx.Err() == nil {
+		f.cond.Wait()
+	}
+	streaming := f.streaming
+	f.mu.Unlock()
+
+	switch {
+	case streaming:
+		return errInflightStreaming
+	case ctx.Err() != nil:
+		return nil // client has gone away
+	}
+
+	bi, found, err := lctx.Assets.GetBlob(u)
+	if err != nil {
+		return fmt.Errorf("error looking up asset: %w", err)
+	}
+	if found {
+		return serveFoundBlob(lctx, bi, w)
+	}
+	logrus.Infof("In-flight request wasn't saved, making our own request: %s", secrets.RedactURL(u))
+	return fetchUpstream(lctx, w, r, u)
+}
+
+func (f *inflightFetch) follow(lctx *listenerCtx, w http.ResponseWriter, ctx context.Context) error {
+	f.mu.Lock()
+	for !f.headerReady && !f.done && ctx.Err() == nil {
+		f.cond.Wait()
+	}
+	found, ready, streaming, status, header, err := f.found, f.headerReady, f.streaming, f.status, f.header, f.err
+	f.mu.Unlock()
+
+	switch {
+	case found != nil:
+		return serveFoundBlob(lctx, *found, w)
+	case streaming:
+		return errInflightStreaming
+	case !ready && err != nil:
+		return fmt.Errorf("error from in-flight fetch: %w", err)
+	case !ready:
+		return ctx.Err()
+	}
+
+	for k, v := range header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(status)
+
+	rc := http.NewResponseController(w)
+	var sent int64
+	for {
+		f.mu.Lock()
+		for f.size == sent && !f.done && f.spoolErr == nil && ctx.Err() == nil {
+			f.cond.Wait()
+		}
+		size, done, err, spoolErr := f.size, f.done, f.err, f.spoolErr
+		f.mu.Unlock()
+
+		if ctx.Err() != nil {
+			return nil // client has gone away
+		}
+		if spoolErr != nil {
+			logrus.Warnf("in-flight fetch couldn't spool the response for us: %v", spoolErr)
+			return http.ErrAbortHandler
+		}
+		if size > sent {
+			n, err := io.Copy(w, io.NewSectionReader(f.spool, sent, size-sent))
+			sent += n
+			if err != nil {
+				return nil // client has gone away
+			}
+			rc.Flush()
+			continue
+		}
+		if done {
+			if err != nil {
+				// too late to send an error status, so just cut the response short
+				logrus.Warnf("in-flight fetch failed after sending a partial response: %v", err)
+				return http.ErrAbortHandler
+			}
+			return nil
+		}
+	}
+}
+
+// unwatch is called when a client goes away. If nobody is left, the upstream fetch is cancelled.
+func (f *inflightFetch) unwatch() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.watchers--
+	if f.watchers == 0 && !f.done && f.cancel != nil {
+		f.cancel()
+	}
+	f.cond.Broadcast() // so that any follower for this client stops waiting
+}
+
+// release is called when a request is finished with the spool file
+func (f *inflightFetch) release() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.readers--
+	if f.readers != 0 || f.spool == nil {
+		return
+	}
+	if err := f.spool.Close(); err != nil {
+		logrus.Warnf("error closing spool file: %v", err)
+	}
+}
+
+// spoolingWriter is used by the leader, and writes the response to its own
+// client, as well as to the spool file if any follower needs it. Errors writing to our
+// client are ignored, so that the fetch can carry on for the others. Event
+// streams are unbounded, so are written to our client only.
+type spoolingWriter struct {
+	f         *inflightFetch
+	w         http.ResponseWriter
+	clientErr error
+	streaming bool
+}
+
+func (sw *spoolingWriter) Header() http.Header {
+	return sw.w.Header()
+}
+
+func (sw *spoolingWriter) WriteHeader(status int) {
+	sw.streaming = isStreamingResponse(&http.Response{Header: sw.w.Header()})
+
+	sw.f.mu.Lock()
+	sw.f.status = status
+	sw.f.header = sw.w.Header().Clone()
+	sw.f.streaming = sw.streaming
+	sw.f.headerReady = true
+	sw.f.cond.Broadcast()
+	sw.f.mu.Unlock()
+
+	sw.w.WriteHeader(status)
+}
+
+func (sw *spoolingWriter) Write(b []byte) (int, error) {
+	if sw.streaming {
+		return sw.w.Write(b)
+	}
+
+	sw.f.mu.Lock()
+	if !sw.f.bodyStarted {
+		sw.f.bodyStarted = true
+		if sw.f.spoolWanted {
+			sw.f.spool, sw.f.spoolErr = createSpool()
+			sw.f.cond.Broadcast()
+		}
+	}
+	spool := sw.f.spool
+	sw.f.mu.Unlock()
+
+	if spool != nil {
+		n, err := spool.Write(b)
+
+		sw.f.mu.Lock()
+		sw.f.size += int64(n)
+		sw.f.cond.Broadcast()
+		sw.f.mu.Unlock()
+
+		if err != nil {
+			return n, fmt.Errorf("error writing to spool file: %w", err)
+		}
+	}
+
+	if sw.clientErr == nil {
+		if _, sw.clientErr = sw.w.Write(b); sw.clientErr != nil {
+			logrus.Infof("client went away during in-flight fetch, continuing for others: %v", sw.clientErr)
+		}
+	}
+	return len(b), nil
+}
+
+// createSpool creates a temp file which is removed straight away, as we only access it via
+// the returned handle, so that it doesn't outlive us if we don't exit cleanly
+func createSpool() (*os.File, error) {
+	spool, err := os.CreateTemp("", "htvend-spool-*")
+	if err != nil {
+		return nil, fmt.Errorf("error creating spool file: %w", err)
+	}
+	if err := os.Remove(spool.Name()); err != nil {
+		logrus.Warnf("error removing spool file: %v", err)
+	}
+	return spool, nil
+}
+
+// Unwrap allows http.ResponseController to flush our client
+func (sw *spoolingWriter) Unwrap() http.ResponseWriter {
+	return sw.w
+}
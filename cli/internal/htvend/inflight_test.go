@@ -0,0 +1,107 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package htvend
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// waitForInflight waits until there is an in-flight fetch for which cond is true, and returns it
+func waitForInflight(t *testing.T, lctx *listenerCtx, cond func(f *inflightFetch) bool) *inflightFetch {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		lctx.inflight.mu.Lock()
+		for _, f := range lctx.inflight.fetches {
+			f.mu.Lock()
+			ok := cond(f)
+			f.mu.Unlock()
+			if ok {
+				lctx.inflight.mu.Unlock()
+				return f
+			}
+		}
+		lctx.inflight.mu.Unlock()
+	}
+	t.Fatal("timed out waiting for in-flight fetch")
+	return nil
+}
+
+func TestInflightFetch(t *testing.T) {
+	for _, early := range []bool{false, true} {
+		t.Run(fmt.Sprintf("early follower %v", early), func(t *testing.T) {
+			headers, rest := make(chan struct{}), make(chan struct{})
+			var requests atomic.Int32
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				<-headers
+				_, _ = w.Write([]byte("first,"))
+				w.(http.Flusher).Flush()
+				<-rest
+				_, _ = w.Write([]byte("last"))
+			}))
+			defer upstream.Close()
+
+			mf, bs := newTestManifest(t)
+			lctx := &listenerCtx{Assets: mf, Blobs: bs, FetchIfMissing: true, Client: upstream.Client()}
+			var recs []*httptest.ResponseRecorder
+			var dones []chan struct{}
+			get := func() {
+				rec, done := httptest.NewRecorder(), make(chan struct{})
+				go func() {
+					defer close(done)
+					serveWithListenerCtx(lctx)(rec, httptest.NewRequest(http.MethodGet, upstream.URL+"/blob", nil))
+				}()
+				recs, dones = append(recs, rec), append(dones, done)
+			}
+			watchers := func(n int) func(f *inflightFetch) bool {
+				return func(f *inflightFetch) bool { return f.watchers == n }
+			}
+
+			get() // leader
+			f := waitForInflight(t, lctx, watchers(1))
+			if early {
+				get() // streams the response from the spool, as it arrives
+				waitForInflight(t, lctx, watchers(2))
+			}
+			close(headers)
+			waitForInflight(t, lctx, func(f *inflightFetch) bool { return f.bodyStarted })
+			get() // too late to stream the response, so waits for it to be saved
+			waitForInflight(t, lctx, watchers(len(recs)))
+			close(rest)
+
+			for _, done := range dones {
+				waitFor(t, done)
+			}
+			for _, rec := range recs {
+				assert.Equal(t, http.StatusOK, rec.Code)
+				assert.Equal(t, "first,last", rec.Body.String())
+			}
+			assert.Equal(t, int32(1), requests.Load())
+
+			// only spooled if a follower could use it
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			require.NoError(t, f.spoolErr)
+			assert.Equal(t, early, f.spool != nil)
+		})
+	}
+}
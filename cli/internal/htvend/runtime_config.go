@@ -0,0 +1,190 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package htvend
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// runtimeConfig is what a container runtime needs to pull images via the proxy
+type runtimeConfig struct {
+	ProxyAddr  string   // host:port of the proxy
+	CAPem      []byte   // CAs the runtime should trust, including ours
+	CAPath     string   // file containing CAPem, as read by the runtime
+	Registries []string // registry hosts to configure, e.g. docker.io
+}
+
+// runtimeConfigFile is a file (or directory) written for a runtime, and the env var its path is exported as
+type runtimeConfigFile struct {
+	EnvVar string
+	Path   string
+}
+
+// runtimeConfigWriters write config for a container runtime to a directory
+var runtimeConfigWriters = map[string]func(rc *runtimeConfig, dir string) ([]runtimeConfigFile, error){
+	"k3s":        writeK3sConfig,
+	"containerd": writeContainerdConfig,
+	"docker":     writeDockerConfig,
+}
+
+// writeRuntimeConfig writes config for the named runtime to dir, creating it if needed
+func writeRuntimeConfig(name string, rc *runtimeConfig, dir string) ([]runtimeConfigFile, error) {
+	f, ok := runtimeConfigWriters[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown container runtime: %s", name)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("error creating config dir: %w", err)
+	}
+	rv, err := f(rc, dir)
+	if err != nil {
+		return nil, fmt.Errorf("error writing %s config: %w", name, err)
+	}
+	return rv, nil
+}
+
+// registryEndpoint returns the URL that a runtime connects to for a registry
+func registryEndpoint(registry string) string {
+	if registry == "docker.io" {
+		return "https://registry-1.docker.io"
+	}
+	return "https://" + registry
+}
+
+// serviceEnv is an env file (for systemd's EnvironmentFile) setting the proxy for a service
+func serviceEnv(rc *runtimeConfig, prefix string, withCertFile bool) string {
+	var sb strings.Builder
+	for _, ev := range []string{"HTTP_PROXY", "HTTPS_PROXY", "http_proxy", "https_proxy"} {
+		fmt.Fprintf(&sb, "%s%s=http://%s\n", prefix, ev, rc.ProxyAddr)
+	}
+	for _, ev := range []string{"NO_PROXY", "no_proxy"} {
+		fmt.Fprintf(&sb, "%s%s=\n", prefix, ev)
+	}
+	if withCertFile {
+		fmt.Fprintf(&sb, "%sSSL_CERT_FILE=%s\n", prefix, rc.CAPath)
+	}
+	return sb.String()
+}
+
+func writeConfigFile(dir, name, contents string) (string, error) {
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		return "", fmt.Errorf("error writing config file: %w", err)
+	}
+	return path, nil
+}
+
+// writeK3sConfig writes a registries.yaml trusting our CA for each registry, and an env
+// file for the k3s service, which passes the proxy settings on to its embedded containerd
+func writeK3sConfig(rc *runtimeConfig, dir string) ([]runtimeConfigFile, error) {
+	var sb strings.Builder
+	sb.WriteString("configs:\n")
+	for _, registry := range rc.Registries {
+		hosts := []string{registry}
+		if endpointHost := strings.TrimPrefix(registryEndpoint(registry), "https://"); endpointHost != registry {
+			hosts = append(hosts, endpointHost)
+		}
+		for _, host := range hosts {
+			fmt.Fprintf(&sb, "  %s:\n    tls:\n      ca_file: %s\n", strconv.Quote(host), strconv.Quote(rc.CAPath))
+		}
+	}
+	registriesPath, err := writeConfigFile(dir, "registries.yaml", sb.String())
+	if err != nil {
+		return nil, err
+	}
+	envPath, err := writeConfigFile(dir, "k3s.service.env", serviceEnv(rc, "CONTAINERD_", true))
+	if err != nil {
+		return nil, err
+	}
+	return []runtimeConfigFile{
+		{EnvVar: "HTVEND_K3S_REGISTRIES_YAML", Path: registriesPath},
+		{EnvVar: "HTVEND_K3S_ENV_FILE", Path: envPath},
+	}, nil
+}
+
+// writeContainerdConfig writes a certs.d directory, for containerd's config_path, with
+// a hosts.toml per registry trusting our CA, and an env file for the containerd service
+func writeContainerdConfig(rc *runtimeConfig, dir string) ([]runtimeConfigFile, error) {
+	certsDir := filepath.Join(dir, "certs.d")
+	for _, registry := range rc.Registries {
+		hostDir := filepath.Join(certsDir, registry)
+		if err := os.MkdirAll(hostDir, 0o755); err != nil {
+			return nil, fmt.Errorf("error creating hosts dir: %w", err)
+		}
+		endpoint := registryEndpoint(registry)
+		if _, err := writeConfigFile(hostDir, "hosts.toml", fmt.Sprintf(`server = %[1]s
+
+[host.%[1]s]
+  capabilities = ["pull", "resolve"]
+  ca = %[2]s
+`, strconv.Quote(endpoint), strconv.Quote(rc.CAPath))); err != nil {
+			return nil, err
+		}
+	}
+	envPath, err := writeConfigFile(dir, "containerd.env", serviceEnv(rc, "", false))
+	if err != nil {
+		return nil, err
+	}
+	return []runtimeConfigFile{
+		{EnvVar: "HTVEND_CONTAINERD_CONFIG_PATH", Path: certsDir},
+		{EnvVar: "HTVEND_CONTAINERD_ENV_FILE", Path: envPath},
+	}, nil
+}
+
+// writeDockerConfig writes a daemon.json setting the proxy, and a certs.d directory
+// with our CA for each registry. Docker doesn't read certs.d for Docker Hub, so an
+// env file setting SSL_CERT_FILE for the docker service is also written.
+func writeDockerConfig(rc *runtimeConfig, dir string) ([]runtimeConfigFile, error) {
+	bb, err := json.MarshalIndent(map[string]any{
+		"proxies": map[string]string{
+			"http-proxy":  "http://" + rc.ProxyAddr,
+			"https-proxy": "http://" + rc.ProxyAddr,
+			"no-proxy":    "",
+		},
+	}, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling daemon.json: %w", err)
+	}
+	daemonPath, err := writeConfigFile(dir, "daemon.json", string(bb)+"\n")
+	if err != nil {
+		return nil, err
+	}
+
+	certsDir := filepath.Join(dir, "certs.d")
+	for _, registry := range rc.Registries {
+		hostDir := filepath.Join(certsDir, strings.TrimPrefix(registryEndpoint(registry), "https://"))
+		if err := os.MkdirAll(hostDir, 0o755); err != nil {
+			return nil, fmt.Errorf("error creating certs dir: %w", err)
+		}
+		if _, err := writeConfigFile(hostDir, "ca.crt", string(rc.CAPem)); err != nil {
+			return nil, err
+		}
+	}
+
+	envPath, err := writeConfigFile(dir, "docker.env", fmt.Sprintf("SSL_CERT_FILE=%s\n", rc.CAPath))
+	if err != nil {
+		return nil, err
+	}
+	return []runtimeConfigFile{
+		{EnvVar: "HTVEND_DOCKER_DAEMON_JSON", Path: daemonPath},
+		{EnvVar: "HTVEND_DOCKER_CERTS_D", Path: certsDir},
+		{EnvVar: "HTVEND_DOCKER_ENV_FILE", Path: envPath},
+	}, nil
+}
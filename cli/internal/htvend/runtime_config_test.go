@@ -0,0 +1,145 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package htvend
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRuntimeConfig() *runtimeConfig {
+	return &runtimeConfig{
+		ProxyAddr:  "127.0.0.1:8080",
+		CAPem:      []byte("ca pem\n"),
+		CAPath:     "/tmp/ca.pem",
+		Registries: []string{"docker.io", "ghcr.io"},
+	}
+}
+
+// readConfigFiles returns the contents of each file written, keyed by env var and path relative to it
+func readConfigFiles(t *testing.T, files []runtimeConfigFile) map[string]string {
+	rv := make(map[string]string)
+	for _, f := range files {
+		require.NoError(t, filepath.WalkDir(f.Path, func(path string, d os.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			rel, err := filepath.Rel(f.Path, path)
+			if err != nil {
+				return err
+			}
+			bb, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			rv[filepath.Join(f.EnvVar, rel)] = string(bb)
+			return nil
+		}))
+	}
+	return rv
+}
+
+func TestRuntimeConfig(t *testing.T) {
+	proxyEnv := func(prefix string) string {
+		return prefix + "HTTP_PROXY=http://127.0.0.1:8080\n" +
+			prefix + "HTTPS_PROXY=http://127.0.0.1:8080\n" +
+			prefix + "http_proxy=http://127.0.0.1:8080\n" +
+			prefix + "https_proxy=http://127.0.0.1:8080\n" +
+			prefix + "NO_PROXY=\n" +
+			prefix + "no_proxy=\n"
+	}
+	hostsToml := func(endpoint string) string {
+		return `server = "` + endpoint + `"
+
+[host."` + endpoint + `"]
+  capabilities = ["pull", "resolve"]
+  ca = "/tmp/ca.pem"
+`
+	}
+
+	for name, want := range map[string]map[string]string{
+		"k3s": {
+			"HTVEND_K3S_REGISTRIES_YAML": `configs:
+  "docker.io":
+    tls:
+      ca_file: "/tmp/ca.pem"
+  "registry-1.docker.io":
+    tls:
+      ca_file: "/tmp/ca.pem"
+  "ghcr.io":
+    tls:
+      ca_file: "/tmp/ca.pem"
+`,
+			"HTVEND_K3S_ENV_FILE": proxyEnv("CONTAINERD_") + "CONTAINERD_SSL_CERT_FILE=/tmp/ca.pem\n",
+		},
+		"containerd": {
+			"HTVEND_CONTAINERD_CONFIG_PATH/docker.io/hosts.toml": hostsToml("https://registry-1.docker.io"),
+			"HTVEND_CONTAINERD_CONFIG_PATH/ghcr.io/hosts.toml":   hostsToml("https://ghcr.io"),
+			"HTVEND_CONTAINERD_ENV_FILE":                         proxyEnv(""),
+		},
+		"docker": {
+			"HTVEND_DOCKER_CERTS_D/registry-1.docker.io/ca.crt": "ca pem\n",
+			"HTVEND_DOCKER_CERTS_D/ghcr.io/ca.crt":              "ca pem\n",
+			"HTVEND_DOCKER_ENV_FILE":                            "SSL_CERT_FILE=/tmp/ca.pem\n",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			files, err := writeRuntimeConfig(name, newTestRuntimeConfig(), filepath.Join(t.TempDir(), "new-dir"))
+			require.NoError(t, err)
+			got := readConfigFiles(t, files)
+
+			if name == "docker" {
+				var daemon map[string]map[string]string
+				require.NoError(t, json.Unmarshal([]byte(got["HTVEND_DOCKER_DAEMON_JSON"]), &daemon))
+				assert.Equal(t, map[string]string{
+					"http-proxy":  "http://127.0.0.1:8080",
+					"https-proxy": "http://127.0.0.1:8080",
+					"no-proxy":    "",
+				}, daemon["proxies"])
+				delete(got, "HTVEND_DOCKER_DAEMON_JSON")
+			}
+			assert.Equal(t, want, got)
+		})
+	}
+
+	_, err := writeRuntimeConfig("podman", newTestRuntimeConfig(), t.TempDir())
+	assert.ErrorContains(t, err, "unknown container runtime: podman")
+}
+
+func TestRuntimeConfigAppender(t *testing.T) {
+	e := newTestEnvCtx(t)
+	e.CABundlePem = []byte("bundle pem\n")
+	e.Options.RuntimeConfigs = []string{"k3s", "docker"}
+	e.Options.RuntimeConfigRegistries = []string{"quay.io"}
+	require.NoError(t, runtimeConfigAppender(e))
+
+	env := envMap(t, e)
+	assert.Len(t, env, 5)
+	assert.Equal(t, filepath.Join(e.TempDir, "k3s", "registries.yaml"), env["HTVEND_K3S_REGISTRIES_YAML"])
+	assert.Equal(t, filepath.Join(e.TempDir, "docker", "daemon.json"), env["HTVEND_DOCKER_DAEMON_JSON"])
+
+	// runtimes trust the same bundle as the sub-process
+	bb, err := os.ReadFile(filepath.Join(env["HTVEND_DOCKER_CERTS_D"], "quay.io", "ca.crt"))
+	require.NoError(t, err)
+	assert.Equal(t, "bundle pem\n", string(bb))
+	bb, err = os.ReadFile(env["HTVEND_K3S_REGISTRIES_YAML"])
+	require.NoError(t, err)
+	assert.Contains(t, string(bb), `ca_file: "/tmp/ca.pem"`)
+}
@@ -0,0 +1,271 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package htvend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type controlStatus struct {
+	Status        string                   `json:"status"`
+	Mode          string                   `json:"mode"`
+	Manifest      string                   `json:"manifest,omitempty"`
+	Entries       int                      `json:"entries"`
+	Projects      map[string]projectStatus `json:"projects,omitempty"`
+	ProxyAddr     string                   `json:"proxyAddr"`
+	SocksAddr     string                   `json:"socksAddr,omitempty"`
+	RecentMisses  int                      `json:"recentMisses"`
+	UptimeSeconds float64                  `json:"uptimeSeconds"`
+}
+
+type projectStatus struct {
+	Manifest string `json:"manifest"`
+	Entries  int    `json:"entries"`
+}
+
+type controlManifestRequest struct {
+	Project string `json:"project"`
+	Path    string `json:"path"`
+	Mode    string `json:"mode"`
+}
+
+// serveControlAPI blocks until ctx is done. If no control listeners are configured, it just waits.
+func (st *serveState) serveControlAPI(ctx context.Context) error {
+	var listeners []net.Listener
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+
+	if st.opts.ControlSocket != "" {
+		// remove any stale socket from a previous run
+		if err := os.Remove(st.opts.ControlSocket); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("error removing old control socket: %w", err)
+		}
+		l, err := net.Listen("unix", st.opts.ControlSocket)
+		if err != nil {
+			return fmt.Errorf("error listening on control socket: %w", err)
+		}
+		listeners = append(listeners, l)
+		if err := os.Chmod(st.opts.ControlSocket, 0o660); err != nil {
+			return fmt.Errorf("error setting permissions on control socket: %w", err)
+		}
+		logrus.Infof("Control API listening on unix:%s", st.opts.ControlSocket)
+	}
+	if st.opts.ControlAddr != "" {
+		l, err := net.Listen("tcp", st.opts.ControlAddr)
+		if err != nil {
+			return fmt.Errorf("error listening on control address: %w", err)
+		}
+		listeners = append(listeners, l)
+		logrus.Infof("Control API listening on http://%s", l.Addr())
+	}
+
+	server := &http.Server{
+		Handler: st.controlMux(),
+	}
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func() {
+			errs <- server.Serve(l)
+		}()
+	}
+
+	<-ctx.Done()
+	for range listeners {
+		if err := <-errs; err != nil && !errors.Is(err, http.ErrServerClosed) {
+			return fmt.Errorf("error from control server: %w", err)
+		}
+	}
+	return nil
+}
+
+func (st *serveState) controlMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /health", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, st.status())
+	})
+	mux.HandleFunc("GET /mode", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, st.status())
+	})
+	mux.HandleFunc("PUT /mode", func(w http.ResponseWriter, r *http.Request) {
+		var req controlManifestRequest
+		if !readJSON(w, r, &req) {
+			return
+		}
+		if err := st.switchTo(req.Mode, nil); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, st.status())
+	})
+	mux.HandleFunc("GET /manifest", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, st.status())
+	})
+	mux.HandleFunc("PUT /manifest", func(w http.ResponseWriter, r *http.Request) {
+		var req controlManifestRequest
+		if !readJSON(w, r, &req) {
+			return
+		}
+		st.mu.RLock()
+		if req.Mode == "" {
+			req.Mode = st.mode
+		}
+		st.mu.RUnlock()
+		if req.Path == "" {
+			http.Error(w, "path must be specified", http.StatusBadRequest)
+			return
+		}
+		if st.multiProject() != (req.Project != "") {
+			http.Error(w, "project must be specified if and only if serving multiple projects", http.StatusBadRequest)
+			return
+		}
+		path, err := st.controlManifestPath(req.Path)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err := st.switchTo(req.Mode, map[string]string{req.Project: path}); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, st.status())
+	})
+	mux.HandleFunc("POST /manifest/flush", func(w http.ResponseWriter, r *http.Request) {
+		if err := st.flush(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, st.status())
+	})
+	mux.HandleFunc("GET /misses", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, st.misses.Recent())
+	})
+	mux.HandleFunc("GET /ca", func(w http.ResponseWriter, r *http.Request) {
+		st.mu.RLock()
+		defer st.mu.RUnlock()
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		w.Write(st.caPem)
+	})
+	mux.HandleFunc("GET /env", func(w http.ResponseWriter, r *http.Request) {
+		st.mu.RLock()
+		defer st.mu.RUnlock()
+		w.Header().Set("Content-Type", "text/plain")
+		for _, ev := range st.env {
+			fmt.Fprintf(w, "export %s\n", ev)
+		}
+	})
+	return mux
+}
+
+// controlManifestPath resolves a manifest path given to the control API, which must be
+// within --control-manifest-dir, so that callers can't read or write arbitrary files.
+func (st *serveState) controlManifestPath(p string) (string, error) {
+	dir, err := filepath.Abs(st.opts.ControlDir)
+	if err != nil {
+		return "", fmt.Errorf("error resolving control manifest dir: %w", err)
+	}
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		return "", fmt.Errorf("error resolving control manifest dir: %w", err)
+	}
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(dir, p)
+	}
+
+	// the manifest may not exist yet, but its directory must
+	resolved, err := filepath.EvalSymlinks(p)
+	if errors.Is(err, os.ErrNotExist) {
+		var parent string
+		if parent, err = filepath.EvalSymlinks(filepath.Dir(p)); err == nil {
+			resolved = filepath.Join(parent, filepath.Base(p))
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("error resolving manifest path: %w", err)
+	}
+
+	rel, err := filepath.Rel(dir, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("manifest path must be within %s (see --control-manifest-dir)", dir)
+	}
+	return resolved, nil
+}
+
+func (st *serveState) status() controlStatus {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	rv := controlStatus{
+		Status:        "ok",
+		Mode:          st.mode,
+		ProxyAddr:     st.proxyAddr,
+		SocksAddr:     st.socksAddr,
+		RecentMisses:  len(st.misses.Recent()),
+		UptimeSeconds: time.Since(st.started).Seconds(),
+	}
+	if len(st.manifests) == 0 {
+		rv.Status = "no manifest loaded"
+	}
+	for name, sm := range st.manifests {
+		n := sm.lctx.Assets.Len()
+		rv.Entries += n
+		if name == "" {
+			rv.Manifest = sm.path
+		} else {
+			if rv.Projects == nil {
+				rv.Projects = make(map[string]projectStatus)
+			}
+			rv.Projects[name] = projectStatus{Manifest: sm.path, Entries: n}
+		}
+	}
+	return rv
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		logrus.Warnf("error writing control API response: %v", err)
+	}
+}
+
+// readJSON returns false if it failed, in which case an error has already been sent
+func readJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		http.Error(w, "bad request body: "+strings.TrimSpace(err.Error()), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
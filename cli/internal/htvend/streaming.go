@@ -0,0 +1,122 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package htvend
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"github.com/continusec/htvend/internal/secrets"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	streamingPassthrough = "passthrough"
+	streamingReject      = "reject"
+)
+
+var (
+	streamingRequestCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "htvend_streaming_request_total",
+		Help: "The total number of websocket and server-sent event requests, which are never recorded",
+	}, []string{"action"})
+)
+
+// isStreamingRequest returns true for requests that can't be captured as a
+// single response body, i.e. protocol upgrades (websockets) and server-sent events.
+func isStreamingRequest(r *http.Request) bool {
+	if r.Header.Get("Upgrade") != "" {
+		return true
+	}
+	for _, v := range r.Header.Values("Accept") {
+		if strings.Contains(v, "text/event-stream") {
+			return true
+		}
+	}
+	return false
+}
+
+func isStreamingResponse(resp *http.Response) bool {
+	mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mt == "text/event-stream"
+}
+
+// handleStreamingRequest either passes the request straight through to upstream,
+// or rejects it, depending on policy. Nothing is ever recorded in the manifest.
+func handleStreamingRequest(lctx *listenerCtx, w http.ResponseWriter, r *http.Request, u *url.URL) error {
+	if !lctx.FetchIfMissing {
+		streamingRequestCount.WithLabelValues("rejected").Inc()
+		logrus.Warnf("rejecting streaming request, as these are never recorded so can't be served offline: %s", secrets.RedactURL(u))
+		http.Error(w, "htvend: websocket and server-sent event requests are not recorded, so can't be served offline", http.StatusNotImplemented)
+		return nil
+	}
+	if lctx.StreamingPolicy != streamingPassthrough {
+		streamingRequestCount.WithLabelValues("rejected").Inc()
+		logrus.Warnf("rejecting streaming request due to --streaming-policy=%s: %s", lctx.StreamingPolicy, secrets.RedactURL(u))
+		http.Error(w, "htvend: websocket and server-sent event requests are rejected by --streaming-policy", http.StatusNotImplemented)
+		return nil
+	}
+
+	streamingRequestCount.WithLabelValues("passthrough").Inc()
+	logrus.Warnf("Passing through streaming request without recording, so this build is not reproducible offline: %s %s", r.Method, secrets.RedactURL(u))
+
+	var transport http.RoundTripper
+	if lctx.Client != nil {
+		transport = lctx.Client.Transport
+	}
+	(&httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL = u
+			pr.Out.Host = ""
+		},
+		Transport:     transport,
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			logrus.Warnf("error passing through streaming request (%s): %v", secrets.RedactURL(u), err)
+			http.Error(w, "see proxy server log for details", http.StatusBadGateway)
+		},
+	}).ServeHTTP(w, r)
+	return nil
+}
+
+// copyFlushing copies src to w, flushing after each read so that events arrive as they are sent.
+func copyFlushing(w http.ResponseWriter, src io.Reader) error {
+	rc := http.NewResponseController(w)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+			if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
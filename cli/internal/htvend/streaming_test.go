@@ -0,0 +1,125 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package htvend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newEventServer returns a server that sends an event stream, and signals on requests as each
+// arrives. Responses don't finish until release is closed.
+func newEventServer(t *testing.T) (srv *httptest.Server, requests chan struct{}, release chan struct{}, count *atomic.Int32) {
+	requests, release, count = make(chan struct{}, 10), make(chan struct{}), &atomic.Int32{}
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count.Add(1)
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte("data: first\n\n"))
+		w.(http.Flusher).Flush()
+		requests <- struct{}{}
+		<-release
+		_, _ = w.Write([]byte("data: last\n\n"))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, requests, release, count
+}
+
+func waitFor(t *testing.T, c chan struct{}) {
+	select {
+	case <-c:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out")
+	}
+}
+
+func TestStreamingRequest(t *testing.T) {
+	srv, requests, release, _ := newEventServer(t)
+	close(release)
+	mf, bs := newTestManifest(t)
+
+	for _, tc := range []struct {
+		name   string
+		lctx   *listenerCtx
+		status int
+	}{
+		{
+			name:   "passthrough",
+			lctx:   &listenerCtx{Assets: mf, Blobs: bs, FetchIfMissing: true, StreamingPolicy: streamingPassthrough, Client: srv.Client()},
+			status: http.StatusOK,
+		},
+		{
+			name:   "reject",
+			lctx:   &listenerCtx{Assets: mf, Blobs: bs, FetchIfMissing: true, StreamingPolicy: streamingReject, Client: srv.Client()},
+			status: http.StatusNotImplemented,
+		},
+		{
+			name:   "offline",
+			lctx:   &listenerCtx{Assets: mf, Blobs: bs, FailIfMissing: true, StreamingPolicy: streamingPassthrough, Client: srv.Client()},
+			status: http.StatusNotImplemented,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, srv.URL+"/events", nil)
+			r.Header.Set("Accept", "text/event-stream")
+			rec := httptest.NewRecorder()
+			serveWithListenerCtx(tc.lctx)(rec, r)
+			assert.Equal(t, tc.status, rec.Code)
+			if tc.status == http.StatusOK {
+				<-requests
+				assert.Equal(t, "data: first\n\ndata: last\n\n", rec.Body.String())
+			}
+			assert.Zero(t, mf.Len()) // never recorded
+		})
+	}
+}
+
+func TestStreamingResponse(t *testing.T) {
+	srv, requests, release, count := newEventServer(t)
+	mf, bs := newTestManifest(t)
+	lctx := &listenerCtx{Assets: mf, Blobs: bs, FetchIfMissing: true, StreamingPolicy: streamingPassthrough, Client: srv.Client()}
+
+	// neither client asks for an event stream, so we only find out from the response
+	get := func() (*httptest.ResponseRecorder, chan struct{}) {
+		rec, done := httptest.NewRecorder(), make(chan struct{})
+		go func() {
+			defer close(done)
+			serveWithListenerCtx(lctx)(rec, httptest.NewRequest(http.MethodGet, srv.URL+"/events", nil))
+		}()
+		return rec, done
+	}
+	leader, leaderDone := get()
+	waitFor(t, requests)
+
+	// a second client for the same URL doesn't wait for the first stream to end, but makes its own request
+	follower, followerDone := get()
+	waitFor(t, requests)
+	assert.Equal(t, int32(2), count.Load())
+
+	close(release)
+	waitFor(t, leaderDone)
+	waitFor(t, followerDone)
+	for _, rec := range []*httptest.ResponseRecorder{leader, follower} {
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "text/event-stream", rec.Header().Get("Content-Type"))
+		assert.Equal(t, "data: first\n\ndata: last\n\n", rec.Body.String())
+	}
+	require.Zero(t, mf.Len()) // never recorded
+}
@@ -0,0 +1,95 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imagepull
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/continusec/htvend/internal/secrets"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+var _ Fetcher = &HTTPFetcher{}
+
+// HTTPFetcher fetches with an HTTP client, e.g. via a proxy that is recording.
+// Blobs are discarded once hashed, and manifests are kept in memory.
+type HTTPFetcher struct {
+	client *http.Client
+
+	mu        sync.Mutex
+	manifests map[digest.Digest][]byte
+}
+
+func NewHTTPFetcher(client *http.Client) *HTTPFetcher {
+	return &HTTPFetcher{
+		client:    client,
+		manifests: make(map[digest.Digest][]byte),
+	}
+}
+
+func (f *HTTPFetcher) Fetch(ctx context.Context, u string, accept string) (digest.Digest, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return "", "", fmt.Errorf("error making request: %w", err)
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	logrus.Infof("Fetching URL: %s", secrets.RedactURLString(u))
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return "", "", fmt.Errorf("error in GET: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", &StatusError{URL: secrets.RedactURLString(u), StatusCode: resp.StatusCode}
+	}
+
+	// only manifests are fetched with an Accept header, and they are small enough to keep
+	if accept == "" {
+		digester := digest.Canonical.Digester()
+		if _, err := io.Copy(digester.Hash(), resp.Body); err != nil {
+			return "", "", fmt.Errorf("error reading %s: %w", secrets.RedactURLString(u), err)
+		}
+		return digester.Digest(), resp.Header.Get("Content-Type"), nil
+	}
+
+	bb, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize))
+	if err != nil {
+		return "", "", fmt.Errorf("error reading %s: %w", secrets.RedactURLString(u), err)
+	}
+	d := digest.FromBytes(bb)
+	f.mu.Lock()
+	f.manifests[d] = bb
+	f.mu.Unlock()
+	return d, resp.Header.Get("Content-Type"), nil
+}
+
+func (f *HTTPFetcher) Open(ctx context.Context, d digest.Digest) (io.ReadCloser, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	bb, ok := f.manifests[d]
+	if !ok {
+		return nil, fmt.Errorf("manifest not fetched: %s", d)
+	}
+	return io.NopCloser(bytes.NewReader(bb)), nil
+}
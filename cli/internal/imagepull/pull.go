@@ -0,0 +1,269 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package imagepull fetches everything needed to pull a container image, i.e.
+// manifests, configs and layers, for the selected platforms.
+package imagepull
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"runtime"
+	"slices"
+	"strings"
+
+	"github.com/continusec/htvend/internal/imageref"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	MediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeArtifactManifest   = "application/vnd.oci.artifact.manifest.v1+json" // removed from the final OCI 1.1 spec, but still found
+
+	// PlatformAll selects every platform in a multi-platform image
+	PlatformAll = "all"
+
+	maxManifestSize = 4 << 20
+)
+
+// ManifestAccept is sent as the Accept header when fetching manifests
+var ManifestAccept = strings.Join([]string{
+	imgspecv1.MediaTypeImageIndex,
+	imgspecv1.MediaTypeImageManifest,
+	MediaTypeDockerManifestList,
+	MediaTypeDockerManifest,
+}, ", ")
+
+// StatusError is returned by a Fetcher if the response was not 200 OK
+type StatusError struct {
+	URL        string
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("bad status fetching %s: %d %s", e.URL, e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// Fetcher fetches from registries, e.g. recording what it fetches in a manifest
+type Fetcher interface {
+	// Fetch makes sure that u has been fetched, and returns the digest and content
+	// type of its content. accept is sent as the Accept header, if set. If the
+	// response is not 200 OK, a *StatusError is returned.
+	Fetch(ctx context.Context, u string, accept string) (digest.Digest, string, error)
+
+	// Open returns the content of something already fetched, by its digest.
+	// This is only called for manifests.
+	Open(ctx context.Context, d digest.Digest) (io.ReadCloser, error)
+}
+
+// Platforms selects which images to pull from a multi-platform image
+type Platforms struct {
+	All       bool
+	Platforms []imgspecv1.Platform
+}
+
+// Options control what Pull fetches
+type Options struct {
+	Platforms Platforms
+
+	// Also fetch artifacts referring to each manifest, e.g. signatures, see PullReferrers
+	WithReferrers bool
+}
+
+// HostPlatform returns the platform we are running on
+func HostPlatform() imgspecv1.Platform {
+	rv := imgspecv1.Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}
+	if runtime.GOARCH == "arm" {
+		rv.Variant = "v7" // matches containers/image's default for 32-bit arm
+	}
+	return rv
+}
+
+// ParsePlatforms parses a list of os/arch[/variant] platforms, or all. If empty, the host platform is used.
+func ParsePlatforms(ss []string) (Platforms, error) {
+	if len(ss) == 0 {
+		return Platforms{Platforms: []imgspecv1.Platform{HostPlatform()}}, nil
+	}
+	var rv Platforms
+	for _, s := range ss {
+		if s == PlatformAll {
+			rv.All = true
+			continue
+		}
+		bits := strings.Split(s, "/")
+		if len(bits) < 2 || len(bits) > 3 || bits[0] == "" || bits[1] == "" {
+			return Platforms{}, fmt.Errorf("bad platform, expected os/arch[/variant] or %s: %s", PlatformAll, s)
+		}
+		p := imgspecv1.Platform{OS: bits[0], Architecture: bits[1]}
+		if len(bits) == 3 {
+			p.Variant = bits[2]
+		}
+		rv.Platforms = append(rv.Platforms, p)
+	}
+	return rv, nil
+}
+
+// platformMatches treats an unset variant on either side as compatible (e.g. arm64/v8)
+func platformMatches(want imgspecv1.Platform, p *imgspecv1.Platform) bool {
+	if p == nil || p.OS != want.OS || p.Architecture != want.Architecture {
+		return false
+	}
+	return want.Variant == "" || p.Variant == "" || p.Variant == want.Variant
+}
+
+func platformString(p *imgspecv1.Platform) string {
+	if p == nil {
+		return "unknown"
+	}
+	rv := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		rv += "/" + p.Variant
+	}
+	return rv
+}
+
+// choose returns the descriptors from an index for the selected platforms
+func (ps Platforms) choose(manifests []imgspecv1.Descriptor) ([]imgspecv1.Descriptor, error) {
+	if ps.All {
+		return manifests, nil
+	}
+	var rv []imgspecv1.Descriptor
+	for _, want := range ps.Platforms {
+		i := slices.IndexFunc(manifests, func(d imgspecv1.Descriptor) bool {
+			return platformMatches(want, d.Platform)
+		})
+		if i == -1 {
+			return nil, fmt.Errorf("no image found for %s", platformString(&want))
+		}
+		if !slices.ContainsFunc(rv, func(d imgspecv1.Descriptor) bool { return d.Digest == manifests[i].Digest }) {
+			rv = append(rv, manifests[i])
+		}
+	}
+	return rv, nil
+}
+
+// manifest has the fields of an image index, image manifest, or their Docker equivalents
+type manifest struct {
+	SchemaVersion int                    `json:"schemaVersion"`
+	MediaType     string                 `json:"mediaType"`
+	Manifests     []imgspecv1.Descriptor `json:"manifests"`
+	Config        imgspecv1.Descriptor   `json:"config"`
+	Layers        []imgspecv1.Descriptor `json:"layers"`
+	Blobs         []imgspecv1.Descriptor `json:"blobs"` // artifact manifest
+}
+
+// Pull fetches the manifest for ref, and for the selected platforms, their manifests, configs and layers
+func Pull(ctx context.Context, f Fetcher, ref imageref.Reference, opts Options) error {
+	d, contentType, err := f.Fetch(ctx, ref.ManifestURL(ref.Ref()), ManifestAccept)
+	if err != nil {
+		return fmt.Errorf("error fetching manifest: %w", err)
+	}
+	if ref.Digest != "" && d.String() != ref.Digest {
+		return fmt.Errorf("manifest digest (%s) differs from that requested (%s)", d, ref.Digest)
+	}
+	if ref.Digest == "" {
+		// some clients fetch the manifest again by digest, after resolving the tag
+		d2, _, err := f.Fetch(ctx, ref.ManifestURL(d.String()), ManifestAccept)
+		if err != nil {
+			return fmt.Errorf("error fetching manifest by digest: %w", err)
+		}
+		if d2 != d {
+			return fmt.Errorf("manifest by digest (%s) differs from that by tag (%s)", d2, d)
+		}
+	}
+	return pullManifest(ctx, f, ref, d, contentType, opts)
+}
+
+func pullManifest(ctx context.Context, f Fetcher, ref imageref.Reference, d digest.Digest, contentType string, opts Options) error {
+	if opts.WithReferrers {
+		if err := PullReferrers(ctx, f, ref, d); err != nil {
+			return err
+		}
+	}
+
+	rc, err := f.Open(ctx, d)
+	if err != nil {
+		return fmt.Errorf("error opening manifest: %w", err)
+	}
+	bb, err := io.ReadAll(io.LimitReader(rc, maxManifestSize))
+	rc.Close()
+	if err != nil {
+		return fmt.Errorf("error reading manifest: %w", err)
+	}
+
+	var m manifest
+	if err := json.Unmarshal(bb, &m); err != nil {
+		return fmt.Errorf("error parsing manifest (%s): %w", d, err)
+	}
+	mediaType := m.MediaType
+	if mediaType == "" {
+		mediaType, _, _ = mime.ParseMediaType(contentType)
+	}
+	if mediaType == "" || mediaType == "application/json" {
+		// OCI doesn't require mediaType, so fall back to the shape
+		switch {
+		case len(m.Manifests) != 0:
+			mediaType = imgspecv1.MediaTypeImageIndex
+		case m.Config.Digest != "":
+			mediaType = imgspecv1.MediaTypeImageManifest
+		}
+	}
+
+	switch mediaType {
+	case imgspecv1.MediaTypeImageIndex, MediaTypeDockerManifestList:
+		chosen, err := opts.Platforms.choose(m.Manifests)
+		if err != nil {
+			return err
+		}
+		for _, desc := range chosen {
+			logrus.Infof("Pulling %s for %s", ref, platformString(desc.Platform))
+			cd, cct, err := f.Fetch(ctx, ref.ManifestURL(desc.Digest.String()), ManifestAccept)
+			if err != nil {
+				return fmt.Errorf("error fetching manifest for %s: %w", platformString(desc.Platform), err)
+			}
+			if cd != desc.Digest {
+				return fmt.Errorf("manifest digest (%s) differs from that in index (%s)", cd, desc.Digest)
+			}
+			// anything nested is taken as a whole
+			if err := pullManifest(ctx, f, ref, cd, cct, Options{Platforms: Platforms{All: true}, WithReferrers: opts.WithReferrers}); err != nil {
+				return err
+			}
+		}
+		return nil
+	case imgspecv1.MediaTypeImageManifest, MediaTypeDockerManifest, MediaTypeArtifactManifest:
+		blobs := append(m.Layers, m.Blobs...)
+		if m.Config.Digest != "" {
+			blobs = append([]imgspecv1.Descriptor{m.Config}, blobs...)
+		}
+		for _, desc := range blobs {
+			bd, _, err := f.Fetch(ctx, ref.BlobURL(desc.Digest.String()), "")
+			if err != nil {
+				return fmt.Errorf("error fetching blob: %w", err)
+			}
+			if bd != desc.Digest {
+				return fmt.Errorf("blob digest (%s) differs from that in manifest (%s)", bd, desc.Digest)
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported manifest media type (%s) for %s, schema version %d", mediaType, d, m.SchemaVersion)
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imagepull
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/continusec/htvend/internal/imageref"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRegistry is a Fetcher serving from memory, recording what is fetched
+type fakeRegistry struct {
+	content map[string][]byte // by URL
+	fetched []string
+}
+
+func (r *fakeRegistry) Fetch(ctx context.Context, u string, accept string) (digest.Digest, string, error) {
+	bb, ok := r.content[u]
+	if !ok {
+		return "", "", &StatusError{URL: u, StatusCode: http.StatusNotFound}
+	}
+	r.fetched = append(r.fetched, u)
+	return digest.FromBytes(bb), "", nil
+}
+
+func (r *fakeRegistry) Open(ctx context.Context, d digest.Digest) (io.ReadCloser, error) {
+	for _, bb := range r.content {
+		if digest.FromBytes(bb) == d {
+			return io.NopCloser(bytes.NewReader(bb)), nil
+		}
+	}
+	return nil, fmt.Errorf("not found: %s", d)
+}
+
+func (r *fakeRegistry) put(t *testing.T, u string, v any) digest.Digest {
+	bb, ok := v.([]byte)
+	if !ok {
+		var err error
+		bb, err = json.Marshal(v)
+		require.NoError(t, err)
+	}
+	r.content[u] = bb
+	return digest.FromBytes(bb)
+}
+
+func TestPull(t *testing.T) {
+	const repo = "https://ghcr.io/v2/org/team/img"
+	reg := &fakeRegistry{content: make(map[string][]byte)}
+
+	// a Docker manifest list, with a platform manifest for each of two platforms
+	var descs []imgspecv1.Descriptor
+	for _, arch := range []string{"amd64", "arm64"} {
+		config := reg.put(t, repo+"/blobs/"+digest.FromString("config-"+arch).String(), []byte("config-"+arch))
+		layer := reg.put(t, repo+"/blobs/"+digest.FromString("layer-"+arch).String(), []byte("layer-"+arch))
+		m := map[string]any{
+			"schemaVersion": 2,
+			"mediaType":     MediaTypeDockerManifest,
+			"config":        imgspecv1.Descriptor{Digest: config},
+			"layers":        []imgspecv1.Descriptor{{Digest: layer}},
+		}
+		bb, err := json.Marshal(m)
+		require.NoError(t, err)
+		d := reg.put(t, repo+"/manifests/"+digest.FromBytes(bb).String(), bb)
+		descs = append(descs, imgspecv1.Descriptor{
+			MediaType: MediaTypeDockerManifest,
+			Digest:    d,
+			Platform:  &imgspecv1.Platform{OS: "linux", Architecture: arch, Variant: map[string]string{"arm64": "v8"}[arch]},
+		})
+	}
+	index := map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     MediaTypeDockerManifestList,
+		"manifests":     descs,
+	}
+	bb, err := json.Marshal(index)
+	require.NoError(t, err)
+	reg.put(t, repo+"/manifests/1.0", bb)
+	indexDigest := reg.put(t, repo+"/manifests/"+digest.FromBytes(bb).String(), bb)
+
+	ref, err := imageref.Parse("ghcr.io/org/team/img:1.0")
+	require.NoError(t, err)
+
+	// a single platform, which should match despite the variant
+	platforms, err := ParsePlatforms([]string{"linux/arm64"})
+	require.NoError(t, err)
+	require.NoError(t, Pull(context.Background(), reg, ref, Options{Platforms: platforms}))
+	assert.Equal(t, []string{
+		repo + "/manifests/1.0",
+		repo + "/manifests/" + indexDigest.String(),
+		repo + "/manifests/" + descs[1].Digest.String(),
+		repo + "/blobs/" + digest.FromString("config-arm64").String(),
+		repo + "/blobs/" + digest.FromString("layer-arm64").String(),
+	}, reg.fetched)
+
+	// all, by digest
+	reg.fetched = nil
+	ref, err = imageref.Parse("ghcr.io/org/team/img@" + indexDigest.String())
+	require.NoError(t, err)
+	platforms, err = ParsePlatforms([]string{PlatformAll})
+	require.NoError(t, err)
+	require.NoError(t, Pull(context.Background(), reg, ref, Options{Platforms: platforms}))
+	assert.Len(t, reg.fetched, 7)
+
+	// missing platform
+	platforms, err = ParsePlatforms([]string{"linux/s390x"})
+	require.NoError(t, err)
+	assert.ErrorContains(t, Pull(context.Background(), reg, ref, Options{Platforms: platforms}), "no image found for linux/s390x")
+
+	// wrong digest
+	ref.Digest = descs[0].Digest.String()
+	reg.content[repo+"/manifests/"+ref.Digest] = bb
+	assert.ErrorContains(t, Pull(context.Background(), reg, ref, Options{Platforms: platforms}), "differs from that requested")
+
+	_, err = ParsePlatforms([]string{"linux"})
+	assert.Error(t, err)
+}
+
+func TestPullReferrers(t *testing.T) {
+	const repo = "https://ghcr.io/v2/org/img"
+	reg := &fakeRegistry{content: make(map[string][]byte)}
+
+	image := func(name string) digest.Digest {
+		layer := reg.put(t, repo+"/blobs/"+digest.FromString(name).String(), []byte(name))
+		return reg.put(t, repo+"/manifests/"+name, map[string]any{
+			"schemaVersion": 2,
+			"mediaType":     imgspecv1.MediaTypeImageManifest,
+			"layers":        []imgspecv1.Descriptor{{Digest: layer}},
+		})
+	}
+	d := image("1.0")
+	reg.content[repo+"/manifests/"+d.String()] = reg.content[repo+"/manifests/1.0"]
+
+	// a cosign signature by tag, and an SBOM via the referrers API
+	image(ReferrerTag(d, ".sig"))
+	sbom := image("sbom")
+	reg.content[repo+"/manifests/"+sbom.String()] = reg.content[repo+"/manifests/sbom"]
+	reg.put(t, repo+"/referrers/"+d.String(), imgspecv1.Index{
+		Manifests: []imgspecv1.Descriptor{{Digest: sbom, ArtifactType: "application/spdx+json"}},
+	})
+
+	ref, err := imageref.Parse("ghcr.io/org/img:1.0")
+	require.NoError(t, err)
+	require.NoError(t, Pull(context.Background(), reg, ref, Options{WithReferrers: true}))
+	assert.Contains(t, reg.fetched, repo+"/manifests/"+sbom.String())
+	assert.Contains(t, reg.fetched, repo+"/blobs/"+digest.FromString("sbom").String())
+	assert.Contains(t, reg.fetched, repo+"/manifests/"+ReferrerTag(d, ".sig"))
+	assert.Contains(t, reg.fetched, repo+"/blobs/"+digest.FromString(ReferrerTag(d, ".sig")).String())
+
+	assert.True(t, IsReferrerTag(ReferrerTag(d, ".att")))
+	assert.True(t, IsReferrerTag(ReferrerTag(d, "")))
+	assert.False(t, IsReferrerTag("1.0"))
+	assert.False(t, IsReferrerTag("sha256-1234.sig"))
+}
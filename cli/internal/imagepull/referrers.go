@@ -0,0 +1,106 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imagepull
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/continusec/htvend/internal/imageref"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+)
+
+// ReferrerTagSuffixes are appended to sha256-<hex> to find artifacts by tag. The
+// empty suffix is the OCI referrers tag schema, for registries without the
+// referrers API. The others are used by cosign for signatures, attestations and SBOMs.
+var ReferrerTagSuffixes = []string{"", ".sig", ".att", ".sbom"}
+
+// ReferrerTag returns the tag for artifacts referring to d, e.g. sha256-<hex>.sig
+func ReferrerTag(d digest.Digest, suffix string) string {
+	return d.Algorithm().String() + "-" + d.Encoded() + suffix
+}
+
+// IsReferrerTag returns true if tag looks like one returned by ReferrerTag
+func IsReferrerTag(tag string) bool {
+	alg, rest, ok := strings.Cut(tag, "-")
+	if !ok || digest.Algorithm(alg) != digest.SHA256 {
+		return false
+	}
+	encoded, _, _ := strings.Cut(rest, ".")
+	return digest.NewDigestFromEncoded(digest.SHA256, encoded).Validate() == nil
+}
+
+// PullReferrers fetches artifacts referring to the manifest d, e.g. signatures,
+// attestations and SBOMs, using both the OCI referrers API and the tag schemes.
+// Those that aren't found, and a registry that doesn't support the API, are skipped.
+func PullReferrers(ctx context.Context, f Fetcher, ref imageref.Reference, d digest.Digest) error {
+	var statusErr *StatusError
+
+	// the API is an index of artifacts, which need fetching by digest
+	rd, _, err := f.Fetch(ctx, ref.ReferrersURL(d.String()), imgspecv1.MediaTypeImageIndex)
+	switch {
+	case errors.As(err, &statusErr):
+		logrus.Debugf("No referrers API for %s: %v", ref.Repository, err)
+	case err != nil:
+		return fmt.Errorf("error fetching referrers: %w", err)
+	default:
+		rc, err := f.Open(ctx, rd)
+		if err != nil {
+			return fmt.Errorf("error opening referrers: %w", err)
+		}
+		var index imgspecv1.Index
+		err = json.NewDecoder(io.LimitReader(rc, maxManifestSize)).Decode(&index)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("error parsing referrers for %s: %w", d, err)
+		}
+		for _, desc := range index.Manifests {
+			logrus.Infof("Pulling referrer %s (%s) of %s", desc.Digest, desc.ArtifactType, d)
+			ad, act, err := f.Fetch(ctx, ref.ManifestURL(desc.Digest.String()), ManifestAccept)
+			if err != nil {
+				return fmt.Errorf("error fetching referrer: %w", err)
+			}
+			if ad != desc.Digest {
+				return fmt.Errorf("referrer digest (%s) differs from that listed (%s)", ad, desc.Digest)
+			}
+			if err := pullManifest(ctx, f, ref, ad, act, Options{Platforms: Platforms{All: true}}); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, suffix := range ReferrerTagSuffixes {
+		tag := ReferrerTag(d, suffix)
+		td, tct, err := f.Fetch(ctx, ref.ManifestURL(tag), ManifestAccept)
+		if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error fetching %s: %w", tag, err)
+		}
+		logrus.Infof("Pulling %s", tag)
+		if err := pullManifest(ctx, f, ref, td, tct, Options{Platforms: Platforms{All: true}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
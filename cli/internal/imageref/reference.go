@@ -0,0 +1,187 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package imageref parses container image references, such as
+// ghcr.io/org/team/img:1.0@sha256:..., following the grammar used by Docker
+// and the OCI distribution spec.
+package imageref
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const (
+	DockerHub         = "docker.io"
+	DockerHubRegistry = "registry-1.docker.io"
+	DefaultTag        = "latest"
+)
+
+var (
+	pathComponentRegex = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*$`)
+	domainRegex        = regexp.MustCompile(`^(?:[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?)(?:\.[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?)*(?::[0-9]+)?$|^\[[0-9a-fA-F:]+\](?::[0-9]+)?$`)
+	tagRegex           = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+	digestRegex        = regexp.MustCompile(`^[a-z0-9]+(?:[.+_-][a-z0-9]+)*:[a-zA-Z0-9=_-]{32,}$`)
+)
+
+type Reference struct {
+	Domain     string // e.g. docker.io or localhost:5000
+	Repository string // e.g. library/alpine or org/team/img
+	Tag        string // empty if only a digest was given
+	Digest     string // e.g. sha256:..., empty if not given
+}
+
+// Parse parses ref. If no domain is given, docker.io is used, and names on
+// docker.io without an org are in library/. If neither tag nor digest is
+// given, the tag is latest.
+func Parse(ref string) (Reference, error) {
+	var rv Reference
+	name := ref
+
+	if i := strings.Index(name, "@"); i != -1 {
+		name, rv.Digest = name[:i], name[i+1:]
+		if !digestRegex.MatchString(rv.Digest) {
+			return Reference{}, fmt.Errorf("invalid digest in image reference: %s", ref)
+		}
+	}
+
+	// a tag follows the last colon, unless that is part of the domain's port
+	if i := strings.LastIndex(name, ":"); i != -1 && !strings.Contains(name[i:], "/") {
+		name, rv.Tag = name[:i], name[i+1:]
+		if !tagRegex.MatchString(rv.Tag) {
+			return Reference{}, fmt.Errorf("invalid tag in image reference: %s", ref)
+		}
+	}
+
+	rv.Domain, rv.Repository = SplitDomain(name)
+	if !domainRegex.MatchString(rv.Domain) {
+		return Reference{}, fmt.Errorf("invalid domain in image reference: %s", ref)
+	}
+	for _, c := range strings.Split(rv.Repository, "/") {
+		if !pathComponentRegex.MatchString(c) {
+			return Reference{}, fmt.Errorf("invalid repository name in image reference: %s", ref)
+		}
+	}
+
+	if rv.Tag == "" && rv.Digest == "" {
+		rv.Tag = DefaultTag
+	}
+	return rv, nil
+}
+
+// HasDomain returns true if name starts with a domain. The first component is
+// the domain if it looks like a host name, i.e. contains a . or :, or is localhost.
+func HasDomain(name string) bool {
+	first, _, ok := strings.Cut(name, "/")
+	return ok && (strings.ContainsAny(first, ".:") || first == "localhost" || strings.ToLower(first) != first)
+}
+
+// SplitDomain splits a name without tag or digest into its domain and repository,
+// using docker.io if it has none, and normalising Docker Hub names.
+func SplitDomain(name string) (domain, repository string) {
+	domain, repository = DockerHub, name
+	if HasDomain(name) {
+		domain, repository, _ = strings.Cut(name, "/")
+	}
+	if domain == "index.docker.io" {
+		domain = DockerHub
+	}
+	if domain == DockerHub && !strings.Contains(repository, "/") {
+		repository = "library/" + repository
+	}
+	return domain, repository
+}
+
+// RegistryHost returns the host to connect to for the registry at domain
+func RegistryHost(domain string) string {
+	if domain == DockerHub {
+		return DockerHubRegistry
+	}
+	return domain
+}
+
+// Ref returns the digest if set, else the tag, as used in a manifest URL
+func (r Reference) Ref() string {
+	if r.Digest != "" {
+		return r.Digest
+	}
+	return r.Tag
+}
+
+// RepositoryURL returns the URL prefix for the repository, e.g. https://registry-1.docker.io/v2/library/alpine
+func (r Reference) RepositoryURL() string {
+	return (&url.URL{
+		Scheme: "https",
+		Host:   RegistryHost(r.Domain),
+		Path:   "/v2/" + r.Repository,
+	}).String()
+}
+
+// ManifestURL returns the URL of the manifest for ref, which is a tag or digest
+func (r Reference) ManifestURL(ref string) string {
+	return r.RepositoryURL() + "/manifests/" + ref
+}
+
+// ReferrersURL returns the URL of the OCI referrers API for the manifest with the given digest
+func (r Reference) ReferrersURL(digest string) string {
+	return r.RepositoryURL() + "/referrers/" + digest
+}
+
+// BlobURL returns the URL of the blob with the given digest
+func (r Reference) BlobURL(digest string) string {
+	return r.RepositoryURL() + "/blobs/" + digest
+}
+
+// FromManifestURL is the reverse of ManifestURL, and returns false if u is not a manifest URL
+func FromManifestURL(u *url.URL) (Reference, bool) {
+	if u.Scheme != "https" {
+		return Reference{}, false
+	}
+	p, ok := strings.CutPrefix(u.Path, "/v2/")
+	if !ok {
+		return Reference{}, false
+	}
+	i := strings.LastIndex(p, "/manifests/")
+	if i == -1 {
+		return Reference{}, false
+	}
+	rv := Reference{Domain: u.Host, Repository: p[:i]}
+	if rv.Domain == DockerHubRegistry {
+		rv.Domain = DockerHub
+	}
+	ref := p[i+len("/manifests/"):]
+	if strings.Contains(ref, ":") {
+		rv.Digest = ref
+	} else {
+		rv.Tag = ref
+	}
+	if _, err := Parse(rv.String()); err != nil {
+		return Reference{}, false
+	}
+	return rv, true
+}
+
+// String returns the reference in its canonical form, e.g. docker.io/library/alpine:3.20
+func (r Reference) String() string {
+	rv := r.Domain + "/" + r.Repository
+	if r.Tag != "" {
+		rv += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		rv += "@" + r.Digest
+	}
+	return rv
+}
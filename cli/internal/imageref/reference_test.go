@@ -0,0 +1,96 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageref
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	const dgst = "sha256:4bcff63911fcb4448bd4fdacec207030997caf25e9bea4045fa6c8c44de311d1"
+	for _, tc := range []struct {
+		Ref      string
+		Expected Reference
+		URL      string
+	}{
+		{"alpine", Reference{"docker.io", "library/alpine", "latest", ""}, "https://registry-1.docker.io/v2/library/alpine/manifests/latest"},
+		{"alpine:3.20", Reference{"docker.io", "library/alpine", "3.20", ""}, "https://registry-1.docker.io/v2/library/alpine/manifests/3.20"},
+		{"rancher/klipper-helm:v0.9.8-build20250709", Reference{"docker.io", "rancher/klipper-helm", "v0.9.8-build20250709", ""}, "https://registry-1.docker.io/v2/rancher/klipper-helm/manifests/v0.9.8-build20250709"},
+		{"docker.io/library/postgres:17", Reference{"docker.io", "library/postgres", "17", ""}, "https://registry-1.docker.io/v2/library/postgres/manifests/17"},
+		{"ghcr.io/org/team/sub/img:1.0", Reference{"ghcr.io", "org/team/sub/img", "1.0", ""}, "https://ghcr.io/v2/org/team/sub/img/manifests/1.0"},
+		{"localhost:5000/foo", Reference{"localhost:5000", "foo", "latest", ""}, "https://localhost:5000/v2/foo/manifests/latest"},
+		{"localhost/foo:bar", Reference{"localhost", "foo", "bar", ""}, "https://localhost/v2/foo/manifests/bar"},
+		{"registry.example.com:8443/a/b:c@" + dgst, Reference{"registry.example.com:8443", "a/b", "c", dgst}, "https://registry.example.com:8443/v2/a/b/manifests/" + dgst},
+		{"alpine@" + dgst, Reference{"docker.io", "library/alpine", "", dgst}, "https://registry-1.docker.io/v2/library/alpine/manifests/" + dgst},
+	} {
+		ref, err := Parse(tc.Ref)
+		require.NoError(t, err, tc.Ref)
+		assert.Equal(t, tc.Expected, ref, tc.Ref)
+		assert.Equal(t, tc.URL, ref.ManifestURL(ref.Ref()), tc.Ref)
+
+		// and canonical form should round trip
+		ref2, err := Parse(ref.String())
+		require.NoError(t, err, tc.Ref)
+		assert.Equal(t, ref, ref2, tc.Ref)
+	}
+
+	for _, bad := range []string{
+		"",
+		"Alpine",
+		"alpine:",
+		"alpine:-bad",
+		"alpine@sha256:short",
+		"foo//bar",
+		"ghcr.io/",
+		"bad_domain.com:x/foo",
+		"a/b/../c",
+	} {
+		_, err := Parse(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestFromManifestURL(t *testing.T) {
+	for _, img := range []string{
+		"alpine:3.20",
+		"ghcr.io/org/team/img:1.0",
+		"localhost:5000/img@sha256:" + strings.Repeat("a", 64),
+	} {
+		ref, err := Parse(img)
+		require.NoError(t, err)
+		u, err := url.Parse(ref.ManifestURL(ref.Ref()))
+		require.NoError(t, err)
+		ref2, ok := FromManifestURL(u)
+		require.True(t, ok, img)
+		assert.Equal(t, ref, ref2, img)
+	}
+
+	for _, bad := range []string{
+		"https://ghcr.io/v2/org/img/blobs/sha256:" + strings.Repeat("a", 64),
+		"https://ghcr.io/v2/",
+		"http://ghcr.io/v2/org/img/manifests/1.0",
+		"https://ghcr.io/v2/Org/img/manifests/1.0",
+	} {
+		u, err := url.Parse(bad)
+		require.NoError(t, err)
+		_, ok := FromManifestURL(u)
+		assert.False(t, ok, bad)
+	}
+}
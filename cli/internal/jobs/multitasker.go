@@ -1,4 +1,4 @@
-// Copyright 2026 Continusec Pty Ltd.
+// Copyright 2025 Continusec Pty Ltd.
 //
 // Licensed under the Apache License, Version 2.0 (the "License");
 // you may not use this file except in compliance with the License.
@@ -14,38 +14,169 @@
 
 package jobs
 
-import "sync"
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"sync"
+	"time"
 
+	"github.com/hashicorp/go-multierror"
+	"github.com/sirupsen/logrus"
+)
+
+const maxRetryDelay = 30 * time.Second
+
+type Options struct {
+	// Maximum number of jobs to run at once. Values less than 1 are treated as 1.
+	Jobs int
+
+	// If false, then the first failure cancels all other jobs.
+	KeepGoing bool
+
+	// Number of times to retry a failed job, unless the error is marked Permanent.
+	Retries int
+
+	// Delay before the first retry, doubled for each subsequent one. Defaults to 1s.
+	RetryDelay time.Duration
+}
+
+// MultiTasker runs queued jobs on a bounded pool of workers.
 type MultiTasker struct {
+	opts   Options
+	parent context.Context
+	ctx    context.Context
+	cancel context.CancelFunc
+	queue  chan func(context.Context) error
 	wg     sync.WaitGroup
-	errors chan error
+
+	mu     sync.Mutex
+	errors []error
+}
+
+func NewMultiTasker(ctx context.Context, opts Options) *MultiTasker {
+	if opts.Jobs < 1 {
+		opts.Jobs = 1
+	}
+	if opts.RetryDelay == 0 {
+		opts.RetryDelay = time.Second
+	}
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	rv := &MultiTasker{
+		opts:   opts,
+		parent: parent,
+		ctx:    ctx,
+		cancel: cancel,
+		queue:  make(chan func(context.Context) error),
+	}
+	for range opts.Jobs {
+		rv.wg.Add(1)
+		go rv.worker()
+	}
+	return rv
+}
+
+// Queue blocks until a worker is free to accept the job.
+// If the MultiTasker has been cancelled, then the job is never run.
+func (mt *MultiTasker) Queue(f func(ctx context.Context) error) {
+	select {
+	case mt.queue <- f:
+	case <-mt.ctx.Done():
+	}
+}
+
+func (mt *MultiTasker) worker() {
+	defer mt.wg.Done()
+	for f := range mt.queue {
+		if mt.ctx.Err() != nil {
+			continue // drain anything left without running it
+		}
+		if err := mt.runWithRetries(f); err != nil {
+			// don't report errors caused by us cancelling after an earlier failure
+			if mt.ctx.Err() != nil && errors.Is(err, context.Canceled) {
+				continue
+			}
+			mt.mu.Lock()
+			mt.errors = append(mt.errors, err)
+			mt.mu.Unlock()
+			if !mt.opts.KeepGoing {
+				mt.cancel()
+			}
+		}
+	}
 }
 
-func NewMultiTasker() *MultiTasker {
-	return &MultiTasker{
-		errors: make(chan error),
+func (mt *MultiTasker) runWithRetries(f func(context.Context) error) error {
+	delay := mt.opts.RetryDelay
+	for attempt := 0; ; attempt++ {
+		err := f(mt.ctx)
+		if err == nil || attempt >= mt.opts.Retries || isPermanent(err) || mt.ctx.Err() != nil {
+			return err
+		}
+
+		// add some jitter so that we don't retry everything in lockstep
+		sleep := delay/2 + rand.N(delay)
+		logrus.Warnf("job failed (attempt %d of %d), retrying in %s: %v", attempt+1, mt.opts.Retries+1, sleep.Round(time.Millisecond), err)
+		select {
+		case <-time.After(sleep):
+		case <-mt.ctx.Done():
+			return err
+		}
+		delay = min(delay*2, maxRetryDelay)
 	}
 }
 
-func (mt *MultiTasker) Queue(f func() error) {
-	mt.wg.Add(1)
-	go func() {
-		defer mt.wg.Done()
-		mt.errors <- f()
-	}()
+// Cancel stops any running jobs, and any that are queued later are never run.
+// Wait must still be called to release the workers.
+func (mt *MultiTasker) Cancel() {
+	mt.cancel()
 }
 
+// Wait for all queued jobs to finish. errCallback is called for each failure.
+// If KeepGoing is set, all errors are returned, else only the first. If the
+// context passed to NewMultiTasker was cancelled, then jobs may have been
+// skipped, so its error is returned if there is nothing else to report.
 func (mt *MultiTasker) Wait(errCallback func(error)) error {
-	go func() {
-		defer close(mt.errors)
-		mt.wg.Wait()
-	}()
-	var rvErr error
-	for err := range mt.errors {
-		if err != nil && rvErr == nil {
-			rvErr = err
-			errCallback(err)
+	close(mt.queue)
+	mt.wg.Wait()
+	mt.cancel()
+
+	var rv error
+	for _, err := range mt.errors {
+		errCallback(err)
+		if !mt.opts.KeepGoing {
+			return err
 		}
+		rv = multierror.Append(rv, err)
+	}
+	if rv == nil {
+		return mt.parent.Err()
 	}
-	return rvErr
+	return rv
+}
+
+type permanentError struct {
+	err error
+}
+
+func (pe permanentError) Error() string {
+	return pe.err.Error()
+}
+
+func (pe permanentError) Unwrap() error {
+	return pe.err
+}
+
+// Permanent marks an error as one which should not be retried.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return permanentError{err: err}
+}
+
+func isPermanent(err error) bool {
+	var pe permanentError
+	return errors.As(err, &pe)
 }
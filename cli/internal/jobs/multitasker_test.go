@@ -0,0 +1,130 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobs
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMultiTaskerLimit(t *testing.T) {
+	mt := NewMultiTasker(context.Background(), Options{Jobs: 3})
+	var running, maxRunning atomic.Int32
+	for range 20 {
+		mt.Queue(func(ctx context.Context) error {
+			n := running.Add(1)
+			defer running.Add(-1)
+			for {
+				m := maxRunning.Load()
+				if n <= m || maxRunning.CompareAndSwap(m, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			return nil
+		})
+	}
+	assert.Nil(t, mt.Wait(func(error) {}))
+	assert.LessOrEqual(t, maxRunning.Load(), int32(3))
+}
+
+func TestMultiTaskerCancelOnFailure(t *testing.T) {
+	mt := NewMultiTasker(context.Background(), Options{Jobs: 1})
+	var ran atomic.Int32
+	boom := errors.New("boom")
+	mt.Queue(func(ctx context.Context) error {
+		ran.Add(1)
+		return Permanent(boom)
+	})
+	for range 5 {
+		mt.Queue(func(ctx context.Context) error {
+			ran.Add(1)
+			return nil
+		})
+	}
+	var reported int
+	err := mt.Wait(func(error) { reported++ })
+	assert.ErrorIs(t, err, boom)
+	assert.Equal(t, 1, reported)
+	assert.Equal(t, int32(1), ran.Load())
+}
+
+func TestMultiTaskerKeepGoing(t *testing.T) {
+	mt := NewMultiTasker(context.Background(), Options{Jobs: 2, KeepGoing: true})
+	var ran atomic.Int32
+	for range 4 {
+		mt.Queue(func(ctx context.Context) error {
+			ran.Add(1)
+			return Permanent(errors.New("boom"))
+		})
+	}
+	var reported int
+	assert.NotNil(t, mt.Wait(func(error) { reported++ }))
+	assert.Equal(t, 4, reported)
+	assert.Equal(t, int32(4), ran.Load())
+}
+
+func TestMultiTaskerRetries(t *testing.T) {
+	mt := NewMultiTasker(context.Background(), Options{Jobs: 1, Retries: 2, RetryDelay: time.Millisecond})
+
+	// succeeds on the final attempt
+	var attempts atomic.Int32
+	mt.Queue(func(ctx context.Context) error {
+		if attempts.Add(1) < 3 {
+			return errors.New("transient")
+		}
+		return nil
+	})
+	assert.Nil(t, mt.Wait(func(error) {}))
+	assert.Equal(t, int32(3), attempts.Load())
+
+	// never retried
+	mt = NewMultiTasker(context.Background(), Options{Jobs: 1, Retries: 2, RetryDelay: time.Millisecond})
+	var permanentAttempts atomic.Int32
+	mt.Queue(func(ctx context.Context) error {
+		permanentAttempts.Add(1)
+		return Permanent(errors.New("bad hash"))
+	})
+	assert.NotNil(t, mt.Wait(func(error) {}))
+	assert.Equal(t, int32(1), permanentAttempts.Load())
+}
+
+func TestMultiTaskerParentCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	mt := NewMultiTasker(ctx, Options{Jobs: 1})
+	var ran atomic.Int32
+	mt.Queue(func(ctx context.Context) error {
+		ran.Add(1)
+		cancel()
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	for range 5 {
+		mt.Queue(func(ctx context.Context) error {
+			ran.Add(1)
+			return nil
+		})
+	}
+	var reported int
+	err := mt.Wait(func(error) { reported++ })
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 0, reported)
+	assert.Equal(t, int32(1), ran.Load())
+}
@@ -0,0 +1,158 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Progress tracks completion of a known number of items (and optionally bytes)
+// so that it can be displayed while jobs are running. Safe for concurrent use.
+type Progress struct {
+	name       string
+	totalItems int64
+	totalBytes int64 // 0 if unknown
+	start      time.Time
+
+	doneItems atomic.Int64
+	doneBytes atomic.Int64
+}
+
+func NewProgress(name string, totalItems, totalBytes int64) *Progress {
+	return &Progress{
+		name:       name,
+		totalItems: totalItems,
+		totalBytes: totalBytes,
+		start:      time.Now(),
+	}
+}
+
+func (p *Progress) ItemDone() {
+	p.doneItems.Add(1)
+}
+
+func (p *Progress) AddBytes(n int64) {
+	p.doneBytes.Add(n)
+}
+
+func (p *Progress) Bytes() int64 {
+	return p.doneBytes.Load()
+}
+
+func (p *Progress) Elapsed() time.Duration {
+	return time.Since(p.start)
+}
+
+// Writer returns a writer that counts all bytes written to it towards progress.
+func (p *Progress) Writer() io.Writer {
+	return progressWriter{p}
+}
+
+type progressWriter struct {
+	p *Progress
+}
+
+func (pw progressWriter) Write(b []byte) (int, error) {
+	pw.p.AddBytes(int64(len(b)))
+	return len(b), nil
+}
+
+func (p *Progress) String() string {
+	items, bytes := p.doneItems.Load(), p.doneBytes.Load()
+
+	rv := fmt.Sprintf("%s: %d/%d", p.name, items, p.totalItems)
+	if p.totalBytes > 0 {
+		rv += fmt.Sprintf(", %s/%s", HumanBytes(bytes), HumanBytes(p.totalBytes))
+	} else {
+		rv += ", " + HumanBytes(bytes)
+	}
+
+	// estimate on bytes if we know the total, else on items
+	var frac float64
+	if p.totalBytes > 0 {
+		frac = float64(bytes) / float64(p.totalBytes)
+	} else if p.totalItems > 0 {
+		frac = float64(items) / float64(p.totalItems)
+	}
+	if frac > 0 && frac < 1 {
+		elapsed := p.Elapsed()
+		rv += fmt.Sprintf(", ETA %s", time.Duration(float64(elapsed)*(1-frac)/frac).Round(time.Second))
+	}
+	return rv
+}
+
+// Display shows progress until the returned func is called. If w is a terminal
+// the line is redrawn in place, else a log line is emitted periodically.
+func (p *Progress) Display(w *os.File) (stop func()) {
+	tty := isTerminal(w)
+	interval := 10 * time.Second
+	if tty {
+		interval = 250 * time.Millisecond
+	}
+
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				if tty {
+					fmt.Fprintf(w, "\r\033[K")
+				}
+				return
+			case <-t.C:
+				if tty {
+					fmt.Fprintf(w, "\r\033[K%s", p)
+				} else {
+					logrus.Info(p.String())
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+	}
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+func HumanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,107 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lockfile
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+const (
+	// LayoutIndent writes each entry indented over multiple lines
+	LayoutIndent = "indent"
+
+	// LayoutLine writes each entry on a single line, which keeps diffs small for large manifests
+	LayoutLine = "line"
+)
+
+// marshalManifest produces the canonical form of a manifest. Entries are
+// ordered by host, then path, so that related URLs are grouped together
+// regardless of scheme, and there is always a trailing newline.
+func marshalManifest(blobs blobMap, layout string) ([]byte, error) {
+	keys := make([]string, 0, len(blobs))
+	for k := range blobs {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, compareKeys)
+
+	var prefix, indent string
+	switch layout {
+	case LayoutIndent, "":
+		prefix, indent = "  ", "  "
+	case LayoutLine:
+	default:
+		return nil, fmt.Errorf("unknown manifest layout: %s", layout)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("{")
+	for i, k := range keys {
+		kb, err := marshalJSON(k, "", "")
+		if err != nil {
+			return nil, err
+		}
+		vb, err := marshalJSON(blobs[k], prefix, indent)
+		if err != nil {
+			return nil, err
+		}
+		if i != 0 {
+			buf.WriteString(",")
+		}
+		buf.WriteString("\n  ")
+		buf.Write(kb)
+		buf.WriteString(": ")
+		buf.Write(vb)
+	}
+	if len(keys) != 0 {
+		buf.WriteString("\n")
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes(), nil
+}
+
+// marshalJSON is like json.MarshalIndent, except that it doesn't escape HTML
+// characters, as & is common in URLs. Empty indent gives compact output.
+func marshalJSON(v any, prefix, indent string) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent(prefix, indent)
+	if err := enc.Encode(v); err != nil {
+		return nil, fmt.Errorf("error marshalling: %w", err)
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+func compareKeys(a, b string) int {
+	ua, errA := url.Parse(a)
+	ub, errB := url.Parse(b)
+	if errA != nil || errB != nil {
+		return strings.Compare(a, b)
+	}
+	return cmp.Or(
+		strings.Compare(strings.ToLower(ua.Hostname()), strings.ToLower(ub.Hostname())),
+		strings.Compare(ua.Port(), ub.Port()),
+		strings.Compare(ua.EscapedPath(), ub.EscapedPath()),
+		strings.Compare(ua.RawQuery, ub.RawQuery),
+		strings.Compare(ua.Scheme, ub.Scheme),
+		strings.Compare(a, b),
+	)
+}
@@ -0,0 +1,120 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lockfile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	journalAdd    = "add"
+	journalRemove = "remove"
+)
+
+// Each change to a writable file is appended to a journal alongside it, so
+// that if we don't get to write the file out (e.g. we are killed) the changes
+// are merged the next time it is opened. The journal is removed once the file is saved.
+type journalEntry struct {
+	Op    string    `json:"op"`
+	Key   string    `json:"key"`
+	Value *BlobInfo `json:"value,omitempty"`
+}
+
+func journalPath(path string) string {
+	return path + ".journal"
+}
+
+// replayJournal applies any journal left from a previous run to blobs, and returns the number of entries applied.
+// A truncated final line is ignored, as that is expected if we were killed mid-write.
+func replayJournal(path string, blobs blobMap) (int, error) {
+	bb, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("error reading journal: %w", err)
+	}
+
+	count := 0
+	r := bufio.NewReader(bytes.NewReader(bb))
+	for lineNo := 1; ; lineNo++ {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// anything without a trailing newline was not completely written
+			return count, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("error reading journal: %w", err)
+		}
+
+		var je journalEntry
+		if err := json.Unmarshal(line, &je); err != nil {
+			return 0, fmt.Errorf("bad journal entry on line %d: %w", lineNo, err)
+		}
+		switch {
+		case je.Op == journalAdd && je.Value != nil:
+			blobs[je.Key] = *je.Value
+		case je.Op == journalRemove:
+			delete(blobs, je.Key)
+		default:
+			return 0, fmt.Errorf("bad journal entry on line %d: unknown op %q", lineNo, je.Op)
+		}
+		count++
+	}
+}
+
+// caller must get mutex
+func (f *File) appendJournal(je journalEntry) error {
+	if f.journal == nil {
+		var err error
+		f.journal, err = os.OpenFile(journalPath(f.options.Path), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o666)
+		if err != nil {
+			return fmt.Errorf("error opening journal: %w", err)
+		}
+	}
+
+	bb, err := json.Marshal(je)
+	if err != nil {
+		return fmt.Errorf("error marshalling journal entry: %w", err)
+	}
+	if _, err := f.journal.Write(append(bb, '\n')); err != nil {
+		return fmt.Errorf("error writing journal: %w", err)
+	}
+	if err := f.journal.Sync(); err != nil {
+		return fmt.Errorf("error syncing journal: %w", err)
+	}
+	return nil
+}
+
+// removeJournal is called once the file has been saved, so the journal is no longer needed
+// caller must get mutex
+func (f *File) removeJournal() error {
+	if f.journal != nil {
+		if err := f.journal.Close(); err != nil {
+			return fmt.Errorf("error closing journal: %w", err)
+		}
+		f.journal = nil
+	}
+	if err := os.Remove(journalPath(f.options.Path)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("error removing journal: %w", err)
+	}
+	return nil
+}
@@ -21,9 +21,13 @@ import (
 	"maps"
 	"net/url"
 	"os"
+	"path/filepath"
+	"slices"
 	"sync"
 
 	"github.com/continusec/htvend/internal/re"
+	"github.com/continusec/htvend/internal/secrets"
+	"github.com/continusec/htvend/internal/urlnorm"
 	"github.com/danjacques/gofslock/fslock"
 	"github.com/sirupsen/logrus"
 )
@@ -31,10 +35,14 @@ import (
 type BlobInfo struct {
 	Sha256  string
 	Headers map[string]string
+
+	// Set if the key is not the URL that was fetched, e.g. as a signature was
+	// scrubbed from it, so it can't be used to fetch the asset again.
+	Unfetchable bool `json:",omitempty"`
 }
 
 func blobEquals(a, b BlobInfo) bool {
-	return a.Sha256 == b.Sha256 && maps.Equal(a.Headers, b.Headers)
+	return a.Sha256 == b.Sha256 && a.Unfetchable == b.Unfetchable && maps.Equal(a.Headers, b.Headers)
 }
 
 type blobMap map[string]BlobInfo
@@ -45,7 +53,10 @@ type File struct {
 	mu            sync.Mutex
 	blobs         blobMap
 	previousBlobs blobMap
+	loadedBlobs   blobMap         // as read from disk, used to report changes
+	reused        map[string]bool // keys restored from previousBlobs
 	dirty         bool
+	journal       *os.File // opened on first change, if writable
 	lock          fslock.Handle
 	lockPath      string
 }
@@ -62,6 +73,12 @@ type MapFileOptions struct {
 
 	// List of regexes that we never return a value for
 	NoCache *re.MultiRegexMatcher
+
+	// How entries are laid out when saved, LayoutIndent (the default) or LayoutLine
+	Layout string
+
+	// Normalizes URLs before they are used as keys, may be nil
+	URLNormalizer *urlnorm.Normalizer
 }
 
 // if writable, then we get an exclusive lock on this file,
@@ -80,7 +97,7 @@ func NewMapFile(options MapFileOptions) (retFile *File, retErr error) {
 		defer func() {
 			// if we return an error, then we must release any lock we have
 			if retErr != nil {
-				retFile.Close()
+				rv.unlock()
 			}
 		}()
 	}
@@ -92,12 +109,19 @@ func NewMapFile(options MapFileOptions) (retFile *File, retErr error) {
 	return rv, nil
 }
 
+// KeyFor returns the key under which u is stored in the manifest. It is
+// normalized with the URLNormalizer, and never includes the signature of a
+// presigned URL, see secrets.ScrubURL.
+func (f *File) KeyFor(u *url.URL) string {
+	return secrets.ScrubURL(f.options.URLNormalizer.Normalize(u))
+}
+
 func (f *File) SkipSave(u *url.URL) bool {
-	return f.options.NoCache.Match(u.Redacted())
+	return f.options.NoCache.Match(f.KeyFor(u))
 }
 
 func (f *File) GetBlob(u *url.URL) (BlobInfo, bool, error) {
-	k := u.Redacted()
+	k := f.KeyFor(u)
 
 	// if we don't want to cache it, stop early
 	if f.options.NoCache.Match(k) {
@@ -118,9 +142,10 @@ func (f *File) GetBlob(u *url.URL) (BlobInfo, bool, error) {
 	rv, ok = f.previousBlobs[k]
 	if ok {
 		if err := f.internalAddBlob(k, rv); err != nil {
-			logrus.Infof("Found (previous run): %s", k)
 			return BlobInfo{}, false, fmt.Errorf("error storing previously cached blob info: %w", err)
 		}
+		logrus.Infof("Found (previous run): %s", k)
+		f.reused[k] = true
 		return rv, true, nil
 	}
 
@@ -129,7 +154,9 @@ func (f *File) GetBlob(u *url.URL) (BlobInfo, bool, error) {
 }
 
 func (f *File) AddBlob(u *url.URL, info BlobInfo) error {
-	k := u.Redacted()
+	k := f.KeyFor(u)
+	info.Headers = withoutSensitiveHeaders(info.Headers)
+	info.Unfetchable = k != u.String()
 
 	if f.options.NoCache.Match(k) {
 		return nil
@@ -153,12 +180,12 @@ func (f *File) internalAddBlob(k string, info BlobInfo) error {
 	}
 	f.blobs[k] = info
 	f.dirty = true
-	return f.save(false)
+	return f.journalChange(journalEntry{Op: journalAdd, Key: k, Value: &info})
 }
 
 // remove from us only with no regard to fallback
 func (f *File) RemoveEntry(u *url.URL) error {
-	k := u.Redacted()
+	k := f.KeyFor(u)
 
 	if f.options.NoCache.Match(k) {
 		return nil
@@ -174,7 +201,7 @@ func (f *File) RemoveEntry(u *url.URL) error {
 
 	delete(f.blobs, k)
 	f.dirty = true
-	return f.save(false)
+	return f.journalChange(journalEntry{Op: journalRemove, Key: k})
 }
 
 func (f *File) Reset(forgetBlobs bool) error {
@@ -223,6 +250,80 @@ func (f *File) ForEach(cb func(k *url.URL, v BlobInfo) error) error {
 	return nil
 }
 
+// FindBySha256 returns an entry whose content has the given SHA256 (in hex), if there is one
+func (f *File) FindBySha256(sha256 string) (BlobInfo, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, v := range f.blobs {
+		if v.Sha256 == sha256 {
+			return v, true
+		}
+	}
+	return BlobInfo{}, false
+}
+
+// ChangeReport describes how the current entries differ from those
+// loaded from disk when the file was opened. All lists are sorted.
+type ChangeReport struct {
+	Reused    []string // restored from the previous run without going upstream
+	Added     []string // not present before
+	Changed   []string // present before, with a different value
+	Refetched []string // fetched again, with the same value as before
+	Dropped   []string // present before, but not requested this time
+}
+
+// Drifted returns true if the set of entries, or any of their values, has changed.
+func (cr *ChangeReport) Drifted() bool {
+	return len(cr.Added) != 0 || len(cr.Changed) != 0 || len(cr.Dropped) != 0
+}
+
+func (f *File) Changes() *ChangeReport {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	rv := &ChangeReport{}
+	for k, v := range f.blobs {
+		v0, ok := f.loadedBlobs[k]
+		switch {
+		case !ok:
+			rv.Added = append(rv.Added, k) // including those recovered from a journal, then reused
+		case f.reused[k]:
+			rv.Reused = append(rv.Reused, k)
+		case !blobEquals(v0, v):
+			rv.Changed = append(rv.Changed, k)
+		default:
+			rv.Refetched = append(rv.Refetched, k)
+		}
+	}
+	for k := range f.loadedBlobs {
+		if _, ok := f.blobs[k]; !ok {
+			rv.Dropped = append(rv.Dropped, k)
+		}
+	}
+	for _, l := range [][]string{rv.Reused, rv.Added, rv.Changed, rv.Refetched, rv.Dropped} {
+		slices.Sort(l)
+	}
+	return rv
+}
+
+// Len returns the number of entries currently in the manifest
+func (f *File) Len() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return len(f.blobs)
+}
+
+// Flush writes the file out now, rather than waiting for Close()
+// no-op if read-only
+func (f *File) Flush() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.save(true)
+}
+
 // writes file out, releases any locks we have
 // ok to call if read-only
 func (f *File) Close() (retErr error) {
@@ -231,10 +332,32 @@ func (f *File) Close() (retErr error) {
 	}
 
 	defer func() {
-		if err := f.lock.Unlock(); err != nil && retErr == nil {
+		if err := f.unlock(); err != nil && retErr == nil {
 			retErr = err
 		}
-		if err := os.Remove(f.lockPath); err != nil && retErr == nil {
+	}()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.save(true); err != nil {
+		return err
+	}
+
+	// if there were no changes, there may still be a journal we recovered from
+	return f.removeJournal()
+}
+
+// Discard closes the file without saving any changes, and removes the journal of them,
+// so that the file is left as it was. A journal recovered from an earlier run is also
+// removed, as its changes were never saved either.
+func (f *File) Discard() (retErr error) {
+	if !f.options.Writable {
+		return nil
+	}
+
+	defer func() {
+		if err := f.unlock(); err != nil && retErr == nil {
 			retErr = err
 		}
 	}()
@@ -242,7 +365,28 @@ func (f *File) Close() (retErr error) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	return f.save(true)
+	f.dirty = false
+	return f.removeJournal()
+}
+
+func (f *File) unlock() error {
+	if f.journal != nil {
+		f.journal.Close() // only if we failed to save, in which case we want to keep it
+		f.journal = nil
+	}
+	if err := f.lock.Unlock(); err != nil {
+		return err
+	}
+	return os.Remove(f.lockPath)
+}
+
+// journalChange records a change that will be written out on the next full save
+// caller must get mutex
+func (f *File) journalChange(je journalEntry) error {
+	if !f.options.Writable {
+		return fmt.Errorf("%s is not writable! should not get here", f.options.Path)
+	}
+	return f.appendJournal(je)
 }
 
 // caller must get mutex
@@ -262,31 +406,160 @@ func (f *File) save(final bool) (retErr error) {
 		return nil
 	}
 
-	bb, err := json.MarshalIndent(f.blobs, "", "  ") // uses the JSON marshaller which docs say will sort keys
+	bb, err := marshalManifest(f.blobs, f.options.Layout)
 	if err != nil {
-		return fmt.Errorf("error marshalling: %w", err)
+		return err
 	}
 
-	if err = os.WriteFile(f.options.Path, bb, 0o666); err != nil {
+	if err = writeFileAtomic(f.options.Path, bb); err != nil {
 		return fmt.Errorf("error writing file: %w", err)
 	}
 
 	f.dirty = false
 
-	return nil
+	// everything in the journal is now in the file
+	return f.removeJournal()
+}
+
+// writeFileAtomic writes to a temp file in the same directory, and renames it
+// into place, so that readers never see a partially written file, and a crash
+// leaves either the old or new contents. The mode of any existing file is kept.
+func writeFileAtomic(path string, bb []byte) (retErr error) {
+	mode := os.FileMode(0o644)
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode().Perm()
+	}
+
+	dir := filepath.Dir(path)
+	tf, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if retErr != nil {
+			tf.Close()
+			os.Remove(tf.Name())
+		}
+	}()
+	if _, err := tf.Write(bb); err != nil {
+		return err
+	}
+	if err := tf.Chmod(mode); err != nil {
+		return err
+	}
+	if err := tf.Sync(); err != nil {
+		return err
+	}
+	if err := tf.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tf.Name(), path); err != nil {
+		return err
+	}
+
+	// and make sure the rename itself is persisted
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// rekey re-keys entries with KeyFor, and drops cached headers that may include
+// credentials, e.g. as written by an earlier version or with different URL
+// normalization options. Returns true if any changed. If entries with different
+// content now have the same key, it fails rather than guess which to keep.
+// caller must get mutex
+func (f *File) rekey() (bool, error) {
+	changed := false
+	for _, k := range slices.Sorted(maps.Keys(f.blobs)) {
+		v := f.blobs[k]
+		nk := k
+		if u, err := url.Parse(k); err == nil {
+			nk = f.KeyFor(u)
+		}
+		nv := BlobInfo{
+			Sha256:      v.Sha256,
+			Headers:     withoutSensitiveHeaders(v.Headers),
+			Unfetchable: v.Unfetchable || nk != k,
+		}
+		if nk == k && blobEquals(v, nv) {
+			continue
+		}
+		if !maps.Equal(v.Headers, nv.Headers) {
+			logrus.Warnf("removed credentials from manifest entry: %s", nk)
+		}
+		changed = true
+		delete(f.blobs, k)
+		if existing, ok := f.blobs[nk]; ok && nk != k {
+			if existing.Sha256 != nv.Sha256 {
+				return false, fmt.Errorf("manifest entries with different content would have the same key %s, remove one or change the URL normalization options: %s", nk, secrets.RedactURLString(k))
+			}
+			logrus.Infof("merged manifest entry with the same content: %s -> %s", secrets.RedactURLString(k), nk)
+			continue
+		}
+		if nk != k {
+			logrus.Infof("re-keyed manifest entry: %s -> %s", secrets.RedactURLString(k), nk)
+		}
+		f.blobs[nk] = nv
+	}
+	return changed, nil
+}
+
+func withoutSensitiveHeaders(headers map[string]string) map[string]string {
+	if headers == nil {
+		return nil
+	}
+	rv := make(map[string]string, len(headers))
+	for k, v := range headers {
+		if !secrets.IsSensitiveHeader(k) {
+			rv[k] = v
+		}
+	}
+	return rv
 }
 
 // caller must get mutex
 func (f *File) load() (retErr error) {
 	logrus.Infof("loading assets file from: %s", f.options.Path)
 	f.blobs = make(blobMap)
+	f.reused = make(map[string]bool)
 	bb, err := os.ReadFile(f.options.Path)
-	if err != nil {
-		if errors.Is(err, os.ErrNotExist) && f.options.Writable {
+	switch {
+	case errors.Is(err, os.ErrNotExist) && f.options.Writable:
+		f.dirty = true
+	case err != nil:
+		return fmt.Errorf("error opening map: %w", err)
+	default:
+		if err := json.Unmarshal(bb, &f.blobs); err != nil {
+			return err
+		}
+		changed, err := f.rekey()
+		if err != nil {
+			return err
+		}
+		if changed && f.options.Writable {
 			f.dirty = true
-			return nil
 		}
-		return fmt.Errorf("error opening map: %w", err)
 	}
-	return json.Unmarshal(bb, &f.blobs)
+	f.loadedBlobs = maps.Clone(f.blobs)
+
+	jp := journalPath(f.options.Path)
+	if !f.options.Writable {
+		if _, err := os.Stat(jp); err == nil {
+			logrus.Warnf("ignoring %s left by an interrupted run, open the manifest for writing (e.g. htvend build) to recover it", jp)
+		}
+		return nil
+	}
+
+	n, err := replayJournal(jp, f.blobs)
+	if err != nil {
+		return fmt.Errorf("error recovering from %s: %w", jp, err)
+	}
+	if n != 0 {
+		logrus.Warnf("recovered %d changes from %s left by an interrupted run", n, jp)
+		f.dirty = true
+	}
+	return nil
 }
@@ -0,0 +1,121 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	dnsHeaderLen = 12
+	dnsTypeA     = 1
+	dnsClassIN   = 1
+	dnsTTL       = 60
+)
+
+var errBadDNSQuery = errors.New("bad DNS query")
+
+// ServeDNS answers every A query received on pc with addr, and every other query with no records,
+// until ctx is done. This is enough to make clients connect to us, whatever name they look up.
+func ServeDNS(ctx context.Context, pc net.PacketConn, addr net.IP) error {
+	go func() {
+		<-ctx.Done()
+		pc.Close()
+	}()
+
+	buf := make([]byte, 512)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		resp, err := dnsAnswer(buf[:n], addr)
+		if err != nil {
+			logrus.Debugf("ignoring DNS query from %s: %v", from, err)
+			continue
+		}
+		if _, err := pc.WriteTo(resp, from); err != nil {
+			logrus.Debugf("error sending DNS response to %s: %v", from, err)
+		}
+	}
+}
+
+// dnsAnswer makes a response to a query with a single question
+func dnsAnswer(query []byte, addr net.IP) ([]byte, error) {
+	ip4 := addr.To4()
+	if ip4 == nil {
+		return nil, errors.New("only IPv4 addresses are supported")
+	}
+	if len(query) < dnsHeaderLen {
+		return nil, errBadDNSQuery
+	}
+	flags := binary.BigEndian.Uint16(query[2:])
+	if flags&0x8000 != 0 || binary.BigEndian.Uint16(query[4:]) != 1 {
+		return nil, errBadDNSQuery // a response, or not exactly one question
+	}
+
+	// skip the name, which in a query is never compressed
+	i := dnsHeaderLen
+	for {
+		if i >= len(query) {
+			return nil, errBadDNSQuery
+		}
+		l := int(query[i])
+		if l&0xc0 != 0 {
+			return nil, errBadDNSQuery
+		}
+		i += 1 + l
+		if l == 0 {
+			break
+		}
+	}
+	if i+4 > len(query) {
+		return nil, errBadDNSQuery
+	}
+	qtype, qclass := binary.BigEndian.Uint16(query[i:]), binary.BigEndian.Uint16(query[i+2:])
+	question := query[dnsHeaderLen : i+4]
+
+	var answers uint16
+	if qtype == dnsTypeA && qclass == dnsClassIN {
+		answers = 1
+	}
+
+	resp := make([]byte, 0, dnsHeaderLen+len(question)+16)
+	resp = append(resp, query[0], query[1]) // ID
+	// response, same opcode, authoritative, same recursion desired, recursion available, no error
+	resp = binary.BigEndian.AppendUint16(resp, 0x8000|flags&0x7800|0x0400|flags&0x0100|0x0080)
+	resp = binary.BigEndian.AppendUint16(resp, 1)
+	resp = binary.BigEndian.AppendUint16(resp, answers)
+	resp = binary.BigEndian.AppendUint16(resp, 0)
+	resp = binary.BigEndian.AppendUint16(resp, 0)
+	resp = append(resp, question...)
+	if answers != 0 {
+		resp = binary.BigEndian.AppendUint16(resp, 0xc000|dnsHeaderLen) // pointer to name in question
+		resp = binary.BigEndian.AppendUint16(resp, dnsTypeA)
+		resp = binary.BigEndian.AppendUint16(resp, dnsClassIN)
+		resp = binary.BigEndian.AppendUint32(resp, dnsTTL)
+		resp = binary.BigEndian.AppendUint16(resp, 4)
+		resp = append(resp, ip4...)
+	}
+	return resp, nil
+}
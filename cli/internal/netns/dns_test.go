@@ -0,0 +1,60 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// query for example.com with recursion desired
+func makeQuery(qtype byte) []byte {
+	return append([]byte{
+		0x12, 0x34, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0,
+	}, 0, qtype, 0, 1)
+}
+
+func TestDNSAnswerA(t *testing.T) {
+	resp, err := dnsAnswer(makeQuery(1), net.ParseIP("127.0.0.1"))
+	require.NoError(t, err)
+
+	assert.Equal(t, []byte{0x12, 0x34, 0x85, 0x80, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00}, resp[:12])
+	assert.Equal(t, makeQuery(1)[12:], resp[12:29])
+	assert.Equal(t, []byte{0xc0, 0x0c, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 127, 0, 0, 1}, resp[29:])
+}
+
+func TestDNSAnswerAAAA(t *testing.T) {
+	resp, err := dnsAnswer(makeQuery(28), net.ParseIP("127.0.0.1"))
+	require.NoError(t, err)
+
+	// no answers, and no error
+	assert.Equal(t, []byte{0x12, 0x34, 0x85, 0x80, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, resp[:12])
+	assert.Len(t, resp, 29)
+}
+
+func TestDNSAnswerBad(t *testing.T) {
+	for _, q := range [][]byte{
+		nil,
+		makeQuery(1)[:20],
+		append([]byte{0x12, 0x34, 0x81, 0x80}, makeQuery(1)[4:]...), // a response
+	} {
+		_, err := dnsAnswer(q, net.ParseIP("127.0.0.1"))
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netns
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Forward accepts connections on l until ctx is done, and copies data in both directions between
+// each and a new connection made by dial. l is closed before returning.
+func Forward(ctx context.Context, l net.Listener, dial func(ctx context.Context) (net.Conn, error)) error {
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		src, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer src.Close()
+
+			dst, err := dial(ctx)
+			if err != nil {
+				logrus.Warnf("error connecting to forward %s: %v", l.Addr(), err)
+				return
+			}
+			defer dst.Close()
+
+			// don't hold up shutdown for idle connections
+			finished := make(chan struct{})
+			defer close(finished)
+			go func() {
+				select {
+				case <-ctx.Done():
+					src.Close()
+					dst.Close()
+				case <-finished:
+				}
+			}()
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				io.Copy(dst, src)
+				closeWrite(dst)
+			}()
+			io.Copy(src, dst)
+			closeWrite(src)
+			<-done
+		}()
+	}
+}
+
+// closeWrite half-closes c if it supports it, so that the other end sees EOF
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package netns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	capNetBindService = 10
+	capNetAdmin       = 12
+
+	prCapAmbient         = 47
+	prCapAmbientClearAll = 4
+)
+
+// Supported is true if this platform can isolate sub-processes
+const Supported = true
+
+// SysProcAttr returns attributes that start a process in a new user and network namespace.
+// The current user and group are mapped to themselves, and CAP_NET_ADMIN and CAP_NET_BIND_SERVICE
+// are kept across exec so that the process can set up the network.
+func SysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNET,
+		UidMappings: []syscall.SysProcIDMap{
+			{ContainerID: os.Getuid(), HostID: os.Getuid(), Size: 1},
+		},
+		GidMappings: []syscall.SysProcIDMap{
+			{ContainerID: os.Getgid(), HostID: os.Getgid(), Size: 1},
+		},
+		AmbientCaps: []uintptr{capNetAdmin, capNetBindService},
+	}
+}
+
+// ChildSysProcAttr returns attributes for a process started from within the namespace,
+// so that it is killed if we are.
+func ChildSysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{
+		Pdeathsig: syscall.SIGKILL,
+	}
+}
+
+// ifreq is struct ifreq from <net/if.h>, with the flags member of the union
+type ifreq struct {
+	Name  [syscall.IFNAMSIZ]byte
+	Flags uint16
+	_     [22]byte
+}
+
+// SetupLoopback brings up the loopback interface, which starts down in a new network namespace
+func SetupLoopback() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("error opening socket: %w", err)
+	}
+	defer syscall.Close(fd)
+
+	var ifr ifreq
+	copy(ifr.Name[:], "lo")
+	if err := ioctl(fd, syscall.SIOCGIFFLAGS, &ifr); err != nil {
+		return fmt.Errorf("error getting loopback flags: %w", err)
+	}
+	ifr.Flags |= syscall.IFF_UP
+	if err := ioctl(fd, syscall.SIOCSIFFLAGS, &ifr); err != nil {
+		return fmt.Errorf("error bringing loopback up: %w", err)
+	}
+	return nil
+}
+
+func ioctl(fd int, req uintptr, ifr *ifreq) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), req, uintptr(unsafe.Pointer(ifr))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// RouteAllToLoopback adds a route which makes every IPv4 address local, so that connections
+// to anywhere arrive at listeners on 0.0.0.0. Equivalent to: ip route add local 0.0.0.0/0 dev lo
+func RouteAllToLoopback() error {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		return fmt.Errorf("error finding loopback interface: %w", err)
+	}
+
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return fmt.Errorf("error opening netlink socket: %w", err)
+	}
+	defer syscall.Close(fd)
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return fmt.Errorf("error binding netlink socket: %w", err)
+	}
+
+	const msgLen = syscall.SizeofNlMsghdr + syscall.SizeofRtMsg + syscall.SizeofRtAttr + 4
+	msg := make([]byte, 0, msgLen)
+	msg = binary.NativeEndian.AppendUint32(msg, msgLen)
+	msg = binary.NativeEndian.AppendUint16(msg, syscall.RTM_NEWROUTE)
+	msg = binary.NativeEndian.AppendUint16(msg, syscall.NLM_F_REQUEST|syscall.NLM_F_ACK|syscall.NLM_F_CREATE|syscall.NLM_F_EXCL)
+	msg = binary.NativeEndian.AppendUint32(msg, 1) // seq
+	msg = binary.NativeEndian.AppendUint32(msg, 0) // pid
+	msg = append(msg,
+		syscall.AF_INET,
+		0, // dst len, i.e. 0.0.0.0/0
+		0, // src len
+		0, // tos
+		syscall.RT_TABLE_LOCAL,
+		syscall.RTPROT_BOOT,
+		syscall.RT_SCOPE_HOST,
+		syscall.RTN_LOCAL,
+	)
+	msg = binary.NativeEndian.AppendUint32(msg, 0) // flags
+	msg = binary.NativeEndian.AppendUint16(msg, syscall.SizeofRtAttr+4)
+	msg = binary.NativeEndian.AppendUint16(msg, syscall.RTA_OIF)
+	msg = binary.NativeEndian.AppendUint32(msg, uint32(lo.Index))
+
+	if err := syscall.Sendto(fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return fmt.Errorf("error sending netlink message: %w", err)
+	}
+
+	// wait for the ack, which is an error message with an error of 0 if all is well
+	buf := make([]byte, 4096)
+	n, _, err := syscall.Recvfrom(fd, buf, 0)
+	if err != nil {
+		return fmt.Errorf("error reading netlink reply: %w", err)
+	}
+	msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+	if err != nil {
+		return fmt.Errorf("error parsing netlink reply: %w", err)
+	}
+	for _, m := range msgs {
+		if m.Header.Type == syscall.NLMSG_ERROR && len(m.Data) >= 4 {
+			if errno := -int32(binary.NativeEndian.Uint32(m.Data)); errno != 0 {
+				return fmt.Errorf("error adding route: %w", syscall.Errno(errno))
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("no ack received when adding route")
+}
+
+// DropAmbientCaps clears ambient capabilities for the calling goroutine, which stays locked
+// to its thread, so that any process it starts does not inherit them.
+func DropAmbientCaps() error {
+	runtime.LockOSThread()
+	if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prCapAmbient, prCapAmbientClearAll, 0, 0, 0, 0); errno != 0 {
+		return fmt.Errorf("error clearing ambient capabilities: %w", errno)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+
+package netns
+
+import (
+	"errors"
+	"syscall"
+)
+
+// Supported is true if this platform can isolate sub-processes
+const Supported = false
+
+var errNotSupported = errors.New("network isolation is only supported on Linux")
+
+func SysProcAttr() *syscall.SysProcAttr {
+	return nil
+}
+
+func ChildSysProcAttr() *syscall.SysProcAttr {
+	return nil
+}
+
+func SetupLoopback() error {
+	return errNotSupported
+}
+
+func RouteAllToLoopback() error {
+	return errNotSupported
+}
+
+func DropAmbientCaps() error {
+	return errNotSupported
+}
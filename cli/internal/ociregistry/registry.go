@@ -0,0 +1,268 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ociregistry serves the read side of the OCI Distribution API from a
+// manifest, for images that were pulled from upstream registries via the proxy.
+package ociregistry
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/continusec/htvend/internal/blobstore"
+	"github.com/continusec/htvend/internal/imageref"
+	"github.com/continusec/htvend/internal/lockfile"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	sha256DigestRegex = regexp.MustCompile("^sha256:([0-9a-f]{64})$")
+)
+
+const (
+	maxManifestSize     = 4 << 20
+	defaultManifestType = "application/vnd.oci.image.manifest.v1+json"
+)
+
+// WithManifest calls cb with the manifest and blob store to serve from. They
+// must remain open until cb returns.
+type WithManifest func(cb func(assets *lockfile.File, blobs blobstore.Store) error) error
+
+type Options struct {
+	// Registry for names that don't start with one, e.g. docker.io
+	DefaultRegistry string
+
+	WithManifest WithManifest
+}
+
+type handler struct {
+	opts Options
+}
+
+// NewHandler returns a handler for /v2/ requests. Repository names may start with
+// the upstream registry host, e.g. ghcr.io/org/img, else DefaultRegistry is used.
+func NewHandler(opts Options) http.Handler {
+	return &handler{opts: opts}
+}
+
+// Upstream returns the URL prefix of the upstream repository for name, e.g.
+// alpine is https://registry-1.docker.io/v2/library/alpine
+func Upstream(name, defaultRegistry string) string {
+	if !imageref.HasDomain(name) {
+		name = defaultRegistry + "/" + name
+	}
+	domain, repo := imageref.SplitDomain(name)
+	return imageref.Reference{Domain: domain, Repository: repo}.RepositoryURL()
+}
+
+// registryError is the error format of the distribution API
+type registryError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string][]registryError{
+		"errors": {{Code: code, Message: message}},
+	})
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "this registry is read-only")
+		return
+	}
+
+	p, ok := strings.CutPrefix(r.URL.Path, "/v2/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	var err error
+	switch {
+	case p == "":
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}\n"))
+	case strings.HasSuffix(p, "/tags/list"):
+		err = h.serveTags(w, strings.TrimSuffix(p, "/tags/list"))
+	case strings.Contains(p, "/manifests/"):
+		i := strings.LastIndex(p, "/manifests/")
+		err = h.serveManifest(w, r, p[:i], p[i+len("/manifests/"):])
+	case strings.Contains(p, "/blobs/"):
+		i := strings.LastIndex(p, "/blobs/")
+		err = h.serveBlob(w, r, p[:i], p[i+len("/blobs/"):])
+	default:
+		writeError(w, http.StatusNotFound, "UNSUPPORTED", "unsupported request")
+	}
+	if err != nil {
+		logrus.Warnf("error handling registry request (%s): %v", r.URL.Path, err)
+		writeError(w, http.StatusInternalServerError, "UNKNOWN", "see htvend log for details")
+	}
+}
+
+// lookup finds the entry for the upstream URL, else for a digest, any entry with the same content
+func lookup(assets *lockfile.File, u, digest string) (lockfile.BlobInfo, bool, error) {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return lockfile.BlobInfo{}, false, fmt.Errorf("error parsing upstream URL: %w", err)
+	}
+	bi, found, err := assets.GetBlob(pu)
+	if err != nil || found {
+		return bi, found, err
+	}
+	if m := sha256DigestRegex.FindStringSubmatch(digest); m != nil {
+		bi, found = assets.FindBySha256(m[1])
+	}
+	return bi, found, nil
+}
+
+func openBlob(blobs blobstore.Store, bi lockfile.BlobInfo) (io.ReadCloser, error) {
+	k, err := hex.DecodeString(bi.Sha256)
+	if err != nil {
+		return nil, fmt.Errorf("bad hex key: %w", err)
+	}
+	return blobs.Get(k)
+}
+
+func (h *handler) serveManifest(w http.ResponseWriter, r *http.Request, name, ref string) error {
+	return h.opts.WithManifest(func(assets *lockfile.File, blobs blobstore.Store) error {
+		bi, found, err := lookup(assets, Upstream(name, h.opts.DefaultRegistry)+"/manifests/"+ref, ref)
+		if err != nil {
+			return err
+		}
+		if !found {
+			writeError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest not in htvend manifest: "+name+":"+ref)
+			return nil
+		}
+
+		br, err := openBlob(blobs, bi)
+		if err != nil {
+			return fmt.Errorf("error opening blob: %w", err)
+		}
+		defer br.Close()
+		bb, err := io.ReadAll(io.LimitReader(br, maxManifestSize+1))
+		if err != nil {
+			return fmt.Errorf("error reading manifest: %w", err)
+		}
+		if len(bb) > maxManifestSize {
+			return fmt.Errorf("manifest is larger than %d bytes", maxManifestSize)
+		}
+
+		contentType := bi.Headers["Content-Type"]
+		if contentType == "" {
+			var mt struct {
+				MediaType string `json:"mediaType"`
+			}
+			if json.Unmarshal(bb, &mt) == nil && mt.MediaType != "" {
+				contentType = mt.MediaType
+			} else {
+				contentType = defaultManifestType
+			}
+		}
+		digest := sha256.Sum256(bb)
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(bb)))
+		w.Header().Set("Docker-Content-Digest", "sha256:"+hex.EncodeToString(digest[:]))
+		if r.Method == http.MethodHead {
+			return nil
+		}
+		_, err = io.Copy(w, bytes.NewReader(bb))
+		return err
+	})
+}
+
+func (h *handler) serveBlob(w http.ResponseWriter, r *http.Request, name, digest string) error {
+	if !sha256DigestRegex.MatchString(digest) {
+		writeError(w, http.StatusBadRequest, "DIGEST_INVALID", "only sha256 digests are supported: "+digest)
+		return nil
+	}
+	return h.opts.WithManifest(func(assets *lockfile.File, blobs blobstore.Store) error {
+		bi, found, err := lookup(assets, Upstream(name, h.opts.DefaultRegistry)+"/blobs/"+digest, digest)
+		if err != nil {
+			return err
+		}
+		if !found || "sha256:"+bi.Sha256 != digest {
+			// don't serve an entry that differs from the digest asked for, e.g. if it was captured gzipped
+			writeError(w, http.StatusNotFound, "BLOB_UNKNOWN", "blob not in htvend manifest: "+digest)
+			return nil
+		}
+
+		br, err := openBlob(blobs, bi)
+		if err != nil {
+			if errors.Is(err, blobstore.ErrBlobNotExist) {
+				writeError(w, http.StatusNotFound, "BLOB_UNKNOWN", "blob missing from blob store: "+digest)
+				return nil
+			}
+			return fmt.Errorf("error opening blob: %w", err)
+		}
+		defer br.Close()
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Docker-Content-Digest", digest)
+		if cl := bi.Headers["Content-Length"]; cl != "" {
+			w.Header().Set("Content-Length", cl)
+		}
+		if r.Method == http.MethodHead {
+			if w.Header().Get("Content-Length") == "" {
+				n, err := io.Copy(io.Discard, br)
+				if err != nil {
+					return fmt.Errorf("error reading blob: %w", err)
+				}
+				w.Header().Set("Content-Length", strconv.FormatInt(n, 10))
+			}
+			return nil
+		}
+		_, err = io.Copy(w, br)
+		return err
+	})
+}
+
+// serveTags lists the tags of name that we have manifests for
+func (h *handler) serveTags(w http.ResponseWriter, name string) error {
+	prefix := Upstream(name, h.opts.DefaultRegistry) + "/manifests/"
+	tags := []string{}
+	if err := h.opts.WithManifest(func(assets *lockfile.File, blobs blobstore.Store) error {
+		return assets.ForEach(func(k *url.URL, v lockfile.BlobInfo) error {
+			if ref, ok := strings.CutPrefix(k.String(), prefix); ok && !strings.Contains(ref, ":") {
+				tags = append(tags, ref)
+			}
+			return nil
+		})
+	}); err != nil {
+		return err
+	}
+	slices.Sort(tags)
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(map[string]any{
+		"name": name,
+		"tags": tags,
+	})
+}
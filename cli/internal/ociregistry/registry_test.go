@@ -0,0 +1,144 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociregistry
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/continusec/htvend/internal/blobstore"
+	"github.com/continusec/htvend/internal/blobstore/directory"
+	"github.com/continusec/htvend/internal/lockfile"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstream(t *testing.T) {
+	for name, expected := range map[string]string{
+		"alpine":                      "https://registry-1.docker.io/v2/library/alpine",
+		"library/alpine":              "https://registry-1.docker.io/v2/library/alpine",
+		"rancher/klipper-lb":          "https://registry-1.docker.io/v2/rancher/klipper-lb",
+		"docker.io/alpine":            "https://registry-1.docker.io/v2/library/alpine",
+		"ghcr.io/org/team/img":        "https://ghcr.io/v2/org/team/img",
+		"localhost:5001/foo":          "https://localhost:5001/v2/foo",
+		"registry.k8s.io/pause":       "https://registry.k8s.io/v2/pause",
+		"index.docker.io/library/foo": "https://registry-1.docker.io/v2/library/foo",
+	} {
+		assert.Equal(t, expected, Upstream(name, "docker.io"), name)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	dir := t.TempDir()
+	blobs := directory.NewDirectoryStore(filepath.Join(dir, "blobs"), true)
+	assets, err := lockfile.NewMapFile(lockfile.MapFileOptions{Path: filepath.Join(dir, "assets.json"), Writable: true})
+	require.NoError(t, err)
+	defer assets.Close()
+
+	put := func(u string, contents string, headers map[string]string) string {
+		caf, err := blobs.Put()
+		require.NoError(t, err)
+		_, err = io.WriteString(caf, contents)
+		require.NoError(t, err)
+		h, err := caf.Commit()
+		require.NoError(t, err)
+		pu, err := url.Parse(u)
+		require.NoError(t, err)
+		require.NoError(t, assets.AddBlob(pu, lockfile.BlobInfo{Sha256: hex.EncodeToString(h), Headers: headers}))
+		return "sha256:" + hex.EncodeToString(h)
+	}
+
+	manifest := `{"mediaType":"application/vnd.oci.image.manifest.v1+json"}`
+	manifestDigest := put("https://registry-1.docker.io/v2/library/alpine/manifests/3.20", manifest, map[string]string{"Content-Type": "application/vnd.oci.image.manifest.v1+json"})
+	put("https://registry-1.docker.io/v2/library/alpine/manifests/"+manifestDigest, manifest, nil)
+	put("https://registry-1.docker.io/v2/library/alpine/manifests/3.19", manifest, nil)
+	// Docker Hub redirects blobs elsewhere, so we only have them under another URL
+	layerDigest := put("https://production.cloudflare.docker.com/registry-v2/docker/registry/v2/blobs/sha256/xx/data", "layer", nil)
+
+	server := httptest.NewServer(NewHandler(Options{
+		DefaultRegistry: "docker.io",
+		WithManifest: func(cb func(assets *lockfile.File, blobs blobstore.Store) error) error {
+			return cb(assets, blobs)
+		},
+	}))
+	defer server.Close()
+
+	do := func(method, path string) (*http.Response, string) {
+		req, err := http.NewRequest(method, server.URL+path, nil)
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		bb, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(bb)
+	}
+
+	resp, _ := do(http.MethodGet, "/v2/")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// by tag, and by digest, with and without library/
+	for _, path := range []string{"/v2/library/alpine/manifests/3.20", "/v2/alpine/manifests/" + manifestDigest} {
+		resp, body := do(http.MethodGet, path)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, path)
+		assert.Equal(t, manifest, body)
+		assert.Equal(t, manifestDigest, resp.Header.Get("Docker-Content-Digest"))
+		assert.Equal(t, "application/vnd.oci.image.manifest.v1+json", resp.Header.Get("Content-Type"))
+	}
+
+	resp, body := do(http.MethodHead, "/v2/alpine/manifests/3.20")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, manifestDigest, resp.Header.Get("Docker-Content-Digest"))
+	assert.Equal(t, "", body)
+
+	resp, _ = do(http.MethodGet, "/v2/alpine/manifests/latest")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, body = do(http.MethodGet, "/v2/alpine/blobs/"+layerDigest)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "layer", body)
+
+	resp, body = do(http.MethodHead, "/v2/alpine/blobs/"+layerDigest)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "5", resp.Header.Get("Content-Length"))
+	assert.Equal(t, "", body)
+
+	missing := sha256.Sum256([]byte("missing"))
+	resp, _ = do(http.MethodGet, "/v2/alpine/blobs/sha256:"+hex.EncodeToString(missing[:]))
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, _ = do(http.MethodGet, "/v2/alpine/blobs/md5:abc")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, body = do(http.MethodGet, "/v2/alpine/tags/list")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `{"name":"alpine","tags":["3.19","3.20"]}`, body)
+
+	resp, _ = do(http.MethodPut, "/v2/alpine/manifests/3.20")
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	// rather than serving a truncated one
+	put("https://registry-1.docker.io/v2/library/alpine/manifests/huge", strings.Repeat(" ", maxManifestSize+1), nil)
+	resp, body = do(http.MethodGet, "/v2/alpine/manifests/huge")
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	assert.NotContains(t, body, "    ")
+}
@@ -32,6 +32,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"sync"
 	"syscall"
 	"time"
 
@@ -42,6 +43,22 @@ type ProxyServerConfig struct {
 	HttpListenAddr  string
 	HttpsListenAddr string
 
+	// Additional addresses for the main proxy server to listen on. ClientInfo.ListenAddr
+	// reports which of these (or HttpListenAddr) a client connected to.
+	ExtraHttpListenAddrs []string
+
+	// Listeners for connections that were meant for an origin server rather than for a proxy, e.g.
+	// redirected from ports 80 and 443. TLS connections are served using SNI to pick the host,
+	// others using the Host header. These are closed when ServeUntilDone returns.
+	TransparentListeners []net.Listener
+
+	// If set, also accept SOCKS5 connections on this address. These are served like
+	// TransparentListeners, once the SOCKS handshake is done.
+	SocksListenAddr string
+
+	// If set, only negotiate HTTP/1.1 with clients
+	DisableHTTP2 bool
+
 	TlsCertPath          string
 	TlsKeyPath           string
 	TlsGenerateIfMissing bool
@@ -56,6 +73,74 @@ type httpServer struct {
 	ca         *x509.Certificate
 	caPEM      []byte
 	tlsAddr    string
+
+	// local address of the connection to tlsAddr -> *ClientInfo, for the lifetime of each CONNECT tunnel
+	tunnels sync.Map
+}
+
+// ClientInfo describes the proxy request that a client made to us
+type ClientInfo struct {
+	// ListenAddr is the configured listen address that the client connected to
+	ListenAddr string
+
+	// Header has the headers from the proxy request. For HTTPS this is the CONNECT request
+	// rather than the request inside the tunnel.
+	Header http.Header
+
+	// Username is set if the client authenticated to our SOCKS5 listener
+	Username string
+}
+
+// ServerInfo tells the child process how to reach the proxy
+type ServerInfo struct {
+	// ProxyAddr is the host:port of the HTTP proxy
+	ProxyAddr string
+
+	// SocksAddr is the host:port of the SOCKS5 proxy, if enabled
+	SocksAddr string
+
+	// CAPem is the CA cert that clients must trust
+	CAPem []byte
+}
+
+type clientInfoKey struct{}
+
+// ClientInfoFromContext returns the ClientInfo for a request passed to a ProxyServerConfig Handler.
+func ClientInfoFromContext(ctx context.Context) (*ClientInfo, bool) {
+	ci, ok := ctx.Value(clientInfoKey{}).(*ClientInfo)
+	return ci, ok
+}
+
+// WithClientInfo returns a copy of ctx carrying ci, as the proxy server passes to its Handler.
+func WithClientInfo(ctx context.Context, ci *ClientInfo) context.Context {
+	return context.WithValue(ctx, clientInfoKey{}, ci)
+}
+
+type connTagKey struct{}
+
+// taggedListener remembers which configured address its connections came from
+type taggedListener struct {
+	net.Listener
+	addr string
+}
+
+func (tl *taggedListener) Accept() (net.Conn, error) {
+	c, err := tl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &taggedConn{Conn: c, tag: connTag{addr: tl.addr}}, nil
+}
+
+// connTag is what we know about a connection before any request is read from it
+type connTag struct {
+	addr     string
+	username string
+}
+
+type taggedConn struct {
+	net.Conn
+	tag connTag
 }
 
 func readKeyCert(keyPath, certPath string) (crypto.PrivateKey, *x509.Certificate, error) {
@@ -169,7 +254,7 @@ func (cfg ProxyServerConfig) newSelfSignedServer() (*httpServer, error) {
 	return &rv, nil
 }
 
-func ServeUntilDone(parCtx context.Context, cfg ProxyServerConfig, childProcess func(ctx context.Context, proxyAddr string, caPemBytes []byte) error) (retErr error) {
+func ServeUntilDone(parCtx context.Context, cfg ProxyServerConfig, childProcess func(ctx context.Context, info ServerInfo) error) (retErr error) {
 	s, err := cfg.newSelfSignedServer()
 	if err != nil {
 		return fmt.Errorf("error creating keys for server: %w", err)
@@ -185,37 +270,64 @@ func ServeUntilDone(parCtx context.Context, cfg ProxyServerConfig, childProcess
 		}
 	}()
 
-	// this is the main listener which accepts proxy request, e.g. can
+	// these are the main listeners which accept proxy requests, e.g. can
 	// handle raw HTTP, as well as CONNECT requests
-	list, err := net.Listen("tcp4", s.listenAddr)
-	if err != nil {
-		return fmt.Errorf("error making listener: %w", err)
+	var lists []net.Listener
+	for _, addr := range append([]string{s.listenAddr}, cfg.ExtraHttpListenAddrs...) {
+		l, err := net.Listen("tcp4", addr)
+		if err != nil {
+			return fmt.Errorf("error making listener: %w", err)
+		}
+		defer l.Close()
+		lists = append(lists, &taggedListener{Listener: l, addr: addr})
 	}
-	defer list.Close()
 
-	mainServerErr := make(chan error, 1)
+	// plain HTTP connections from transparent and SOCKS listeners are passed to the main server via this
+	var rawHTTP *connListener
+	if len(cfg.TransparentListeners) != 0 || cfg.SocksListenAddr != "" {
+		rawHTTP = newConnListener(lists[0].Addr())
+		lists = append(lists, rawHTTP)
+	}
+
+	mainServerErr := make(chan error, len(lists))
 	defer func() {
-		if err := <-mainServerErr; err != nil && retErr == nil && !errors.Is(err, http.ErrServerClosed) {
-			retErr = fmt.Errorf("error from main server: %w", err)
+		for range lists {
+			if err := <-mainServerErr; err != nil && retErr == nil && !errors.Is(err, http.ErrServerClosed) {
+				retErr = fmt.Errorf("error from main server: %w", err)
+			}
 		}
 	}()
+	server := &http.Server{
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			if tc, ok := c.(*taggedConn); ok {
+				return context.WithValue(ctx, connTagKey{}, tc.tag)
+			}
+			return ctx
+		},
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tag, _ := r.Context().Value(connTagKey{}).(connTag)
+			ci := &ClientInfo{
+				ListenAddr: tag.addr,
+				Username:   tag.username,
+				Header:     r.Header.Clone(),
+			}
+			if r.Method == http.MethodConnect {
+				s.handleConnect(w, r, ci)
+			} else {
+				cfg.Handler(w, r.WithContext(WithClientInfo(r.Context(), ci)))
+			}
+		}),
+	}
 	go func() {
-		defer close(mainServerErr)
-		server := &http.Server{
-			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				if r.Method == http.MethodConnect {
-					s.handleConnect(w, r)
-				} else {
-					cfg.Handler(w, r)
-				}
-			}),
-		}
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+
+	for _, l := range lists {
 		go func() {
-			<-ctx.Done()
-			server.Shutdown(context.Background())
+			mainServerErr <- server.Serve(l)
 		}()
-		mainServerErr <- server.Serve(list)
-	}()
+	}
 
 	// creates a second listener. This recieves HTTPS request sent by ourselves, to ourself
 	// when handling CONNECT requests. We could probably do this better, but for now, this works
@@ -236,31 +348,61 @@ func ServeUntilDone(parCtx context.Context, cfg ProxyServerConfig, childProcess
 	go func() {
 		defer close(tlsServerErr)
 		server := &http.Server{
-			Handler: http.HandlerFunc(cfg.Handler),
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// find out who made the CONNECT request that this came via
+				if ci, ok := s.tunnels.Load(r.RemoteAddr); ok {
+					r = r.WithContext(WithClientInfo(r.Context(), ci.(*ClientInfo)))
+				}
+				cfg.Handler(w, r)
+			}),
 		}
 		go func() {
 			<-ctx.Done()
 			server.Shutdown(context.Background())
 		}()
+		nextProtos := []string{"h2", "http/1.1"}
+		if cfg.DisableHTTP2 {
+			nextProtos = []string{"http/1.1"}
+		}
 		tlsServerErr <- server.Serve(tls.NewListener(list2, &tls.Config{
 			GetCertificate: s.makeCertFor,
+			NextProtos:     nextProtos,
 		}))
 	}()
 
+	for _, l := range cfg.TransparentListeners {
+		defer l.Close()
+		go s.serveRaw(ctx, l, rawHTTP, s.handleTransparent)
+	}
+
+	var socksAddr string
+	if cfg.SocksListenAddr != "" {
+		l, err := net.Listen("tcp4", cfg.SocksListenAddr)
+		if err != nil {
+			return fmt.Errorf("error making SOCKS listener: %w", err)
+		}
+		defer l.Close()
+		socksAddr = l.Addr().String()
+		go s.serveRaw(ctx, l, rawHTTP, s.handleSocks)
+	}
+
 	defer func() {
 		defer logrus.Debugf("(terminated)")
 		cancel()
 		cancelled = true
 	}()
-	return childProcess(ctx, list.Addr().String(), s.caPEM)
+	return childProcess(ctx, ServerInfo{
+		ProxyAddr: lists[0].Addr().String(),
+		SocksAddr: socksAddr,
+		CAPem:     s.caPEM,
+	})
 }
 
-func (s *httpServer) handleConnect(w http.ResponseWriter, _ *http.Request) {
+func (s *httpServer) handleConnect(w http.ResponseWriter, _ *http.Request, ci *ClientInfo) {
 	if err := func() (retErr error) {
-		// connect to our other server which handles MITM
-		destConn, err := net.DialTimeout("tcp", s.tlsAddr, 10*time.Second)
+		destConn, err := s.dialTLS(ci)
 		if err != nil {
-			return fmt.Errorf("error dialing upstream: %w", err)
+			return err
 		}
 		defer func() {
 			if err := destConn.Close(); err != nil && retErr == nil {
@@ -284,29 +426,7 @@ func (s *httpServer) handleConnect(w http.ResponseWriter, _ *http.Request) {
 			}
 		}()
 
-		// send data to server
-		sendToServerErr := make(chan error, 1)
-		defer func() {
-			// make sure we read this err as that forces us to wait for go func to finish
-			if err := <-sendToServerErr; retErr == nil && err != nil {
-				retErr = err
-			}
-		}()
-		go func() {
-			defer close(sendToServerErr)
-			_, err := io.Copy(destConn, io.MultiReader(extraBufferedData, srcConn))
-			if err != nil {
-				err = fmt.Errorf("error sending to dest: %w %T", err, err)
-			}
-			sendToServerErr <- err
-		}()
-
-		// and read from resp
-		_, err = io.Copy(srcConn, destConn)
-		if err != nil {
-			return fmt.Errorf("error getting response from server: %w", err)
-		}
-		return nil
+		return pipe(destConn, srcConn, io.MultiReader(extraBufferedData, srcConn))
 	}(); err != nil {
 		if errors.Is(err, syscall.ECONNRESET) {
 			// ignore, this seems normal when client disconnects early
@@ -317,6 +437,57 @@ func (s *httpServer) handleConnect(w http.ResponseWriter, _ *http.Request) {
 	}
 }
 
+// dialTLS connects to our other server which handles MITM. ci is available to requests
+// made over the connection, until it is closed.
+func (s *httpServer) dialTLS(ci *ClientInfo) (net.Conn, error) {
+	destConn, err := net.DialTimeout("tcp", s.tlsAddr, 10*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("error dialing upstream: %w", err)
+	}
+
+	// we must store this before any data is sent, so it is there before any request arrives
+	tunnelKey := destConn.LocalAddr().String()
+	s.tunnels.Store(tunnelKey, ci)
+	return &tunnelConn{Conn: destConn, onClose: func() { s.tunnels.Delete(tunnelKey) }}, nil
+}
+
+type tunnelConn struct {
+	net.Conn
+	onClose func()
+}
+
+func (tc *tunnelConn) Close() error {
+	tc.onClose()
+	return tc.Conn.Close()
+}
+
+// pipe copies data between dest and src until src is finished with. srcReader should read from src.
+func pipe(destConn, srcConn net.Conn, srcReader io.Reader) (retErr error) {
+	// send data to server
+	sendToServerErr := make(chan error, 1)
+	defer func() {
+		// make sure we read this err as that forces us to wait for go func to finish
+		if err := <-sendToServerErr; retErr == nil && err != nil {
+			retErr = err
+		}
+	}()
+	go func() {
+		defer close(sendToServerErr)
+		_, err := io.Copy(destConn, srcReader)
+		if err != nil {
+			err = fmt.Errorf("error sending to dest: %w %T", err, err)
+		}
+		sendToServerErr <- err
+	}()
+
+	// and read from resp
+	_, err := io.Copy(srcConn, destConn)
+	if err != nil {
+		return fmt.Errorf("error getting response from server: %w", err)
+	}
+	return nil
+}
+
 func (s *httpServer) makeCertFor(chi *tls.ClientHelloInfo) (*tls.Certificate, error) {
 	leaf := &x509.Certificate{
 		SerialNumber:          big.NewInt(2),
@@ -0,0 +1,146 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxyserver
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// first byte of a TLS handshake record
+const tlsRecordTypeHandshake = 0x16
+
+// serveRaw accepts connections on l until ctx is done, and passes each to handle
+func (s *httpServer) serveRaw(ctx context.Context, l net.Listener, httpConns *connListener, handle func(ctx context.Context, c net.Conn, listenAddr string, httpConns *connListener) error) {
+	go func() {
+		<-ctx.Done()
+		l.Close() // httpConns is closed by the server that accepts from it
+	}()
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if ctx.Err() == nil && !errors.Is(err, net.ErrClosed) {
+				logrus.Errorf("error accepting connection: %v", err)
+			}
+			return
+		}
+		go func() {
+			if err := handle(ctx, c, l.Addr().String(), httpConns); err != nil && !errors.Is(err, syscall.ECONNRESET) && !errors.Is(err, net.ErrClosed) {
+				logrus.Warnf("error handling connection on %s: %v", l.Addr(), err)
+			}
+		}()
+	}
+}
+
+// handleTransparent serves a connection that was meant for an origin server
+func (s *httpServer) handleTransparent(ctx context.Context, c net.Conn, listenAddr string, httpConns *connListener) error {
+	return s.routeRaw(ctx, c, connTag{addr: listenAddr}, httpConns)
+}
+
+// routeRaw sends TLS connections to our MITM server, which picks the host from SNI,
+// and passes anything else to httpConns.
+func (s *httpServer) routeRaw(ctx context.Context, c net.Conn, tag connTag, httpConns *connListener) (retErr error) {
+	// peek at the first byte to see what we have, without waiting forever for it
+	br := bufio.NewReader(c)
+	c.SetReadDeadline(time.Now().Add(30 * time.Second))
+	first, err := br.Peek(1)
+	if err != nil {
+		c.Close()
+		return err
+	}
+	c.SetReadDeadline(time.Time{})
+	bc := &bufferedConn{Conn: c, r: br}
+
+	if first[0] != tlsRecordTypeHandshake {
+		// the main server takes ownership of the connection
+		return httpConns.push(ctx, &taggedConn{Conn: bc, tag: tag})
+	}
+
+	defer func() {
+		if err := c.Close(); err != nil && retErr == nil && !errors.Is(err, net.ErrClosed) {
+			retErr = err
+		}
+	}()
+	destConn, err := s.dialTLS(&ClientInfo{ListenAddr: tag.addr, Username: tag.username})
+	if err != nil {
+		return err
+	}
+	defer destConn.Close()
+	return pipe(destConn, c, br)
+}
+
+// bufferedConn reads from r, which has already read from the Conn
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (bc *bufferedConn) Read(b []byte) (int, error) {
+	return bc.r.Read(b)
+}
+
+// connListener is a net.Listener for connections which have been accepted elsewhere
+type connListener struct {
+	addr   net.Addr
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{
+		addr:   addr,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+func (cl *connListener) push(ctx context.Context, c net.Conn) error {
+	select {
+	case cl.conns <- c:
+		return nil
+	case <-cl.closed:
+	case <-ctx.Done():
+	}
+	c.Close()
+	return net.ErrClosed
+}
+
+func (cl *connListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-cl.conns:
+		return c, nil
+	case <-cl.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (cl *connListener) Close() error {
+	cl.once.Do(func() {
+		close(cl.closed)
+	})
+	return nil
+}
+
+func (cl *connListener) Addr() net.Addr {
+	return cl.addr
+}
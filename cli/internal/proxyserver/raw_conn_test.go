@@ -0,0 +1,102 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxyserver
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serveForTest runs a proxy server with cfg until fn returns. The handler responds with what it
+// was told about each request.
+func serveForTest(t *testing.T, cfg ProxyServerConfig, fn func(info ServerInfo)) {
+	cfg.HttpListenAddr = "127.0.0.1:0"
+	cfg.HttpsListenAddr = "127.0.0.1:0"
+	cfg.Handler = func(w http.ResponseWriter, r *http.Request) {
+		ci, ok := ClientInfoFromContext(r.Context())
+		if !assert.True(t, ok) {
+			return
+		}
+		w.Header().Set("X-Listen-Addr", ci.ListenAddr)
+		w.Header().Set("X-Username", ci.Username)
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		_, _ = io.WriteString(w, scheme+"://"+r.Host+r.URL.Path)
+	}
+	require.NoError(t, ServeUntilDone(context.Background(), cfg, func(ctx context.Context, info ServerInfo) error {
+		fn(info)
+		return nil
+	}))
+}
+
+// testGet fetches u with transport, returning the body
+func testGet(t *testing.T, transport *http.Transport, u string) (*http.Response, string) {
+	transport.DisableKeepAlives = true
+	resp, err := (&http.Client{Transport: transport}).Get(u)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	bb, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode, string(bb))
+	return resp, string(bb)
+}
+
+func trusting(caPem []byte) *tls.Config {
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(caPem)
+	return &tls.Config{RootCAs: pool}
+}
+
+func TestTransparent(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+
+	serveForTest(t, ProxyServerConfig{TransparentListeners: []net.Listener{l}}, func(info ServerInfo) {
+		// as if the client connected to the origin server, and was redirected to us
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, addr)
+			},
+			TLSClientConfig: trusting(info.CAPem),
+		}
+		for _, u := range []string{"http://example.com/plain", "https://example.com/tls"} {
+			resp, body := testGet(t, transport, u)
+			assert.Equal(t, u, body) // host from the Host header, or SNI
+			assert.Equal(t, addr, resp.Header.Get("X-Listen-Addr"))
+			assert.Empty(t, resp.Header.Get("X-Username"))
+		}
+
+		// and the normal proxy still works
+		proxyAddr := "http://" + info.ProxyAddr
+		resp, body := testGet(t, &http.Transport{
+			Proxy:           func(*http.Request) (*url.URL, error) { return url.Parse(proxyAddr) },
+			TLSClientConfig: trusting(info.CAPem),
+		}, "https://example.com/proxied")
+		assert.Equal(t, "https://example.com/proxied", body)
+		assert.Equal(t, "127.0.0.1:0", resp.Header.Get("X-Listen-Addr")) // as configured
+	})
+}
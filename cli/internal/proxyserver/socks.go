@@ -0,0 +1,176 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxyserver
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// See RFC 1928 and RFC 1929
+const (
+	socksVersion = 5
+
+	socksAuthNone         = 0
+	socksAuthUserPass     = 2
+	socksAuthNoAcceptable = 0xff
+	socksUserPassVersion  = 1
+
+	socksCmdConnect = 1
+
+	socksAtypIPv4   = 1
+	socksAtypDomain = 3
+	socksAtypIPv6   = 4
+
+	socksRepSuccess          = 0
+	socksRepCmdNotSupported  = 7
+	socksRepAtypNotSupported = 8
+)
+
+var errSocksAtypNotSupported = errors.New("address type not supported")
+
+// handleSocks does the SOCKS5 handshake, and then serves the connection as if it were transparent.
+// We don't connect to the destination requested, so it is ignored - the host for each request comes
+// from SNI or the Host header, as usual. This means that clients never need to resolve names themselves.
+func (s *httpServer) handleSocks(ctx context.Context, c net.Conn, listenAddr string, httpConns *connListener) error {
+	c.SetDeadline(time.Now().Add(30 * time.Second))
+	username, err := socksHandshake(c)
+	if err != nil {
+		c.Close()
+		return fmt.Errorf("error in SOCKS handshake: %w", err)
+	}
+	c.SetDeadline(time.Time{})
+
+	return s.routeRaw(ctx, c, connTag{addr: listenAddr, username: username}, httpConns)
+}
+
+// socksHandshake negotiates authentication and reads a CONNECT request, replying success to it.
+// Any username is accepted, as it is only used for selecting which manifest to use.
+func socksHandshake(c io.ReadWriter) (username string, err error) {
+	// greeting: version, number of methods, methods
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(c, hdr); err != nil {
+		return "", err
+	}
+	if hdr[0] != socksVersion {
+		return "", fmt.Errorf("unsupported SOCKS version: %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return "", err
+	}
+
+	method := byte(socksAuthNoAcceptable)
+	for _, m := range methods {
+		if m == socksAuthUserPass || (m == socksAuthNone && method == socksAuthNoAcceptable) {
+			method = m
+		}
+	}
+	if _, err := c.Write([]byte{socksVersion, method}); err != nil {
+		return "", err
+	}
+	switch method {
+	case socksAuthNoAcceptable:
+		return "", errors.New("no acceptable authentication methods")
+	case socksAuthUserPass:
+		username, err = socksReadUserPass(c)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// request: version, command, reserved, address type, address, port
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(c, req); err != nil {
+		return "", err
+	}
+	if req[0] != socksVersion {
+		return "", fmt.Errorf("unsupported SOCKS version: %d", req[0])
+	}
+	if err := socksReadAddr(c, req[3]); err != nil {
+		if errors.Is(err, errSocksAtypNotSupported) {
+			socksReply(c, socksRepAtypNotSupported)
+		}
+		return "", err
+	}
+	if req[1] != socksCmdConnect {
+		socksReply(c, socksRepCmdNotSupported)
+		return "", fmt.Errorf("unsupported SOCKS command: %d", req[1])
+	}
+
+	if err := socksReply(c, socksRepSuccess); err != nil {
+		return "", err
+	}
+	return username, nil
+}
+
+func socksReadUserPass(c io.ReadWriter) (string, error) {
+	// version, username length, username, password length, password
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(c, hdr); err != nil {
+		return "", err
+	}
+	if hdr[0] != socksUserPassVersion {
+		return "", fmt.Errorf("unsupported SOCKS username/password version: %d", hdr[0])
+	}
+	username := make([]byte, hdr[1])
+	if _, err := io.ReadFull(c, username); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(c, hdr[:1]); err != nil {
+		return "", err
+	}
+	if _, err := io.CopyN(io.Discard, c, int64(hdr[0])); err != nil {
+		return "", err
+	}
+	if _, err := c.Write([]byte{socksUserPassVersion, 0}); err != nil {
+		return "", err
+	}
+	return string(username), nil
+}
+
+// socksReadAddr reads (and discards) the destination address and port
+func socksReadAddr(c io.Reader, atyp byte) error {
+	var n int64
+	switch atyp {
+	case socksAtypIPv4:
+		n = net.IPv4len
+	case socksAtypIPv6:
+		n = net.IPv6len
+	case socksAtypDomain:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(c, l); err != nil {
+			return err
+		}
+		n = int64(l[0])
+	default:
+		return errSocksAtypNotSupported
+	}
+	_, err := io.CopyN(io.Discard, c, n+2)
+	return err
+}
+
+func socksReply(c io.Writer, rep byte) error {
+	// we always report our bound address as 0.0.0.0:0, as it is not meaningful here
+	reply := []byte{socksVersion, rep, 0, socksAtypIPv4, 0, 0, 0, 0}
+	reply = binary.BigEndian.AppendUint16(reply, 0)
+	_, err := c.Write(reply)
+	return err
+}
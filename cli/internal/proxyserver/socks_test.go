@@ -0,0 +1,130 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxyserver
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// socksConn reads what the client sends from in, and records our replies in out
+type socksConn struct {
+	in  *bytes.Reader
+	out bytes.Buffer
+}
+
+func (sc *socksConn) Read(b []byte) (int, error)  { return sc.in.Read(b) }
+func (sc *socksConn) Write(b []byte) (int, error) { return sc.out.Write(b) }
+
+func TestSocksHandshake(t *testing.T) {
+	success := []byte{5, socksRepSuccess, 0, 1, 0, 0, 0, 0, 0, 0}
+	connectDomain := []byte{5, 1, 0, 3, 11, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 1, 187}
+	for _, tc := range []struct {
+		name     string
+		in       [][]byte
+		username string
+		out      [][]byte
+		error    string
+	}{
+		{
+			name: "no auth, ipv4",
+			in:   [][]byte{{5, 1, 0}, {5, 1, 0, 1, 10, 0, 0, 1, 0, 80}},
+			out:  [][]byte{{5, 0}, success},
+		},
+		{
+			name: "no auth, ipv6",
+			in:   [][]byte{{5, 1, 0}, {5, 1, 0, 4}, make([]byte, 16), {0, 80}},
+			out:  [][]byte{{5, 0}, success},
+		},
+		{
+			name:     "username preferred",
+			in:       [][]byte{{5, 2, 2, 0}, {1, 4, 'p', 'r', 'o', 'j', 2, 'p', 'w'}, connectDomain},
+			username: "proj",
+			out:      [][]byte{{5, 2}, {1, 0}, success},
+		},
+		{
+			name:  "no acceptable methods",
+			in:    [][]byte{{5, 1, 1}},
+			out:   [][]byte{{5, 0xff}},
+			error: "no acceptable authentication methods",
+		},
+		{
+			name:  "socks4",
+			in:    [][]byte{{4, 1, 0, 80, 10, 0, 0, 1, 0}},
+			error: "unsupported SOCKS version: 4",
+		},
+		{
+			name:  "bind",
+			in:    [][]byte{{5, 1, 0}, {5, 2, 0, 1, 10, 0, 0, 1, 0, 80}},
+			out:   [][]byte{{5, 0}, {5, socksRepCmdNotSupported, 0, 1, 0, 0, 0, 0, 0, 0}},
+			error: "unsupported SOCKS command: 2",
+		},
+		{
+			name:  "bad address type",
+			in:    [][]byte{{5, 1, 0}, {5, 1, 0, 9}},
+			out:   [][]byte{{5, 0}, {5, socksRepAtypNotSupported, 0, 1, 0, 0, 0, 0, 0, 0}},
+			error: "address type not supported",
+		},
+		{
+			name:  "bad username/password version",
+			in:    [][]byte{{5, 1, 2}, {2, 0, 0}},
+			out:   [][]byte{{5, 2}},
+			error: "unsupported SOCKS username/password version: 2",
+		},
+		{
+			name:  "truncated",
+			in:    [][]byte{{5, 1, 0}, {5, 1, 0, 3, 11, 'e', 'x'}},
+			out:   [][]byte{{5, 0}},
+			error: "EOF",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sc := &socksConn{in: bytes.NewReader(bytes.Join(tc.in, nil))}
+			username, err := socksHandshake(sc)
+			if tc.error != "" {
+				assert.ErrorContains(t, err, tc.error)
+			} else {
+				require.NoError(t, err)
+				assert.Zero(t, sc.in.Len(), "unread input")
+			}
+			assert.Equal(t, tc.username, username)
+			assert.Equal(t, string(bytes.Join(tc.out, nil)), sc.out.String())
+		})
+	}
+}
+
+func TestSocks(t *testing.T) {
+	serveForTest(t, ProxyServerConfig{SocksListenAddr: "127.0.0.1:0"}, func(info ServerInfo) {
+		require.NotEmpty(t, info.SocksAddr)
+		for _, user := range []*url.Userinfo{nil, url.UserPassword("proj", "ignored")} {
+			proxyURL := &url.URL{Scheme: "socks5", Host: info.SocksAddr, User: user}
+			transport := &http.Transport{
+				Proxy:           http.ProxyURL(proxyURL),
+				TLSClientConfig: trusting(info.CAPem),
+			}
+			for _, u := range []string{"http://example.com/plain", "https://example.com/tls"} {
+				resp, body := testGet(t, transport, u)
+				assert.Equal(t, u, body)
+				assert.Equal(t, info.SocksAddr, resp.Header.Get("X-Listen-Addr"))
+				assert.Equal(t, user.Username(), resp.Header.Get("X-Username"))
+			}
+		}
+	})
+}
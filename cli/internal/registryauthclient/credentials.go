@@ -0,0 +1,268 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registryauthclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Docker Hub credentials are stored under this, rather than a host name
+	dockerHubServer = "https://index.docker.io/v1/"
+
+	// a helper returns this as the username if the secret is an identity token
+	identityTokenUsername = "<token>"
+
+	// how long a credential helper may take, as it may be waiting on a keychain or network
+	helperTimeout = 30 * time.Second
+)
+
+// Credentials for a registry. If IdentityToken is set, it is exchanged for
+// access tokens, otherwise Username and Password are used.
+type Credentials struct {
+	Username      string
+	Password      string
+	IdentityToken string
+}
+
+// CredentialStore looks up credentials for a registry host, e.g. ghcr.io
+type CredentialStore interface {
+	Get(ctx context.Context, host string) (Credentials, bool, error)
+}
+
+type authEntry struct {
+	Auth          string `json:"auth"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	IdentityToken string `json:"identitytoken"`
+}
+
+type configFile struct {
+	Auths       map[string]authEntry `json:"auths"`
+	CredHelpers map[string]string    `json:"credHelpers"`
+	CredsStore  string               `json:"credsStore"`
+}
+
+var _ CredentialStore = &DockerConfig{}
+
+// DockerConfig reads credentials in the same way as docker, from the files in
+// Paths, in order. In each, a credHelpers entry for the host is used first,
+// else credsStore, which run docker-credential-<name>, else auths. As with
+// docker, auths isn't used for a host that a helper is configured for.
+type DockerConfig struct {
+	Paths []string
+
+	once    sync.Once
+	loadErr error
+	files   []configFile
+
+	mu     sync.Mutex
+	byHost map[string]Credentials // from helpers, which may be slow
+}
+
+// DefaultConfigPaths returns $REGISTRY_AUTH_FILE, if set, then
+// $DOCKER_CONFIG/config.json, else ~/.docker/config.json
+func DefaultConfigPaths() []string {
+	var rv []string
+	if p := os.Getenv("REGISTRY_AUTH_FILE"); p != "" {
+		rv = append(rv, p)
+	}
+	if d := os.Getenv("DOCKER_CONFIG"); d != "" {
+		rv = append(rv, filepath.Join(d, "config.json"))
+	} else if home, err := os.UserHomeDir(); err == nil {
+		rv = append(rv, filepath.Join(home, ".docker", "config.json"))
+	}
+	return rv
+}
+
+var (
+	defaultCredentialsOnce sync.Once
+	defaultCredentials     *DockerConfig
+)
+
+// DefaultCredentials returns a DockerConfig for DefaultConfigPaths, shared by
+// all callers, which isn't read until first needed
+func DefaultCredentials() *DockerConfig {
+	defaultCredentialsOnce.Do(func() {
+		defaultCredentials = &DockerConfig{Paths: DefaultConfigPaths()}
+	})
+	return defaultCredentials
+}
+
+func (dc *DockerConfig) load() error {
+	dc.once.Do(func() {
+		dc.byHost = make(map[string]Credentials)
+		for _, p := range dc.Paths {
+			bb, err := os.ReadFile(p)
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				dc.loadErr = fmt.Errorf("error reading registry credentials: %w", err)
+				return
+			}
+			var cf configFile
+			if err := json.Unmarshal(bb, &cf); err != nil {
+				dc.loadErr = fmt.Errorf("error parsing registry credentials in %s: %w", p, err)
+				return
+			}
+			logrus.Debugf("Loaded registry credentials from %s", p)
+			dc.files = append(dc.files, cf)
+		}
+	})
+	return dc.loadErr
+}
+
+// serverKeys returns the keys that credentials for host may be stored under
+func serverKeys(host string) []string {
+	switch host {
+	case "docker.io", "index.docker.io", "registry-1.docker.io":
+		return []string{dockerHubServer, "docker.io", "index.docker.io", "registry-1.docker.io"}
+	default:
+		return []string{host}
+	}
+}
+
+// normalizeServer strips any scheme and path from an auths key, e.g. https://ghcr.io/v1/
+func normalizeServer(k string) string {
+	if k == dockerHubServer {
+		return k
+	}
+	k = strings.TrimPrefix(strings.TrimPrefix(k, "https://"), "http://")
+	host, _, _ := strings.Cut(k, "/")
+	return host
+}
+
+func (dc *DockerConfig) Get(ctx context.Context, host string) (Credentials, bool, error) {
+	if err := dc.load(); err != nil {
+		return Credentials{}, false, err
+	}
+
+	// keys are in order of preference, so look for each in turn
+	keys := serverKeys(host)
+	for _, cf := range dc.files {
+		helper := cf.CredsStore
+		for _, want := range keys {
+			if h, ok := cf.CredHelpers[want]; ok {
+				helper = h
+				break
+			}
+		}
+		if helper != "" {
+			creds, found, err := dc.fromHelper(ctx, helper, keys[0])
+			if err != nil || found {
+				return creds, found, err
+			}
+			continue // the helper is used instead of auths, so try the next file
+		}
+
+		auths := slices.Sorted(maps.Keys(cf.Auths))
+		for _, want := range keys {
+			for _, k := range auths {
+				if normalizeServer(k) != want {
+					continue
+				}
+				creds, err := cf.Auths[k].credentials()
+				if err != nil {
+					return Credentials{}, false, fmt.Errorf("bad credentials for %s: %w", k, err)
+				}
+				if creds != (Credentials{}) {
+					return creds, true, nil
+				}
+			}
+		}
+	}
+	return Credentials{}, false, nil
+}
+
+func (e authEntry) credentials() (Credentials, error) {
+	rv := Credentials{
+		Username:      e.Username,
+		Password:      e.Password,
+		IdentityToken: e.IdentityToken,
+	}
+	if e.Auth != "" {
+		bb, err := base64.StdEncoding.DecodeString(e.Auth)
+		if err != nil {
+			return Credentials{}, fmt.Errorf("error decoding auth: %w", err)
+		}
+		user, pass, ok := strings.Cut(string(bb), ":")
+		if !ok {
+			return Credentials{}, errors.New("auth is not user:password")
+		}
+		rv.Username, rv.Password = user, pass
+	}
+	return rv, nil
+}
+
+type helperResp struct {
+	Username string `json:"Username"`
+	Secret   string `json:"Secret"`
+}
+
+// fromHelper runs docker-credential-<helper> get, see https://github.com/docker/docker-credential-helpers.
+// Results are cached, and other lookups wait for this one, so it is killed if it takes too long.
+func (dc *DockerConfig) fromHelper(ctx context.Context, helper, server string) (Credentials, bool, error) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	if creds, ok := dc.byHost[server]; ok {
+		return creds, creds != (Credentials{}), nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, helperTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "docker-credential-"+helper, "get")
+	cmd.WaitDelay = time.Second // in case it has started something else that holds its output open
+	cmd.Stdin = strings.NewReader(server)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stdout.String() + stderr.String())
+		if strings.Contains(msg, "credentials not found") {
+			dc.byHost[server] = Credentials{}
+			return Credentials{}, false, nil
+		}
+		return Credentials{}, false, fmt.Errorf("error running docker-credential-%s for %s: %w: %s", helper, server, err, msg)
+	}
+
+	var hr helperResp
+	if err := json.Unmarshal(stdout.Bytes(), &hr); err != nil {
+		return Credentials{}, false, fmt.Errorf("error parsing output of docker-credential-%s: %w", helper, err)
+	}
+	creds := Credentials{Username: hr.Username, Password: hr.Secret}
+	if hr.Username == identityTokenUsername {
+		creds = Credentials{IdentityToken: hr.Secret}
+	}
+	dc.byHost[server] = creds
+	return creds, creds != (Credentials{}), nil
+}
@@ -0,0 +1,113 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registryauthclient
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDockerConfig(t *testing.T) {
+	dir := t.TempDir()
+
+	// a helper that knows one server, as in https://github.com/docker/docker-credential-helpers
+	helper := `#!/bin/sh
+read server
+case "$server" in
+example.com) echo '{"ServerURL":"example.com","Username":"<token>","Secret":"identity"}' ;;
+*) echo "credentials not found in native keychain"; exit 1 ;;
+esac
+`
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "docker-credential-fake"), []byte(helper), 0o755))
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	authFile := filepath.Join(dir, "auth.json")
+	require.NoError(t, os.WriteFile(authFile, []byte(`{"auths":{"ghcr.io":{"username":"first","password":"pass"}}}`), 0o644))
+	configFile := filepath.Join(dir, "config.json")
+	require.NoError(t, os.WriteFile(configFile, []byte(`{
+		"auths": {
+			"docker.io": {"auth": "b3RoZXI6cGFzcw=="},
+			"https://index.docker.io/v1/": {"auth": "dXNlcjpwYXNz"},
+			"ghcr.io": {"auth": "c2Vjb25kOnBhc3M="},
+			"https://quay.io/v1/": {"identitytoken": "quay-token"},
+			"example.com": {"auth": "c3RhbGU6cGFzcw=="}
+		},
+		"credHelpers": {"example.com": "fake"}
+	}`), 0o644))
+
+	dc := &DockerConfig{Paths: []string{authFile, configFile, filepath.Join(dir, "missing.json")}}
+	for _, tc := range []struct {
+		Host  string
+		Found bool
+		Creds Credentials
+	}{
+		{Host: "registry-1.docker.io", Found: true, Creds: Credentials{Username: "user", Password: "pass"}},
+		{Host: "ghcr.io", Found: true, Creds: Credentials{Username: "first", Password: "pass"}},
+		{Host: "quay.io", Found: true, Creds: Credentials{IdentityToken: "quay-token"}},
+		{Host: "example.com", Found: true, Creds: Credentials{IdentityToken: "identity"}}, // not the stale auths entry
+		{Host: "other.example.com"},
+	} {
+		creds, found, err := dc.Get(context.Background(), tc.Host)
+		require.NoError(t, err, tc.Host)
+		assert.Equal(t, tc.Found, found, tc.Host)
+		assert.Equal(t, tc.Creds, creds, tc.Host)
+	}
+
+	// with a credsStore, auths isn't used, even if the store has nothing
+	storeFile := filepath.Join(dir, "store.json")
+	require.NoError(t, os.WriteFile(storeFile, []byte(`{
+		"auths": {"ghcr.io": {"auth": "c3RhbGU6cGFzcw=="}, "example.com": {}},
+		"credsStore": "fake"
+	}`), 0o644))
+	dc = &DockerConfig{Paths: []string{storeFile, configFile}}
+	for _, tc := range []struct {
+		Host  string
+		Found bool
+		Creds Credentials
+	}{
+		{Host: "example.com", Found: true, Creds: Credentials{IdentityToken: "identity"}},
+		{Host: "ghcr.io", Found: true, Creds: Credentials{Username: "second", Password: "pass"}}, // from the next file
+	} {
+		creds, found, err := dc.Get(context.Background(), tc.Host)
+		require.NoError(t, err, tc.Host)
+		assert.Equal(t, tc.Found, found, tc.Host)
+		assert.Equal(t, tc.Creds, creds, tc.Host)
+	}
+
+	require.NoError(t, os.WriteFile(authFile, []byte(`{`), 0o644))
+	_, _, err := (&DockerConfig{Paths: []string{authFile}}).Get(context.Background(), "ghcr.io")
+	assert.Error(t, err)
+}
+
+func TestDockerConfigHelperCancelled(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "docker-credential-hung"), []byte("#!/bin/sh\nsleep 60\n"), 0o755))
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	configFile := filepath.Join(dir, "config.json")
+	require.NoError(t, os.WriteFile(configFile, []byte(`{"credsStore": "hung"}`), 0o644))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, _, err := (&DockerConfig{Paths: []string{configFile}}).Get(ctx, "ghcr.io")
+	assert.ErrorContains(t, err, "error running docker-credential-hung")
+	assert.Less(t, time.Since(start), 10*time.Second)
+}
@@ -15,140 +15,283 @@
 package registryauthclient
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"regexp"
+	"strings"
 	"sync"
 	"time"
 
 	www "github.com/gboddin/go-www-authenticate-parser"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// used if a token response doesn't say
+	defaultTokenTTL = 60 * time.Second
+
+	// sent when exchanging an identity token
+	clientID = "htvend"
 )
 
 var (
-	dockerRegistryRegex = regexp.MustCompile("^(https?://.*/v2/)([^/]+/[^/]+)/(blobs|manifests)/.*$")
+	// repositories may be nested, e.g. /v2/org/team/img/manifests/latest, and
+	// uploads go to e.g. /v2/org/img/blobs/uploads/<id>. Other paths under /v2/
+	// may not be a registry at all, so are left alone.
+	dockerRegistryRegex = regexp.MustCompile("^(https?://[^/]+/v2/)(.+?)/(?:blobs|manifests|referrers|tags|uploads)/")
 )
 
+// Client authenticates requests to registries, by responding to 401 challenges
+// for Bearer tokens or Basic auth, using credentials from a CredentialStore if
+// there are any, else anonymously. Auth is cached per repository. Requests that
+// already have an Authorization header are passed through as-is, and if a
+// challenge can't be answered, the 401 response is returned.
 type Client struct {
-	upstream http.RoundTripper
+	upstream    http.RoundTripper
+	credentials CredentialStore
 
-	mu     sync.Mutex
-	tokens map[string]cachedToken
+	mu    sync.Mutex
+	cache map[string]cachedAuth
 }
 
-type cachedToken struct {
-	Token string
-	TTL   time.Time
+type cachedAuth struct {
+	Header string    // value for Authorization
+	TTL    time.Time // zero if it doesn't expire
 }
 
 type tokenResp struct {
-	Token     string `json:"token"`
-	ExpiresIn int    `json:"expires_in"`
+	Token       string `json:"token"`
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
 }
 
+// NewClient returns a client using credentials from DefaultCredentials
 func NewClient(upstream http.RoundTripper) http.RoundTripper {
+	return NewClientWithCredentials(upstream, DefaultCredentials())
+}
+
+// NewClientWithCredentials returns a client using creds, which may be nil for anonymous access only
+func NewClientWithCredentials(upstream http.RoundTripper, creds CredentialStore) *Client {
 	return &Client{
-		upstream: upstream,
-		tokens:   make(map[string]cachedToken),
+		upstream:    upstream,
+		credentials: creds,
+		cache:       make(map[string]cachedAuth),
 	}
 }
 
 func (c *Client) RoundTrip(r *http.Request) (*http.Response, error) {
-	if r.Method != http.MethodGet {
-		return c.upstream.RoundTrip(r)
-	}
 	regexResult := dockerRegistryRegex.FindStringSubmatch(r.URL.String())
-	if len(regexResult) != 4 {
+	if regexResult == nil || r.Header.Get("Authorization") != "" {
 		return c.upstream.RoundTrip(r)
 	}
-
-	// do we have a token?
 	key := regexResult[1] + regexResult[2]
-	c.mu.Lock()
-	val, ok := c.tokens[key]
-	if val.TTL.Before(time.Now()) {
-		delete(c.tokens, key)
-		ok = false
-	}
-	c.mu.Unlock()
-
-	if ok {
-		r.Header.Set("Authorization", "Bearer "+val.Token) // are we bad for modifying this?
-		return c.upstream.RoundTrip(r)
-	}
 
-	// else we expect to get a failure and we will check the result
-	resp, err := c.upstream.RoundTrip(r)
+	// we may need to send it more than once
+	r, err := replayable(r)
 	if err != nil {
-		return resp, err
+		return nil, err
 	}
 
-	if resp.StatusCode != http.StatusUnauthorized {
-		return resp, err
+	// do we have auth already?
+	c.mu.Lock()
+	val, ok := c.cache[key]
+	if ok && !val.TTL.IsZero() && val.TTL.Before(time.Now()) {
+		delete(c.cache, key)
+		val, ok = cachedAuth{}, false
 	}
+	c.mu.Unlock()
 
-	authenticateSettings := www.Parse(resp.Header.Get("Www-Authenticate"))
-	if authenticateSettings.AuthType != "Bearer" {
+	resp, err := c.send(r, val.Header)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
 		return resp, err
 	}
 
-	realm, ok := authenticateSettings.Params["realm"]
-	if !ok {
-		return resp, err
+	// if it's no longer accepted, e.g. revoked early, forget it and try once more
+	if ok {
+		logrus.Debugf("Cached auth for %s was rejected", key)
+		c.mu.Lock()
+		delete(c.cache, key)
+		c.mu.Unlock()
 	}
 
-	service, ok := authenticateSettings.Params["service"]
-	if !ok {
-		return resp, err
+	header, ok, err := c.authFor(r.Context(), r.URL.Host, resp.Header.Get("Www-Authenticate"))
+	if err != nil {
+		logrus.Warnf("error authenticating to %s, returning the 401: %v", r.URL.Host, err)
+		return resp, nil
 	}
-
-	scope, ok := authenticateSettings.Params["scope"]
 	if !ok {
-		return resp, err
+		return resp, nil
 	}
 
-	// OK, we will do our request, kill the old resp
+	// OK, we will redo our request, kill the old resp
 	err = resp.Body.Close()
 	if err != nil {
 		return nil, fmt.Errorf("error closing response that we're ignoring: %w", err)
 	}
 
-	ar, err := http.NewRequest(http.MethodGet, realm+"?"+url.Values{
-		"scope":   []string{scope},
-		"service": []string{service},
-	}.Encode(), nil)
+	c.mu.Lock()
+	c.cache[key] = header
+	c.mu.Unlock()
+
+	return c.send(r, header.Header)
+}
+
+// send a copy of r, with the Authorization header if set, keeping the other
+// headers, e.g. Accept for manifests
+func (c *Client) send(r *http.Request, authorization string) (*http.Response, error) {
+	fr := r.Clone(r.Context())
+	if r.GetBody != nil {
+		body, err := r.GetBody()
+		if err != nil {
+			return nil, fmt.Errorf("error getting request body: %w", err)
+		}
+		fr.Body = body
+	}
+	if authorization != "" {
+		fr.Header.Set("Authorization", authorization)
+	}
+	return c.upstream.RoundTrip(fr)
+}
+
+// replayable returns r, or a copy of it which can be sent more than once
+func replayable(r *http.Request) (*http.Request, error) {
+	if r.Body == nil || r.Body == http.NoBody || r.GetBody != nil {
+		return r, nil
+	}
+	bb, err := io.ReadAll(r.Body)
 	if err != nil {
-		return nil, fmt.Errorf("error making GET request: %w", err)
+		return nil, fmt.Errorf("error reading request body: %w", err)
 	}
+	if err := r.Body.Close(); err != nil {
+		return nil, fmt.Errorf("error closing request body: %w", err)
+	}
+	rv := r.Clone(r.Context())
+	rv.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(bb)), nil
+	}
+	return rv, nil
+}
+
+// authFor answers the challenge in the Www-Authenticate header. It returns false
+// if it can't, e.g. if Basic auth is asked for but we have no credentials.
+func (c *Client) authFor(ctx context.Context, host, challenge string) (cachedAuth, bool, error) {
+	var creds Credentials
+	var haveCreds bool
+	if c.credentials != nil {
+		var err error
+		creds, haveCreds, err = c.credentials.Get(ctx, host)
+		if err != nil {
+			return cachedAuth{}, false, err
+		}
+	}
+
+	authenticateSettings := www.Parse(challenge)
+	switch {
+	case strings.EqualFold(authenticateSettings.AuthType, "Basic"):
+		if !haveCreds || creds.Username == "" {
+			return cachedAuth{}, false, nil
+		}
+		return cachedAuth{
+			Header: "Basic " + base64.StdEncoding.EncodeToString([]byte(creds.Username+":"+creds.Password)),
+		}, true, nil
+
+	case strings.EqualFold(authenticateSettings.AuthType, "Bearer"):
+		realm, ok := authenticateSettings.Params["realm"]
+		if !ok {
+			return cachedAuth{}, false, nil
+		}
+		token, ttl, err := c.fetchToken(ctx, realm, authenticateSettings.Params["service"], authenticateSettings.Params["scope"], creds)
+		if err != nil {
+			return cachedAuth{}, false, err
+		}
+		return cachedAuth{
+			Header: "Bearer " + token,
+			TTL:    time.Now().Add(ttl),
+		}, true, nil
 
-	resp, err = c.upstream.RoundTrip(ar)
+	default:
+		return cachedAuth{}, false, nil
+	}
+}
+
+// fetchToken gets a Bearer token from realm. An identity token is exchanged
+// via OAuth2, else a username and password, if any, are sent as Basic auth.
+func (c *Client) fetchToken(ctx context.Context, realm, service, scope string, creds Credentials) (string, time.Duration, error) {
+	var ar *http.Request
+	var err error
+	if creds.IdentityToken != "" {
+		form := url.Values{
+			"grant_type":    []string{"refresh_token"},
+			"refresh_token": []string{creds.IdentityToken},
+			"client_id":     []string{clientID},
+		}
+		if service != "" {
+			form.Set("service", service)
+		}
+		if scope != "" {
+			form.Set("scope", scope)
+		}
+		ar, err = http.NewRequestWithContext(ctx, http.MethodPost, realm, strings.NewReader(form.Encode()))
+		if err != nil {
+			return "", 0, fmt.Errorf("error making POST request: %w", err)
+		}
+		ar.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		q := url.Values{}
+		if service != "" {
+			q.Set("service", service)
+		}
+		if scope != "" {
+			q.Set("scope", scope)
+		}
+		if creds.Username != "" {
+			q.Set("account", creds.Username)
+		}
+		ar, err = http.NewRequestWithContext(ctx, http.MethodGet, realm+"?"+q.Encode(), nil)
+		if err != nil {
+			return "", 0, fmt.Errorf("error making GET request: %w", err)
+		}
+		if creds.Username != "" {
+			ar.SetBasicAuth(creds.Username, creds.Password)
+		}
+	}
+
+	resp, err := c.upstream.RoundTrip(ar)
 	if err != nil {
-		return nil, fmt.Errorf("error making upstream RT: %w", err)
+		return "", 0, fmt.Errorf("error making upstream RT: %w", err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("error getting token from %s: %s", realm, resp.Status)
+	}
+
 	var tr tokenResp
 	err = json.NewDecoder(resp.Body).Decode(&tr)
 	if err != nil {
-		return nil, fmt.Errorf("error getting token: %w", err)
+		return "", 0, fmt.Errorf("error getting token: %w", err)
 	}
-	if tr.Token == "" {
-		return nil, fmt.Errorf("error got blank token")
+	token := tr.Token
+	if token == "" {
+		token = tr.AccessToken
 	}
-
-	c.mu.Lock()
-	c.tokens[key] = cachedToken{
-		Token: tr.Token,
-		TTL:   time.Now().Add(time.Second * time.Duration(tr.ExpiresIn-10)),
+	if token == "" {
+		return "", 0, fmt.Errorf("error got blank token")
 	}
-	c.mu.Unlock()
 
-	fr, err := http.NewRequest(http.MethodGet, r.URL.String(), nil)
-	if err != nil {
-		return nil, fmt.Errorf("error making final request: %w", err)
+	ttl := defaultTokenTTL
+	if tr.ExpiresIn > 0 {
+		ttl = time.Second * time.Duration(tr.ExpiresIn)
 	}
-	fr.Header.Set("Authorization", "Bearer "+tr.Token)
-
-	return c.upstream.RoundTrip(fr)
+	// allow for clock skew and time in flight
+	if ttl > 20*time.Second {
+		ttl -= 10 * time.Second
+	}
+	return token, ttl, nil
 }
@@ -0,0 +1,181 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registryauthclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type staticCredentials map[string]Credentials
+
+func (s staticCredentials) Get(_ context.Context, host string) (Credentials, bool, error) {
+	c, ok := s[host]
+	return c, ok, nil
+}
+
+// fakeRegistry issues a new token for each token request, and only accepts the latest
+type fakeRegistry struct {
+	srv *httptest.Server
+
+	basic bool // challenge for Basic, not Bearer
+
+	mu     sync.Mutex
+	issued int
+	bodies []string
+}
+
+func newFakeRegistry(t *testing.T, basic bool) *fakeRegistry {
+	fr := &fakeRegistry{basic: basic}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		var ok bool
+		if r.Method == http.MethodPost {
+			ok = r.FormValue("grant_type") == "refresh_token" && r.FormValue("refresh_token") == "identity"
+		} else {
+			user, pass, _ := r.BasicAuth()
+			ok = user == "user" && pass == "pass" && r.URL.Query().Get("account") == "user"
+		}
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fr.mu.Lock()
+		fr.issued++
+		token := fmt.Sprintf("token-%d", fr.issued)
+		fr.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]any{"access_token": token, "expires_in": 300})
+	})
+	mux.HandleFunc("/v2/", func(w http.ResponseWriter, r *http.Request) {
+		fr.mu.Lock()
+		want := fmt.Sprintf("Bearer token-%d", fr.issued)
+		if fr.basic {
+			want = "Basic dXNlcjpwYXNz" // user:pass
+		}
+		fr.mu.Unlock()
+		if r.Header.Get("Authorization") != want {
+			if fr.basic {
+				w.Header().Set("Www-Authenticate", `Basic realm="reg"`)
+			} else {
+				w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="reg",scope="repository:org/img:pull,push"`, fr.srv.URL))
+			}
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		bb, _ := io.ReadAll(r.Body)
+		fr.mu.Lock()
+		fr.bodies = append(fr.bodies, string(bb))
+		fr.mu.Unlock()
+		w.Write([]byte("ok"))
+	})
+	fr.srv = httptest.NewServer(mux)
+	t.Cleanup(fr.srv.Close)
+	return fr
+}
+
+func (fr *fakeRegistry) host() string {
+	return strings.TrimPrefix(fr.srv.URL, "http://")
+}
+
+func TestClient(t *testing.T) {
+	for _, tc := range []struct {
+		Name  string
+		Basic bool
+		Creds Credentials
+	}{
+		{Name: "bearer with password", Creds: Credentials{Username: "user", Password: "pass"}},
+		{Name: "bearer with identity token", Creds: Credentials{IdentityToken: "identity"}},
+		{Name: "basic", Basic: true, Creds: Credentials{Username: "user", Password: "pass"}},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			fr := newFakeRegistry(t, tc.Basic)
+			client := &http.Client{Transport: NewClientWithCredentials(http.DefaultTransport, staticCredentials{fr.host(): tc.Creds})}
+
+			// HEAD, and a body that must be sent again after the challenge
+			resp, err := client.Head(fr.srv.URL + "/v2/org/img/manifests/latest")
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+			resp, err = client.Post(fr.srv.URL+"/v2/org/img/blobs/uploads/", "", io.NopCloser(strings.NewReader("hello")))
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, []string{"", "hello"}, fr.bodies)
+
+			if tc.Basic {
+				return
+			}
+
+			// a token rejected early is replaced
+			fr.mu.Lock()
+			fr.issued++
+			fr.mu.Unlock()
+			resp, err = client.Get(fr.srv.URL + "/v2/org/img/blobs/sha256:abc")
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, 3, fr.issued)
+		})
+	}
+
+	// without credentials, the 401 is returned
+	fr := newFakeRegistry(t, true)
+	resp, err := (&http.Client{Transport: NewClientWithCredentials(http.DefaultTransport, nil)}).Get(fr.srv.URL + "/v2/org/img/manifests/latest")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestClientPassesThrough(t *testing.T) {
+	fr := newFakeRegistry(t, false)
+	client := &http.Client{Transport: NewClientWithCredentials(http.DefaultTransport, staticCredentials{fr.host(): {Username: "user", Password: "wrong"}})}
+	get := func(path, authorization string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, fr.srv.URL+path, nil)
+		require.NoError(t, err)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	// if the token can't be fetched, the original 401 is returned, with its challenge
+	resp := get("/v2/org/img/manifests/latest", "")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("Www-Authenticate"), "Bearer")
+
+	// not a registry path, or the caller has its own auth, so no token is asked for
+	for _, tc := range []struct{ path, authorization string }{
+		{"/v2/users/me", ""},
+		{"/v2/org/img/manifests/latest", "Bearer mine"},
+	} {
+		resp := get(tc.path, tc.authorization)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, tc.path)
+	}
+	assert.Equal(t, 0, fr.issued)
+}
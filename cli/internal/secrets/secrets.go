@@ -0,0 +1,212 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package secrets keeps credentials out of manifests and logs. Headers that
+// may carry them are never cached. Query parameters that sign a presigned URL,
+// such as for S3, are scrubbed from manifest keys, and those with names that
+// suggest a credential, such as token, are also redacted from logs.
+package secrets
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Redacted replaces the values of anything sensitive, the same as url.URL.Redacted() does for passwords
+const Redacted = "xxxxx"
+
+// sensitiveHeaders may carry credentials, so are never cached or logged
+var sensitiveHeaders = map[string]bool{
+	"Authorization":                  true,
+	"Proxy-Authorization":            true,
+	"Cookie":                         true,
+	"Set-Cookie":                     true,
+	"Set-Cookie2":                    true,
+	"X-Amz-Security-Token":           true,
+	"X-Goog-Iam-Authorization-Token": true,
+	"X-Registry-Auth":                true,
+	"Private-Token":                  true, // GitLab
+	"Job-Token":                      true, // GitLab CI
+	"Deploy-Token":                   true,
+}
+
+// sensitiveHeaderWords are matched against each dash-separated word of a header name, e.g. X-Api-Key
+var sensitiveHeaderWords = []string{"token", "secret", "password", "apikey", "credential", "session"}
+
+// presignedParams are only used to sign URLs, lower case
+var presignedParams = map[string]bool{
+	// S3 presigned URLs (SigV4 and V2)
+	"x-amz-signature":      true,
+	"x-amz-credential":     true,
+	"x-amz-security-token": true,
+	"awsaccesskeyid":       true,
+
+	// GCS signed URLs
+	"x-goog-signature":  true,
+	"x-goog-credential": true,
+	"googleaccessid":    true,
+}
+
+// signatureParams have generic names, so are only treated as signing a URL
+// if it also has one of the other parameters given, lower case
+var signatureParams = map[string][]string{
+	"signature": {"awsaccesskeyid", "key-pair-id"}, // S3 V2, CloudFront
+	"sig":       {"sv"},                            // Azure SAS
+}
+
+// sensitiveParams may carry credentials, but may also be part of what
+// identifies an asset, so are only redacted from logs, lower case
+var sensitiveParams = map[string]bool{
+	"signature":     true,
+	"sig":           true,
+	"token":         true,
+	"access_token":  true,
+	"refresh_token": true,
+	"id_token":      true,
+	"api_key":       true,
+	"apikey":        true,
+	"password":      true,
+	"passwd":        true,
+	"secret":        true,
+	"client_secret": true,
+	"jwt":           true,
+	"auth":          true,
+}
+
+// IsSensitiveHeader returns true if the header named k may carry credentials
+func IsSensitiveHeader(k string) bool {
+	k = http.CanonicalHeaderKey(k)
+	if sensitiveHeaders[k] {
+		return true
+	}
+	words := strings.Split(strings.ToLower(k), "-")
+	for i, w := range words {
+		// join pairs too, so that X-Api-Key matches apikey
+		if i+1 < len(words) {
+			words = append(words, w+words[i+1])
+		}
+	}
+	for _, w := range words {
+		for _, sw := range sensitiveHeaderWords {
+			if w == sw {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsSensitiveParam returns true if the query parameter named k may carry credentials
+func IsSensitiveParam(k string) bool {
+	k = strings.ToLower(k)
+	return presignedParams[k] || sensitiveParams[k]
+}
+
+// isPresignedParam returns true if the query parameter named k signs the URL,
+// given the lower case names of all its parameters
+func isPresignedParam(k string, names map[string]bool) bool {
+	k = strings.ToLower(k)
+	if presignedParams[k] {
+		return true
+	}
+	for _, other := range signatureParams[k] {
+		if names[other] {
+			return true
+		}
+	}
+	return false
+}
+
+// RedactURL returns u as a string for logging, with any password and the
+// values of sensitive query parameters replaced.
+func RedactURL(u *url.URL) string {
+	return redactURL(u, func(k string, _ map[string]bool) bool {
+		return IsSensitiveParam(k)
+	})
+}
+
+// ScrubURL returns u as a string for use as a manifest key, with any password
+// and the values of query parameters that sign a presigned URL replaced. Other
+// parameters, even if they may carry a credential, are kept, as they may also
+// identify the asset. As the order of parameters is kept, the result is stable.
+func ScrubURL(u *url.URL) string {
+	return redactURL(u, isPresignedParam)
+}
+
+// RedactURLString is RedactURL for a URL that hasn't been parsed. If it can't
+// be parsed, it is returned as-is.
+func RedactURLString(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return s
+	}
+	return RedactURL(u)
+}
+
+func redactURL(u *url.URL, sensitive func(k string, names map[string]bool) bool) string {
+	if u == nil {
+		return ""
+	}
+	rawQuery, changed := redactQuery(u.RawQuery, sensitive)
+	if !changed {
+		return u.Redacted()
+	}
+	u2 := *u
+	u2.RawQuery = rawQuery
+	return u2.Redacted()
+}
+
+func redactQuery(rawQuery string, sensitive func(k string, names map[string]bool) bool) (string, bool) {
+	if rawQuery == "" {
+		return rawQuery, false
+	}
+	names := paramNames(rawQuery)
+	parts := strings.Split(rawQuery, "&")
+	changed := false
+	for i, p := range parts {
+		k, v, hasValue := strings.Cut(p, "=")
+		if hasValue && v != Redacted && sensitive(unescapeParam(k), names) {
+			parts[i] = k + "=" + Redacted
+			changed = true
+		}
+	}
+	return strings.Join(parts, "&"), changed
+}
+
+// paramNames returns the lower case names of all query parameters
+func paramNames(rawQuery string) map[string]bool {
+	rv := make(map[string]bool)
+	for _, p := range strings.Split(rawQuery, "&") {
+		k, _, _ := strings.Cut(p, "=")
+		rv[strings.ToLower(unescapeParam(k))] = true
+	}
+	return rv
+}
+
+func unescapeParam(k string) string {
+	name, err := url.QueryUnescape(k)
+	if err != nil {
+		return k
+	}
+	return name
+}
+
+// RedactHeaderValue returns v, or a placeholder if the header named k is sensitive, for logging
+func RedactHeaderValue(k, v string) string {
+	if IsSensitiveHeader(k) {
+		return Redacted
+	}
+	return v
+}
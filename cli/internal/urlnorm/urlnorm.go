@@ -0,0 +1,214 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package urlnorm normalizes URLs before they are used as manifest keys, so
+// that URLs which vary between runs, such as presigned URLs with expiring
+// signatures, are recorded under a key that is the same each time.
+package urlnorm
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const (
+	// stripAll in Rule.StripParams removes the whole query
+	stripAll = "*"
+
+	rewriteSeparator = "=>"
+)
+
+// Rule removes query parameters from URLs it applies to
+type Rule struct {
+	// If set, the rule only applies to hosts matching this
+	Hosts *regexp.Regexp
+
+	// If set, the rule only applies to URLs with this query parameter
+	IfParam string
+
+	// Query parameters to remove, or "*" for all of them. Case-insensitive.
+	StripParams []string
+}
+
+var (
+	amzV4Params = []string{"X-Amz-Algorithm", "X-Amz-Credential", "X-Amz-Date", "X-Amz-Expires", "X-Amz-SignedHeaders", "X-Amz-Signature", "X-Amz-Security-Token"}
+	azureParams = []string{"sv", "ss", "srt", "sp", "se", "st", "spr", "sig", "sr", "si", "sip", "ses", "skoid", "sktid", "skt", "ske", "sks", "skv", "sdd", "saoid", "suoid", "scid"}
+)
+
+// Presets are the built-in rules, by name
+var Presets = map[string][]Rule{
+	// presigned S3 URLs, including S3-compatible stores, SigV4 and V2
+	"s3": {
+		{IfParam: "X-Amz-Signature", StripParams: amzV4Params},
+		{IfParam: "AWSAccessKeyId", StripParams: []string{"AWSAccessKeyId", "Signature", "Expires", "X-Amz-Security-Token"}},
+	},
+
+	// signed GCS URLs, V4 and V2
+	"gcs": {
+		{IfParam: "X-Goog-Signature", StripParams: []string{"X-Goog-Algorithm", "X-Goog-Credential", "X-Goog-Date", "X-Goog-Expires", "X-Goog-SignedHeaders", "X-Goog-Signature"}},
+		{IfParam: "GoogleAccessId", StripParams: []string{"GoogleAccessId", "Expires", "Signature"}},
+	},
+
+	// Azure storage SAS tokens
+	"azure": {
+		{Hosts: regexp.MustCompile(`\.(blob|file|dfs)\.core\.windows\.net$`), IfParam: "sig", StripParams: azureParams},
+	},
+
+	// GitHub release downloads redirect to these, with short-lived signatures
+	// and tokens. Paths include the asset ID, so the query isn't needed.
+	"github": {
+		{Hosts: regexp.MustCompile(`^(objects|objects-origin|release-assets|github-releases)\.githubusercontent\.com$`), StripParams: []string{stripAll}},
+		{Hosts: regexp.MustCompile(`^raw\.githubusercontent\.com$`), StripParams: []string{"token"}},
+	},
+
+	// CloudFront signed URLs, including on custom domains
+	"cloudfront": {
+		{IfParam: "Key-Pair-Id", StripParams: []string{"Expires", "Signature", "Key-Pair-Id", "Policy"}},
+	},
+}
+
+// PresetNames returns the names of all of the presets, sorted
+func PresetNames() []string {
+	rv := make([]string, 0, len(Presets))
+	for k := range Presets {
+		rv = append(rv, k)
+	}
+	slices.Sort(rv)
+	return rv
+}
+
+type rewrite struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// Normalizer applies rules to URLs. A nil Normalizer leaves URLs unchanged.
+type Normalizer struct {
+	rules    []Rule
+	rewrites []rewrite
+}
+
+// New returns a Normalizer for the named presets, query parameters
+// to strip from every URL, and rewrites of the whole URL, each of the form
+// REGEX=>REPLACEMENT, where the replacement may refer to groups, e.g. $1.
+func New(presets, stripParams, rewrites []string) (*Normalizer, error) {
+	rv := &Normalizer{}
+	for _, name := range presets {
+		rules, ok := Presets[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown URL preset %q, expected one of: %s", name, strings.Join(PresetNames(), ", "))
+		}
+		rv.rules = append(rv.rules, rules...)
+	}
+	if len(stripParams) != 0 {
+		rv.rules = append(rv.rules, Rule{StripParams: stripParams})
+	}
+	for _, s := range rewrites {
+		pattern, replacement, ok := strings.Cut(s, rewriteSeparator)
+		if !ok {
+			return nil, fmt.Errorf("bad URL rewrite %q, expected REGEX%sREPLACEMENT", s, rewriteSeparator)
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("bad URL rewrite regex %q: %w", pattern, err)
+		}
+		rv.rewrites = append(rv.rewrites, rewrite{pattern: re, replacement: replacement})
+	}
+	return rv, nil
+}
+
+// Normalize returns u, or a normalized copy of it. Parameters are removed
+// first, then the rewrites applied in order.
+func (n *Normalizer) Normalize(u *url.URL) *url.URL {
+	if n == nil || u == nil {
+		return u
+	}
+
+	rv := u
+	for _, rule := range n.rules {
+		if rule.Hosts != nil && !rule.Hosts.MatchString(rv.Hostname()) {
+			continue
+		}
+		rawQuery, changed := stripQuery(rv.RawQuery, rule)
+		if !changed {
+			continue
+		}
+		u2 := *rv
+		u2.RawQuery = rawQuery
+		u2.ForceQuery = false
+		rv = &u2
+	}
+
+	if len(n.rewrites) == 0 {
+		return rv
+	}
+	s := rv.String()
+	for _, rw := range n.rewrites {
+		s = rw.pattern.ReplaceAllString(s, rw.replacement)
+	}
+	if s == rv.String() {
+		return rv
+	}
+	u2, err := url.Parse(s)
+	if err != nil {
+		return rv // leave it rather than fail the request, as it's only a key
+	}
+	return u2
+}
+
+// stripQuery removes parameters from rawQuery, keeping the rest as they were
+func stripQuery(rawQuery string, rule Rule) (string, bool) {
+	if rawQuery == "" {
+		return rawQuery, false
+	}
+	parts := strings.Split(rawQuery, "&")
+	names := make([]string, len(parts))
+	for i, p := range parts {
+		k, _, _ := strings.Cut(p, "=")
+		name, err := url.QueryUnescape(k)
+		if err != nil {
+			name = k
+		}
+		names[i] = name
+	}
+
+	if rule.IfParam != "" && !slices.ContainsFunc(names, func(name string) bool {
+		return strings.EqualFold(name, rule.IfParam)
+	}) {
+		return rawQuery, false
+	}
+
+	var kept []string
+	for i, p := range parts {
+		if !stripped(rule.StripParams, names[i]) {
+			kept = append(kept, p)
+		}
+	}
+	if len(kept) == len(parts) {
+		return rawQuery, false
+	}
+	return strings.Join(kept, "&"), true
+}
+
+func stripped(stripParams []string, name string) bool {
+	for _, sp := range stripParams {
+		if sp == stripAll || strings.EqualFold(sp, name) {
+			return true
+		}
+	}
+	return false
+}
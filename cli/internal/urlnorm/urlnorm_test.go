@@ -0,0 +1,66 @@
+// Copyright 2025 Continusec Pty Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package urlnorm
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalize(t *testing.T) {
+	all, err := New(PresetNames(), []string{"build_id"}, []string{`^(https://ci\.example\.com/artifacts/)[0-9]+/=>${1}N/`})
+	require.NoError(t, err)
+
+	for in, want := range map[string]string{
+		// unchanged
+		"https://example.com/a.tgz":                 "https://example.com/a.tgz",
+		"https://example.com/a?z=1&a=2&Signature=x": "https://example.com/a?z=1&a=2&Signature=x",
+
+		"https://bucket.s3.us-east-1.amazonaws.com/a.tgz?X-Amz-Algorithm=AWS4-HMAC-SHA256&X-Amz-Credential=AKIA%2F20250101%2Fus-east-1%2Fs3%2Faws4_request&X-Amz-Date=20250101T000000Z&X-Amz-Expires=300&X-Amz-SignedHeaders=host&x-id=GetObject&X-Amz-Signature=abc": "https://bucket.s3.us-east-1.amazonaws.com/a.tgz?x-id=GetObject",
+		"https://bucket.s3.amazonaws.com/a.tgz?AWSAccessKeyId=AKIA&Expires=1700000000&Signature=abc":                         "https://bucket.s3.amazonaws.com/a.tgz",
+		"https://storage.googleapis.com/b/a.tgz?X-Goog-Algorithm=GOOG4-RSA-SHA256&X-Goog-Date=20250101&X-Goog-Signature=abc": "https://storage.googleapis.com/b/a.tgz",
+		"https://acct.blob.core.windows.net/c/a.tgz?sv=2024-11-04&se=2025-01-01&sr=b&sp=r&rscd=attachment&sig=abc":           "https://acct.blob.core.windows.net/c/a.tgz?rscd=attachment",
+		"https://release-assets.githubusercontent.com/github-production-release-asset/1/2?sp=r&jwt=abc&filename=a.tgz":       "https://release-assets.githubusercontent.com/github-production-release-asset/1/2",
+		"https://d111.cloudfront.net/a.tgz?Expires=1700000000&Signature=abc&Key-Pair-Id=K1":                                  "https://d111.cloudfront.net/a.tgz",
+
+		// custom
+		"https://example.com/a.tgz?build_id=7&v=1":               "https://example.com/a.tgz?v=1",
+		"https://ci.example.com/artifacts/1234/out.tgz?build_id": "https://ci.example.com/artifacts/N/out.tgz",
+	} {
+		u, err := url.Parse(in)
+		require.NoError(t, err)
+		got := all.Normalize(u)
+		assert.Equal(t, want, got.String(), in)
+		assert.Equal(t, want, all.Normalize(got).String(), in) // stable
+		assert.Equal(t, in, u.String(), in)                    // not modified
+	}
+
+	none, err := New(nil, nil, nil)
+	require.NoError(t, err)
+	u, err := url.Parse("https://bucket.s3.amazonaws.com/a.tgz?AWSAccessKeyId=AKIA&Expires=1700000000&Signature=abc")
+	require.NoError(t, err)
+	assert.Equal(t, u, none.Normalize(u))
+	assert.Equal(t, u, (*Normalizer)(nil).Normalize(u))
+
+	_, err = New([]string{"bad"}, nil, nil)
+	assert.Error(t, err)
+	_, err = New(nil, nil, []string{"no-separator"})
+	assert.Error(t, err)
+	_, err = New(nil, nil, []string{"(=>x"})
+	assert.Error(t, err)
+}